@@ -0,0 +1,66 @@
+//go:build !appengine
+// +build !appengine
+
+// Command gopherpaint runs GopherPaint without App Engine.
+//
+// The serve command serves the web app. Everything is stored in the
+// data directory, and users are either signed in as a single local
+// user, only on a loopback address, or given by an authenticating
+// reverse proxy:
+//
+//	gopherpaint serve -listen 127.0.0.1:8080 -data /var/lib/gopherpaint -auth single
+//	gopherpaint serve -listen :8080 -auth header -auth-header X-Forwarded-User
+//
+// It can also sign in with an OpenID Connect provider, or with the
+// users of a password file managed with the passwd command:
+//
+//	gopherpaint serve -auth oidc -oidc-issuer https://sso.example.com -oidc-client-id paint
+//	gopherpaint passwd -file passwords alice < password.txt
+//	gopherpaint serve -auth password -passwords passwords
+//
+// The render command paints files from the command line, with the
+// same styles and pipelines as the web app. By default the paintings
+// go to a painted directory next to each input:
+//
+//	gopherpaint render -style impresionist -size 1200 photos/
+//	gopherpaint render -pipeline oilcanvas -seed 7 -format jpeg -out out/{name}-{seed}.{ext} a.png b.jpg
+//
+// Without a command, gopherpaint serves.
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+const usage = `usage: gopherpaint <command> [flags]
+
+commands:
+  serve   serve the web app
+  render  paint image files
+  passwd  set a password of the password authentication
+
+Run gopherpaint <command> -h for the flags of a command.
+`
+
+func main() {
+	args := os.Args[1:]
+	cmd := "serve"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		cmd, args = args[0], args[1:]
+	}
+	switch cmd {
+	case "serve":
+		serve(args)
+	case "render":
+		render(args)
+	case "passwd":
+		passwd(args)
+	case "help":
+		fmt.Print(usage)
+	default:
+		fmt.Fprintf(os.Stderr, "gopherpaint: unknown command %q\n\n%s", cmd, usage)
+		os.Exit(2)
+	}
+}
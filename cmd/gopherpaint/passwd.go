@@ -0,0 +1,42 @@
+//go:build !appengine
+// +build !appengine
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"gopherpaint"
+	"log"
+	"os"
+	"strings"
+)
+
+var (
+	passwdFlags = flag.NewFlagSet("passwd", flag.ExitOnError)
+
+	passwdFile = passwdFlags.String("file", "passwords", "password file")
+)
+
+// passwd sets the password of a user of the password authentication,
+// read from the standard input.
+func passwd(args []string) {
+	passwdFlags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: gopherpaint passwd [-file passwords] user < password\n\n")
+		passwdFlags.PrintDefaults()
+	}
+	passwdFlags.Parse(args)
+	if passwdFlags.NArg() != 1 {
+		passwdFlags.Usage()
+		os.Exit(2)
+	}
+	password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	password = strings.TrimRight(password, "\r\n")
+	if password == "" {
+		log.Fatalf("no password given: %v", err)
+	}
+	if err := gopherpaint.SetPassword(*passwdFile, passwdFlags.Arg(0), password); err != nil {
+		log.Fatal(err)
+	}
+}
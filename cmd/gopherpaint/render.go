@@ -0,0 +1,534 @@
+//go:build !appengine
+// +build !appengine
+
+package main
+
+import (
+	"errors"
+	"filters"
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	renderFlags = flag.NewFlagSet("render", flag.ExitOnError)
+
+	style      = renderFlags.String("style", "", "painting style, a filter or a pipeline ID (default "+filters.DefaultFilter+")")
+	pipelineID = renderFlags.String("pipeline", "", "ID of a predefined pipeline")
+	spec       = renderFlags.String("spec", "", "JSON pipeline spec, or @file to read it from a file")
+	size       = renderFlags.Int("size", 800, "longest side of the output, 0 keeps the size of the input")
+	seed       = renderFlags.Int64("seed", 0, "seed of the random strokes")
+	format     = renderFlags.String("format", "png", "output format: png, jpeg or gif")
+	quality    = renderFlags.Int("quality", 90, "quality of jpeg outputs")
+	outName    = renderFlags.String("out", "{dir}/painted/{name}_{style}.{ext}", "name of the outputs, with {dir}, {name}, {style}, {size}, {seed}, {ext} and {n}; inputs named like outputs are skipped")
+	workers    = renderFlags.Int("workers", runtime.NumCPU(), "number of images rendered at once")
+	palette    = renderFlags.String("palette", "", "palette: a built-in name, auto, reference or hex colors")
+	colors     = renderFlags.Int("colors", 8, "colors taken from each input with -palette auto")
+	dither     = renderFlags.Bool("dither", false, "dither the palette")
+	metric     = renderFlags.String("metric", "", "color difference: rgb, lab or ciede2000")
+	reference  = renderFlags.String("reference", "", "painting imitated by the reference style")
+	detail     = renderFlags.Float64("detail", 0, "from 0 to 1, how much more detail the subject gets than the background")
+	detailMap  = renderFlags.String("detailmap", "", "grayscale image, white where the strokes are finer and denser")
+	regionSpec = renderFlags.String("regions", "", "JSON regions painted in other styles, or @file to read them from a file; masks are file names")
+	sequence   = renderFlags.Bool("sequence", false, "paint the inputs, sorted by name, as the frames of one animated gif")
+	delay      = renderFlags.Int("delay", 10, "delay between the frames of -sequence, in hundredths of a second")
+	quiet      = renderFlags.Bool("quiet", false, "don't show the progress bar")
+	verbose    = renderFlags.Bool("v", false, "log what the filters do")
+)
+
+// imageExts are the extensions of the files taken from directories.
+var imageExts = map[string]bool{".png": true, ".jpg": true, ".jpeg": true, ".gif": true,
+	".tif": true, ".tiff": true, ".bmp": true, ".webp": true}
+
+// regions are painted over every painting, with their masks by file
+// name.
+var (
+	regions []filters.Region
+	masks   map[string]image.Image
+)
+
+// renderJob is an input file and where its painting goes.
+type renderJob struct {
+	in, out string
+}
+
+// render paints the files given in args.
+func render(args []string) {
+	renderFlags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: gopherpaint render [flags] file or directory...\n\n")
+		renderFlags.PrintDefaults()
+	}
+	renderFlags.Parse(args)
+	if renderFlags.NArg() == 0 {
+		renderFlags.Usage()
+		os.Exit(2)
+	}
+
+	pipeline, styleName, err := renderPipeline()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if _, err := filters.ParseColorMetric(*metric); err != nil {
+		log.Fatal(err)
+	}
+	ext, err := formatExt(*format)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var ref *filters.ReferenceStats
+	if *reference != "" {
+		m, err := decodeFile(*reference)
+		if err != nil {
+			log.Fatal(err)
+		}
+		ref = filters.AnalyzeReference(m)
+	}
+
+	if err := loadRegions(); err != nil {
+		log.Fatal(err)
+	}
+
+	inputs, err := inputFiles(renderFlags.Args())
+	if err != nil {
+		log.Fatal(err)
+	}
+	inputs = skipOutputs(inputs, styleName, ext)
+	if len(inputs) == 0 {
+		log.Fatal("no images to render")
+	}
+	if *sequence {
+		if *format != "gif" {
+			log.Fatal("-sequence needs -format gif")
+		}
+		sort.Strings(inputs)
+		out := outputName(*outName, inputs[0], styleName, ext, 1)
+		if err := renderSequence(inputs, out, pipeline, ref); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	jobs := make([]renderJob, len(inputs))
+	for i, in := range inputs {
+		jobs[i] = renderJob{in, outputName(*outName, in, styleName, ext, i+1)}
+	}
+
+	var bar *progressBar
+	if !*quiet {
+		bar = newProgressBar(os.Stderr, len(jobs))
+	}
+	var (
+		mu     sync.Mutex
+		failed []string
+		wg     sync.WaitGroup
+		queue  = make(chan renderJob)
+	)
+	n := *workers
+	if n < 1 {
+		n = 1
+	}
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range queue {
+				err := renderFile(job, pipeline, ref)
+				if err != nil {
+					mu.Lock()
+					failed = append(failed, fmt.Sprintf("%s: %v", job.in, err))
+					mu.Unlock()
+				}
+				bar.Step(filepath.Base(job.in))
+			}
+		}()
+	}
+	for _, job := range jobs {
+		queue <- job
+	}
+	close(queue)
+	wg.Wait()
+	bar.Done()
+
+	for _, f := range failed {
+		fmt.Fprintln(os.Stderr, f)
+	}
+	if len(failed) > 0 {
+		os.Exit(1)
+	}
+}
+
+// renderPipeline returns the pipeline asked for in the flags and the
+// style name used in the output names.
+func renderPipeline() (*filters.Pipeline, string, error) {
+	var (
+		p    *filters.Pipeline
+		name string
+		err  error
+	)
+	switch {
+	case *spec != "":
+		data := []byte(*spec)
+		if strings.HasPrefix(*spec, "@") {
+			data, err = ioutil.ReadFile((*spec)[1:])
+			if err != nil {
+				return nil, "", err
+			}
+		}
+		p, err = filters.ParsePipeline(data)
+		if err != nil {
+			return nil, "", err
+		}
+		name = "custom"
+	case *pipelineID != "":
+		var ok bool
+		p, ok = filters.Pipelines[*pipelineID]
+		if !ok {
+			return nil, "", errors.New("unknown pipeline " + *pipelineID)
+		}
+		name = *pipelineID
+	default:
+		name = *style
+		if name == "" {
+			name = filters.DefaultFilter
+		}
+		_, isFilter := filters.Registry[name]
+		if _, isPipeline := filters.Pipelines[name]; !isFilter && !isPipeline {
+			return nil, "", errors.New("unknown style " + name)
+		}
+		p = filters.StylePipeline(name)
+	}
+	return p, name, nil
+}
+
+// inputFiles expands the directories in args to the images inside.
+func inputFiles(args []string) ([]string, error) {
+	var res []string
+	for _, arg := range args {
+		fi, err := os.Stat(arg)
+		if err != nil {
+			return nil, err
+		}
+		if !fi.IsDir() {
+			res = append(res, arg)
+			continue
+		}
+		err = filepath.Walk(arg, func(path string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if !fi.IsDir() && imageExts[strings.ToLower(filepath.Ext(path))] {
+				res = append(res, path)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+// outputName fills the naming template for the n-th input.
+func outputName(tmpl, in, style, ext string, n int) string {
+	base := filepath.Base(in)
+	r := strings.NewReplacer(
+		"{dir}", filepath.Dir(in),
+		"{name}", strings.TrimSuffix(base, filepath.Ext(base)),
+		"{style}", style,
+		"{size}", strconv.Itoa(*size),
+		"{seed}", strconv.FormatInt(*seed, 10),
+		"{ext}", ext,
+		"{n}", strconv.Itoa(n),
+	)
+	return filepath.Clean(r.Replace(tmpl))
+}
+
+// skipOutputs leaves out the inputs that are the outputs of others, so
+// that runs over the outputs of earlier ones don't paint them again.
+func skipOutputs(inputs []string, style, ext string) []string {
+	outputs := make(map[string]bool)
+	for i, in := range inputs {
+		outputs[outputName(*outName, in, style, ext, i+1)] = true
+	}
+	var res []string
+	for _, in := range inputs {
+		if !outputs[filepath.Clean(in)] {
+			res = append(res, in)
+		}
+	}
+	return res
+}
+
+// renderFile paints one input and writes the result. Animated GIFs
+// are painted frame by frame when the output is a GIF too, otherwise
+// only their first frame is.
+func renderFile(job renderJob, pipeline *filters.Pipeline, ref *filters.ReferenceStats) error {
+	if *format == "gif" && strings.EqualFold(filepath.Ext(job.in), ".gif") {
+		a, err := decodeGIFFile(job.in)
+		if err != nil {
+			return err
+		}
+		if len(a.Frames) > 1 {
+			return renderAnimation(job.in, job.out, a, pipeline, ref)
+		}
+	}
+	m, err := decodeFile(job.in)
+	if err != nil {
+		return err
+	}
+	if *size > 0 {
+		m = filters.RescaleImage(m, *size)
+	}
+	m = filters.ToRGBA(m)
+	settings, err := renderSettings(job.in, m, ref)
+	if err != nil {
+		return err
+	}
+	painted := pipeline.Run(logger{}, m, settings)
+	if len(regions) > 0 {
+		painted = filters.PaintRegions(logger{}, painted, m, settings, regions, masks)
+	}
+	m = painted
+	return writeFile(job.out, func(w io.Writer) error {
+		return encode(w, m)
+	})
+}
+
+// renderSequence paints the inputs as the frames of an animation, that
+// is written to out.
+func renderSequence(inputs []string, out string, pipeline *filters.Pipeline, ref *filters.ReferenceStats) error {
+	a := &filters.Animation{}
+	for _, in := range inputs {
+		m, err := decodeFile(in)
+		if err != nil {
+			return err
+		}
+		if len(a.Frames) > 0 && m.Bounds().Size() != a.Frames[0].Bounds().Size() {
+			return fmt.Errorf("%s: the frames of a sequence must have the same size", in)
+		}
+		a.Frames = append(a.Frames, m)
+		a.Delays = append(a.Delays, *delay)
+	}
+	return renderAnimation(inputs[0], out, a, pipeline, ref)
+}
+
+// renderAnimation paints the frames of an animation and writes it as
+// an animated GIF.
+func renderAnimation(name, out string, a *filters.Animation, pipeline *filters.Pipeline, ref *filters.ReferenceStats) error {
+	for i, m := range a.Frames {
+		if *size > 0 {
+			m = filters.RescaleImage(m, *size)
+		}
+		a.Frames[i] = filters.ToRGBA(m)
+	}
+	settings, err := renderSettings(name, a.Frames[0], ref)
+	if err != nil {
+		return err
+	}
+	res := pipeline.RunAnimation(logger{}, a, settings)
+	if len(regions) > 0 {
+		res = filters.PaintAnimationRegions(logger{}, res, a, settings, regions, masks)
+	}
+	a = res
+	return writeFile(out, func(w io.Writer) error {
+		return filters.EncodeGIF(w, a, settings.Palette, settings.Dither)
+	})
+}
+
+// loadRegions reads the regions of the flags and their masks.
+func loadRegions() error {
+	if *regionSpec == "" {
+		return nil
+	}
+	data := []byte(*regionSpec)
+	if strings.HasPrefix(*regionSpec, "@") {
+		var err error
+		data, err = ioutil.ReadFile((*regionSpec)[1:])
+		if err != nil {
+			return err
+		}
+	}
+	var err error
+	regions, err = filters.ParseRegions(data)
+	if err != nil {
+		return err
+	}
+	masks = make(map[string]image.Image)
+	for _, r := range regions {
+		if r.Shape == filters.ShapeMask && masks[r.Mask] == nil {
+			if masks[r.Mask], err = decodeFile(r.Mask); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// renderSettings returns the settings asked for in the flags, m is
+// the image the palette is taken from.
+func renderSettings(name string, m image.Image, ref *filters.ReferenceStats) (*filters.PainterlySettings, error) {
+	settings := &filters.PainterlySettings{
+		Blobkey:   name,
+		Dither:    *dither,
+		Seed:      *seed,
+		Reference: ref,
+		Detail:    math.Max(0, math.Min(1, *detail)),
+	}
+	settings.Metric, _ = filters.ParseColorMetric(*metric)
+	var err error
+	if *detailMap != "" {
+		if settings.DetailMap, err = decodeFile(*detailMap); err != nil {
+			return nil, err
+		}
+	}
+	settings.Palette, err = renderPalette(m, ref)
+	return settings, err
+}
+
+// writeFile creates the file name, with its directory, and writes it
+// with write.
+func writeFile(name string, write func(io.Writer) error) error {
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	if err := write(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// renderPalette returns the palette asked for in the flags, the same
+// way the palette parameter of the web app does.
+func renderPalette(m image.Image, ref *filters.ReferenceStats) (color.Palette, error) {
+	switch {
+	case *palette == "":
+		return nil, nil
+	case *palette == "reference":
+		if ref == nil {
+			return nil, errors.New("the reference palette needs -reference")
+		}
+		return ref.ColorPalette(), nil
+	case *palette == "auto":
+		k := *colors
+		if k < 2 {
+			k = 8
+		}
+		return filters.ExtractPalette(m, k), nil
+	}
+	if p, ok := filters.Palettes[*palette]; ok {
+		return p, nil
+	}
+	return filters.ParsePalette(*palette)
+}
+
+func decodeFile(name string) (image.Image, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	m, _, err := image.Decode(f)
+	return m, err
+}
+
+func decodeGIFFile(name string) (*filters.Animation, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return filters.DecodeGIF(f, *size)
+}
+
+// formatExt returns the file extension of an output format.
+func formatExt(format string) (string, error) {
+	switch format {
+	case "png", "gif":
+		return format, nil
+	case "jpeg", "jpg":
+		return "jpg", nil
+	}
+	return "", fmt.Errorf("unknown format %q", format)
+}
+
+func encode(w io.Writer, m image.Image) error {
+	switch *format {
+	case "jpeg", "jpg":
+		return jpeg.Encode(w, m, &jpeg.Options{Quality: *quality})
+	case "gif":
+		return gif.Encode(w, m, nil)
+	}
+	return png.Encode(w, m)
+}
+
+// logger passes the messages of the filters to the log package when
+// -v is set.
+type logger struct{}
+
+func (logger) Infof(format string, args ...interface{}) {
+	if *verbose {
+		log.Printf(format, args...)
+	}
+}
+
+// progressBar draws how many images are done. A nil bar draws
+// nothing.
+type progressBar struct {
+	mu          sync.Mutex
+	w           io.Writer
+	done, total int
+}
+
+const progressWidth = 30
+
+func newProgressBar(w io.Writer, total int) *progressBar {
+	b := &progressBar{w: w, total: total}
+	b.draw("")
+	return b
+}
+
+// Step marks one more image as done.
+func (b *progressBar) Step(name string) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.done++
+	b.draw(name)
+}
+
+// Done ends the line of the bar.
+func (b *progressBar) Done() {
+	if b == nil {
+		return
+	}
+	fmt.Fprintln(b.w)
+}
+
+func (b *progressBar) draw(name string) {
+	filled := progressWidth * b.done / b.total
+	fmt.Fprintf(b.w, "\r[%s%s] %d/%d %-30.30s",
+		strings.Repeat("=", filled), strings.Repeat(" ", progressWidth-filled),
+		b.done, b.total, name)
+}
@@ -0,0 +1,101 @@
+//go:build !appengine
+// +build !appengine
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"image"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// setRenderFlags sets the render flags of args, and the others to their
+// defaults.
+func setRenderFlags(args ...string) {
+	renderFlags.VisitAll(func(f *flag.Flag) { f.Value.Set(f.DefValue) })
+	renderFlags.Parse(args)
+}
+
+func TestOutputName(t *testing.T) {
+	setRenderFlags("-size", "1200", "-seed", "7")
+	tests := []struct {
+		tmpl, in, expected string
+	}{
+		{renderFlags.Lookup("out").DefValue, "photos/a.jpg", "photos/painted/a_voronoi.png"},
+		{"{dir}/{name}_{style}.{ext}", "a.b.jpg", "a.b_voronoi.png"},
+		{"out/{name}-{size}-{seed}-{n}.{ext}", "/tmp/x/a.jpg", "out/a-1200-7-3.png"},
+		{"out/../{name}.{ext}", "a.jpg", "a.png"},
+		{"fixed.png", "a.jpg", "fixed.png"},
+	}
+	for _, test := range tests {
+		if given := outputName(test.tmpl, test.in, "voronoi", "png", 3); given != filepath.FromSlash(test.expected) {
+			t.Errorf("%v for %v: expected %v, given %v", test.tmpl, test.in, test.expected, given)
+		}
+	}
+}
+
+func TestSkipOutputs(t *testing.T) {
+	setRenderFlags()
+	inputs := []string{"photos/a.jpg", "photos/painted/a_voronoi.png", "photos/painted/b.png", "photos/b_voronoi.png"}
+	res := skipOutputs(inputs, "voronoi", "png")
+	if len(res) != 3 || res[1] != "photos/painted/b.png" {
+		t.Errorf("Expected the painting of a skipped, given %v", res)
+	}
+
+	setRenderFlags("-out", "{dir}/{name}_{style}.{ext}")
+	res = skipOutputs(inputs, "voronoi", "png")
+	if len(res) != 4 {
+		t.Errorf("Expected every input painted, given %v", res)
+	}
+}
+
+func TestRenderFileSeed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gopherpaint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	in := filepath.Join(dir, "photo.png")
+	m := image.NewNRGBA(image.Rect(0, 0, 32, 24))
+	for y := 0; y < 24; y++ {
+		for x := 0; x < 32; x++ {
+			m.SetNRGBA(x, y, color.NRGBA{uint8(x * 8), uint8(y * 10), 100, 255})
+		}
+	}
+	f, err := os.Create(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	png.Encode(f, m)
+	f.Close()
+
+	paint := func(seed, out string) []byte {
+		setRenderFlags("-style", "voronoi", "-seed", seed, "-size", "0")
+		pipeline, _, err := renderPipeline()
+		if err != nil {
+			t.Fatal(err)
+		}
+		out = filepath.Join(dir, out)
+		if err := renderFile(renderJob{in, out}, pipeline, nil); err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadFile(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+	first, second := paint("7", "first.png"), paint("7", "second.png")
+	if !bytes.Equal(first, second) {
+		t.Errorf("Expected equal paintings with the same seed")
+	}
+	if other := paint("8", "other.png"); bytes.Equal(first, other) {
+		t.Errorf("Expected another painting with another seed")
+	}
+}
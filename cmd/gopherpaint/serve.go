@@ -0,0 +1,197 @@
+//go:build !appengine
+// +build !appengine
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"gopherpaint"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	serveFlags = flag.NewFlagSet("serve", flag.ExitOnError)
+
+	listen      = serveFlags.String("listen", "127.0.0.1:8080", "address to listen on, only a loopback one with the single authentication")
+	storageName = serveFlags.String("storage", "local", "storage backend, only local is available outside App Engine")
+	dataDir     = serveFlags.String("data", "data", "directory of the local storage")
+	cacheMB     = serveFlags.Int64("cache-mb", 256, "size of the render cache, in megabytes")
+	templateDir = serveFlags.String("templates", "templates", "directory with the HTML templates")
+	staticDir   = serveFlags.String("static", "static", "directory with the static files")
+	authName    = serveFlags.String("auth", "single", "authentication: single, header, oidc or password")
+	userName    = serveFlags.String("user", "gopher", "user of the single authentication")
+	authHeader  = serveFlags.String("auth-header", "X-Forwarded-User", "header with the user of the header authentication")
+	emailHeader = serveFlags.String("auth-email-header", "X-Forwarded-Email", "header with the e-mail of the header authentication")
+	loginURL    = serveFlags.String("auth-login", "/oauth2/sign_in", "login URL of the header authentication")
+	logoutURL   = serveFlags.String("auth-logout", "/oauth2/sign_out", "logout URL of the header authentication")
+	admins      = serveFlags.String("admins", "", "comma separated e-mails, or user names with password authentication, of the administrators")
+	issuer      = serveFlags.String("oidc-issuer", "", "issuer URL of the OpenID Connect provider")
+	clientID    = serveFlags.String("oidc-client-id", "", "client ID registered in the OpenID Connect provider")
+	secretEnv   = serveFlags.String("oidc-client-secret-env", "GOPHERPAINT_OIDC_SECRET", "environment variable with the client secret")
+	redirectURL = serveFlags.String("oidc-redirect", "http://localhost:8080/auth/callback", "absolute URL of /auth/callback, as registered in the provider")
+	passwords   = serveFlags.String("passwords", "passwords", "password file of the password authentication, see gopherpaint passwd")
+	tiersFile   = serveFlags.String("tiers", "", "JSON file with the plans that limit the users, there are no limits by default")
+)
+
+// serve runs the web app.
+func serve(args []string) {
+	serveFlags.Parse(args)
+	if err := checkListen(*listen, *authName); err != nil {
+		log.Fatal(err)
+	}
+
+	if *storageName != "local" {
+		log.Fatalf("unknown storage %q", *storageName)
+	}
+	local, err := gopherpaint.NewLocalStorage(*dataDir, *cacheMB<<20)
+	if err != nil {
+		log.Fatalf("opening storage: %v", err)
+	}
+	defer local.Close()
+	st := local.Storage()
+
+	auth, err := authenticator(*dataDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	tiers, err := loadTiers(*tiersFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	mux, err := newServeMux(st, auth, tiers)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Printf("listening on %v", *listen)
+	if err := http.ListenAndServe(*listen, mux); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// newServeMux sets the app up with the storage, authentication and
+// plans, and returns its handlers with the static files.
+func newServeMux(st *gopherpaint.Storage, auth gopherpaint.Authenticator, tiers []gopherpaint.Tier) (*http.ServeMux, error) {
+	err := gopherpaint.Setup(gopherpaint.Config{
+		TemplateDir: *templateDir,
+		Storage:     func(r *http.Request) *gopherpaint.Storage { return st },
+		Auth:        auth,
+		Tiers:       tiers,
+	})
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir(*staticDir))))
+	gopherpaint.RegisterHandlers(mux)
+	return mux, nil
+}
+
+// checkListen refuses the single authentication, where whoever
+// connects is an administrator, on addresses other computers reach.
+func checkListen(addr, authName string) error {
+	if authName != "single" {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("listen address: %v", err)
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return fmt.Errorf("the single authentication lets anyone who connects in as an administrator, "+
+			"listen on a loopback address like 127.0.0.1:8080 or use another -auth, not on %q", addr)
+	}
+	return nil
+}
+
+func authenticator(dataDir string) (gopherpaint.Authenticator, error) {
+	switch *authName {
+	case "single":
+		return gopherpaint.SingleUserAuth{
+			User: gopherpaint.User{ID: *userName, Name: *userName, Admin: true},
+		}, nil
+	case "header":
+		return gopherpaint.HeaderAuth{
+			UserHeader:  *authHeader,
+			EmailHeader: *emailHeader,
+			Login:       *loginURL,
+			Logout:      *logoutURL,
+		}, nil
+	case "oidc":
+		sessions, err := sessions(dataDir)
+		if err != nil {
+			return nil, err
+		}
+		a, err := gopherpaint.NewOIDCAuth(*issuer, *clientID, os.Getenv(*secretEnv), *redirectURL, sessions)
+		if err != nil {
+			return nil, err
+		}
+		a.Admins = adminList()
+		return a, nil
+	case "password":
+		sessions, err := sessions(dataDir)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := os.Stat(*passwords); err != nil {
+			return nil, fmt.Errorf("password file: %v", err)
+		}
+		return &gopherpaint.PasswordAuth{File: *passwords, Admins: adminList(), Sessions: sessions}, nil
+	}
+	return nil, fmt.Errorf("unknown authentication %q", *authName)
+}
+
+// loadTiers reads the plans from file, a JSON list of tiers.
+func loadTiers(file string) ([]gopherpaint.Tier, error) {
+	if file == "" {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var tiers []gopherpaint.Tier
+	if err := json.Unmarshal(data, &tiers); err != nil {
+		return nil, fmt.Errorf("%v: %v", file, err)
+	}
+	return tiers, nil
+}
+
+func adminList() []string {
+	var res []string
+	for _, a := range strings.Split(*admins, ",") {
+		if a = strings.TrimSpace(a); a != "" {
+			res = append(res, a)
+		}
+	}
+	return res
+}
+
+// sessions signs the session cookies with the key in the data
+// directory, created the first time.
+func sessions(dataDir string) (*gopherpaint.Sessions, error) {
+	file := filepath.Join(dataDir, "session.key")
+	key, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+		err = ioutil.WriteFile(file, key, 0600)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &gopherpaint.Sessions{Key: key}, nil
+}
@@ -0,0 +1,130 @@
+//go:build !appengine
+// +build !appengine
+
+package main
+
+import (
+	"flag"
+	"gopherpaint"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// setServeFlags sets the serve flags of args, and the others to their
+// defaults.
+func setServeFlags(args ...string) {
+	serveFlags.VisitAll(func(f *flag.Flag) { f.Value.Set(f.DefValue) })
+	serveFlags.Parse(args)
+}
+
+func TestCheckListen(t *testing.T) {
+	tests := []struct {
+		addr, auth string
+		ok         bool
+	}{
+		{"127.0.0.1:8080", "single", true},
+		{"[::1]:8080", "single", true},
+		{"localhost:8080", "single", true},
+		{":8080", "single", false},
+		{"0.0.0.0:8080", "single", false},
+		{"192.0.2.1:80", "single", false},
+		{"8080", "single", false},
+		{":8080", "header", true},
+		{"0.0.0.0:8080", "oidc", true},
+	}
+	for _, test := range tests {
+		if err := checkListen(test.addr, test.auth); (err == nil) != test.ok {
+			t.Errorf("%v with %v: expected ok %v, given %v", test.addr, test.auth, test.ok, err)
+		}
+	}
+	if err := checkListen(serveFlags.Lookup("listen").DefValue, serveFlags.Lookup("auth").DefValue); err != nil {
+		t.Errorf("Expected the defaults to be accepted, given %v", err)
+	}
+}
+
+func TestAuthenticator(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gopherpaint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	setServeFlags("-auth", "single", "-user", "me")
+	a, err := authenticator(dir)
+	if u := a.Current(httptest.NewRequest("GET", "/", nil)); err != nil || u == nil || u.ID != "me" {
+		t.Errorf("Expected everyone signed in as me, given %+v (%v)", u, err)
+	}
+
+	setServeFlags("-auth", "header", "-auth-header", "X-User")
+	a, err = authenticator(dir)
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("X-User", "alice")
+	if u := a.Current(r); err != nil || u == nil || u.ID != "alice" {
+		t.Errorf("Expected the user of the header, given %+v (%v)", u, err)
+	}
+
+	passwords := filepath.Join(dir, "passwords")
+	setServeFlags("-auth", "password", "-passwords", passwords, "-admins", "alice, bob")
+	if _, err := authenticator(dir); err == nil {
+		t.Errorf("Expected an error without the password file")
+	}
+	gopherpaint.SetPassword(passwords, "alice", "secret")
+	a, err = authenticator(dir)
+	if p, ok := a.(*gopherpaint.PasswordAuth); err != nil || !ok || len(p.Admins) != 2 || p.Admins[1] != "bob" {
+		t.Errorf("Expected the password authentication with 2 admins, given %+v (%v)", a, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "session.key")); err != nil {
+		t.Errorf("Expected the session key created, given %v", err)
+	}
+
+	setServeFlags("-auth", "nobody")
+	if _, err := authenticator(dir); err == nil {
+		t.Errorf("Expected an unknown authentication refused")
+	}
+}
+
+func TestServeMux(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gopherpaint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	setServeFlags("-templates", "../../templates", "-static", "../../static")
+
+	local, err := gopherpaint.NewLocalStorage(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer local.Close()
+	auth := gopherpaint.HeaderAuth{UserHeader: "X-User"}
+	mux, err := newServeMux(local.Storage(), auth, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path, user string
+		status     int
+	}{
+		{"/static/logo.png", "", http.StatusOK},
+		{"/", "alice", http.StatusOK},
+		{"/api/v1/images", "alice", http.StatusOK},
+		{"/api/v1/images", "", http.StatusUnauthorized},
+		{"/admin/quotas", "alice", http.StatusForbidden},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", test.path, nil)
+		if test.user != "" {
+			r.Header.Set("X-User", test.user)
+		}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		if w.Code != test.status {
+			t.Errorf("%v: expected %v, given %v", test.path, test.status, w.Code)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package filters
+
+import (
+	"image"
+	"image/color"
+	"math"
+)
+
+// Adjustments are photo corrections applied before painting.
+// The zero value leaves the image untouched.
+type Adjustments struct {
+	// Exposure in stops, from -2 to 2.
+	Exposure float64
+	// Contrast, Saturation, Temperature and Tint go from -100 to 100.
+	Contrast   float64
+	Saturation float64
+	// Positive temperatures are warmer, negative are cooler.
+	Temperature float64
+	// Positive tints are more magenta, negative are greener.
+	Tint float64
+	// Stretch every channel to the full range.
+	AutoLevels bool
+}
+
+// IsZero reports whether the adjustments don't change anything.
+func (a *Adjustments) IsZero() bool {
+	return *a == Adjustments{}
+}
+
+// Clamp limits every adjustment to its valid range.
+func (a *Adjustments) Clamp() {
+	a.Exposure = Clamp64(-2, a.Exposure, 2)
+	a.Contrast = Clamp64(-100, a.Contrast, 100)
+	a.Saturation = Clamp64(-100, a.Saturation, 100)
+	a.Temperature = Clamp64(-100, a.Temperature, 100)
+	a.Tint = Clamp64(-100, a.Tint, 100)
+}
+
+// Params returns the adjustments as parameters of an adjust step.
+func (a *Adjustments) Params() map[string]float64 {
+	p := make(map[string]float64)
+	set := func(k string, v float64) {
+		if v != 0 {
+			p[k] = v
+		}
+	}
+	set("exposure", a.Exposure)
+	set("contrast", a.Contrast)
+	set("saturation", a.Saturation)
+	set("temperature", a.Temperature)
+	set("tint", a.Tint)
+	if a.AutoLevels {
+		p["autolevels"] = 1
+	}
+	return p
+}
+
+// AdjustmentsFromParams is the inverse of Params.
+func AdjustmentsFromParams(p map[string]float64) Adjustments {
+	a := Adjustments{
+		Exposure:    p["exposure"],
+		Contrast:    p["contrast"],
+		Saturation:  p["saturation"],
+		Temperature: p["temperature"],
+		Tint:        p["tint"],
+		AutoLevels:  p["autolevels"] != 0,
+	}
+	a.Clamp()
+	return a
+}
+
+// Adjust applies the adjustments to m. Auto levels go first, then
+// white balance, exposure, contrast and saturation.
+func Adjust(m image.Image, a *Adjustments) image.Image {
+	if a.IsZero() {
+		return m
+	}
+	bounds := m.Bounds()
+	out := image.NewNRGBA(bounds)
+
+	lo, hi := [3]float64{0, 0, 0}, [3]float64{1, 1, 1}
+	if a.AutoLevels {
+		lo, hi = levels(m, 0.005)
+	}
+
+	// White balance multipliers
+	temp, tint := a.Temperature/100, a.Tint/100
+	wb := [3]float64{1 + 0.2*temp, 1 - 0.2*tint, 1 - 0.2*temp}
+	exposure := math.Pow(2, a.Exposure)
+	contrast := (100 + a.Contrast) / 100
+	contrast *= contrast
+	saturation := (100 + a.Saturation) / 100
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := color.NRGBAModel.Convert(m.At(x, y)).(color.NRGBA)
+			v := [3]float64{float64(c.R) / 255, float64(c.G) / 255, float64(c.B) / 255}
+			for i := range v {
+				if hi[i] > lo[i] {
+					v[i] = (v[i] - lo[i]) / (hi[i] - lo[i])
+				}
+				v[i] = (v[i]*wb[i]*exposure-0.5)*contrast + 0.5
+			}
+			lum := 0.299*v[0] + 0.587*v[1] + 0.114*v[2]
+			for i := range v {
+				v[i] = Clamp64(0, lum+(v[i]-lum)*saturation, 1)
+			}
+			out.SetNRGBA(x, y, color.NRGBA{
+				uint8(v[0]*255 + 0.5), uint8(v[1]*255 + 0.5), uint8(v[2]*255 + 0.5), c.A,
+			})
+		}
+	}
+	return out
+}
+
+// levels finds, for every channel, the values that leave a fraction
+// clip of the pixels below and above them.
+func levels(m image.Image, clip float64) (lo, hi [3]float64) {
+	var hist [3][256]int
+	bounds := m.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := color.NRGBAModel.Convert(m.At(x, y)).(color.NRGBA)
+			hist[0][c.R]++
+			hist[1][c.G]++
+			hist[2][c.B]++
+		}
+	}
+	limit := int(clip * float64(bounds.Dx()*bounds.Dy()))
+	for i := range hist {
+		lo[i], hi[i] = 0, 1
+		acc := 0
+		for v := 0; v < 256; v++ {
+			acc += hist[i][v]
+			if acc > limit {
+				lo[i] = float64(v) / 255
+				break
+			}
+		}
+		acc = 0
+		for v := 255; v >= 0; v-- {
+			acc += hist[i][v]
+			if acc > limit {
+				hi[i] = float64(v) / 255
+				break
+			}
+		}
+	}
+	return lo, hi
+}
@@ -0,0 +1,78 @@
+package filters
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestAdjust(t *testing.T) {
+	src := image.NewNRGBA(image.Rect(0, 0, 1, 1))
+	src.SetNRGBA(0, 0, color.NRGBA{100, 150, 200, 255})
+
+	tests := []struct {
+		name     string
+		a        Adjustments
+		expected color.NRGBA
+	}{
+		{"exposure", Adjustments{Exposure: 1}, color.NRGBA{200, 255, 255, 255}},
+		{"contrast", Adjustments{Contrast: -50}, color.NRGBA{121, 133, 146, 255}},
+		{"saturation", Adjustments{Saturation: -100}, color.NRGBA{141, 141, 141, 255}},
+		{"temperature", Adjustments{Temperature: 100}, color.NRGBA{120, 150, 160, 255}},
+		{"tint", Adjustments{Tint: 100}, color.NRGBA{100, 120, 200, 255}},
+	}
+	for _, test := range tests {
+		res := Adjust(src, &test.a).(*image.NRGBA)
+		if c := res.NRGBAAt(0, 0); c != test.expected {
+			t.Errorf("%v: expected %v, given %v", test.name, test.expected, c)
+		}
+	}
+
+	if Adjust(src, &Adjustments{}) != image.Image(src) {
+		t.Errorf("Expected no adjustments to return the image")
+	}
+}
+
+func TestAutoLevels(t *testing.T) {
+	src := image.NewNRGBA(image.Rect(0, 0, 2, 1))
+	src.SetNRGBA(0, 0, color.NRGBA{50, 60, 70, 255})
+	src.SetNRGBA(1, 0, color.NRGBA{200, 190, 180, 255})
+	res := Adjust(src, &Adjustments{AutoLevels: true}).(*image.NRGBA)
+	if lo, hi := res.NRGBAAt(0, 0), res.NRGBAAt(1, 0); lo != (color.NRGBA{0, 0, 0, 255}) || hi != (color.NRGBA{255, 255, 255, 255}) {
+		t.Errorf("Expected every channel stretched, given %v and %v", lo, hi)
+	}
+}
+
+func TestAdjustmentsParams(t *testing.T) {
+	a := Adjustments{Exposure: 5, Contrast: 20, AutoLevels: true}
+	if b := AdjustmentsFromParams(a.Params()); b != (Adjustments{Exposure: 2, Contrast: 20, AutoLevels: true}) {
+		t.Errorf("Expected the clamped adjustments back, given %+v", b)
+	}
+}
+
+func TestWithAdjustmentsHash(t *testing.T) {
+	p := SingleFilter("voronoi")
+	if q := p.WithAdjustments(&Adjustments{}); q != p {
+		t.Errorf("Expected no adjustments to keep the pipeline")
+	}
+
+	warm := p.WithAdjustments(&Adjustments{Temperature: 20})
+	if len(p.Steps) != 1 || len(warm.Steps) != 2 || warm.Steps[0].Op != OpAdjust {
+		t.Fatalf("Expected an adjust step first and the pipeline untouched, given %v and %v", p.Steps, warm.Steps)
+	}
+	tests := []struct {
+		name  string
+		other *Pipeline
+		equal bool
+	}{
+		{"same adjustments", p.WithAdjustments(&Adjustments{Temperature: 20}), true},
+		{"no adjustments", p, false},
+		{"other adjustments", p.WithAdjustments(&Adjustments{Temperature: 30}), false},
+		{"other filter", SingleFilter("oilpaint").WithAdjustments(&Adjustments{Temperature: 20}), false},
+	}
+	for _, test := range tests {
+		if equal := warm.Hash() == test.other.Hash(); equal != test.equal {
+			t.Errorf("%v: expected equal hashes %v, given %v", test.name, test.equal, equal)
+		}
+	}
+}
@@ -0,0 +1,270 @@
+package filters
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"io"
+)
+
+// MaxFrames limits the frames of an animation that are painted.
+const MaxFrames = 120
+
+// Animation is a sequence of frames of the same size.
+type Animation struct {
+	Frames []image.Image
+	// Delays of every frame, in hundredths of a second.
+	Delays []int
+	// LoopCount as in image/gif: 0 loops forever.
+	LoopCount int
+}
+
+// DecodeGIF reads the frames of a GIF, up to MaxFrames. The frames of
+// a GIF only hold what changes, they are composed over the previous
+// ones as their disposal methods say, so every frame of the result is
+// complete. Frames are decoded one at a time and, unless size is 0,
+// rescaled to size right away, so a single frame is kept at full size.
+func DecodeGIF(r io.Reader, size int) (*Animation, error) {
+	gr, err := newGIFReader(r)
+	if err != nil {
+		return nil, err
+	}
+	a := &Animation{}
+	var canvas *image.RGBA
+	for len(a.Frames) < MaxFrames {
+		data, err := gr.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		g, err := gif.DecodeAll(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		if canvas == nil {
+			bounds := image.Rect(0, 0, g.Config.Width, g.Config.Height)
+			if bounds.Empty() {
+				bounds = g.Image[0].Bounds()
+			}
+			canvas = image.NewRGBA(bounds)
+			a.LoopCount = g.LoopCount
+		}
+		frame := g.Image[0]
+		var saved *image.RGBA
+		disposal := g.Disposal[0]
+		if disposal == gif.DisposalPrevious {
+			saved = cloneRGBA(canvas)
+		}
+		draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+		if size > 0 {
+			a.Frames = append(a.Frames, RescaleImage(canvas, size))
+		} else {
+			a.Frames = append(a.Frames, cloneRGBA(canvas))
+		}
+		a.Delays = append(a.Delays, g.Delay[0])
+
+		switch disposal {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, frame.Bounds(), image.Transparent, image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			canvas = saved
+		}
+	}
+	if len(a.Frames) == 0 {
+		return nil, errors.New("gif: no frames")
+	}
+	return a, nil
+}
+
+// CountGIFFrames returns how many frames of a GIF DecodeGIF reads,
+// without decoding them.
+func CountGIFFrames(r io.Reader) (int, error) {
+	gr, err := newGIFReader(r)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for ; n < MaxFrames; n++ {
+		if _, err := gr.next(); err == io.EOF {
+			break
+		} else if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// gifReader splits a GIF in GIFs of a single frame, so image/gif can
+// decode its frames one at a time.
+type gifReader struct {
+	r *bufio.Reader
+	// head is the header, the logical screen descriptor and the
+	// global color table, that every frame starts with.
+	head []byte
+}
+
+func newGIFReader(r io.Reader) (*gifReader, error) {
+	gr := &gifReader{r: bufio.NewReader(r), head: make([]byte, 13)}
+	if _, err := io.ReadFull(gr.r, gr.head); err != nil {
+		return nil, fmt.Errorf("gif: reading header: %v", err)
+	}
+	if string(gr.head[:3]) != "GIF" {
+		return nil, errors.New("gif: can't recognize format")
+	}
+	if flags := gr.head[10]; flags&0x80 != 0 {
+		var err error
+		if gr.head, err = gr.read(gr.head, 3<<(flags&7+1)); err != nil {
+			return nil, fmt.Errorf("gif: reading color table: %v", err)
+		}
+	}
+	return gr, nil
+}
+
+// next returns the next frame as a GIF of its own, with the extensions
+// that come before it, or io.EOF after the last frame.
+func (gr *gifReader) next() ([]byte, error) {
+	frame := append([]byte(nil), gr.head...)
+	for {
+		b, err := gr.r.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("gif: reading frames: %v", err)
+		}
+		switch b {
+		case 0x21: // Extension, its label and data
+			if frame, err = gr.read(append(frame, b), 1); err == nil {
+				frame, err = gr.blocks(frame)
+			}
+		case 0x2c: // Image descriptor, its color table and data
+			if frame, err = gr.read(append(frame, b), 9); err != nil {
+				break
+			}
+			if flags := frame[len(frame)-1]; flags&0x80 != 0 {
+				if frame, err = gr.read(frame, 3<<(flags&7+1)); err != nil {
+					break
+				}
+			}
+			if frame, err = gr.read(frame, 1); err == nil {
+				frame, err = gr.blocks(frame)
+			}
+			if err == nil {
+				return append(frame, 0x3b), nil
+			}
+		case 0x3b: // Trailer
+			return nil, io.EOF
+		default:
+			return nil, fmt.Errorf("gif: unknown block type %#x", b)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("gif: reading frames: %v", err)
+		}
+	}
+}
+
+// read appends the next n bytes to buf.
+func (gr *gifReader) read(buf []byte, n int) ([]byte, error) {
+	start := len(buf)
+	buf = append(buf, make([]byte, n)...)
+	_, err := io.ReadFull(gr.r, buf[start:])
+	return buf, err
+}
+
+// blocks appends the data sub-blocks that follow to buf, up to their
+// terminator.
+func (gr *gifReader) blocks(buf []byte) ([]byte, error) {
+	for {
+		n, err := gr.r.ReadByte()
+		if err != nil {
+			return buf, err
+		}
+		buf = append(buf, n)
+		if n == 0 {
+			return buf, nil
+		}
+		if buf, err = gr.read(buf, int(n)); err != nil {
+			return buf, err
+		}
+	}
+}
+
+func cloneRGBA(m *image.RGBA) *image.RGBA {
+	c := image.NewRGBA(m.Bounds())
+	copy(c.Pix, m.Pix)
+	return c
+}
+
+// RunAnimation paints every frame of the animation with the pipeline. Every
+// frame starts with the same random source, and the painterly filters
+// paint over the canvas of the previous frame, only where the frame
+// differs from it by more than their threshold. The strokes of the
+// parts that don't move are kept, so the animation doesn't flicker.
+func (p *Pipeline) RunAnimation(c Context, a *Animation, settings *PainterlySettings) *Animation {
+	res := &Animation{Delays: a.Delays, LoopCount: a.LoopCount}
+	co := &coherence{canvases: make(map[int]*image.RGBA)}
+	for _, frame := range a.Frames {
+		s := PainterlySettings{}
+		if settings != nil {
+			s = *settings
+		}
+		s.rnd = nil
+		s.coherence = co
+		res.Frames = append(res.Frames, p.Run(c, frame, &s))
+	}
+	return res
+}
+
+// coherence keeps the canvases painted for the previous frame of an
+// animation, by step of the pipeline.
+type coherence struct {
+	step     int
+	canvases map[int]*image.RGBA
+}
+
+// previousCanvas returns the canvas painted by the current step for
+// the previous frame, if there is one of the given bounds.
+func (s *PainterlySettings) previousCanvas(bounds image.Rectangle) *image.RGBA {
+	if s == nil || s.coherence == nil {
+		return nil
+	}
+	prev := s.coherence.canvases[s.coherence.step]
+	if prev == nil || prev.Bounds() != bounds {
+		return nil
+	}
+	return prev
+}
+
+// keepCanvas saves the canvas painted by the current step, for the
+// next frame.
+func (s *PainterlySettings) keepCanvas(canvas *image.RGBA) {
+	if s != nil && s.coherence != nil {
+		s.coherence.canvases[s.coherence.step] = canvas
+	}
+}
+
+// EncodeGIF writes the animation as an animated GIF. Every frame uses
+// the same palette, p or one extracted from the first frame, so the
+// colors don't change between frames.
+func EncodeGIF(w io.Writer, a *Animation, p color.Palette, dither bool) error {
+	if len(a.Frames) == 0 {
+		return errors.New("gif: no frames")
+	}
+	if p == nil {
+		p = ExtractPalette(a.Frames[0], MaxPaletteColors)
+	}
+	g := &gif.GIF{LoopCount: a.LoopCount}
+	for i, frame := range a.Frames {
+		g.Image = append(g.Image, ApplyPalette(ToRGBA(frame), p, dither).(*image.Paletted))
+		delay := 0
+		if i < len(a.Delays) {
+			delay = a.Delays[i]
+		}
+		g.Delay = append(g.Delay, delay)
+	}
+	return gif.EncodeAll(w, g)
+}
@@ -0,0 +1,185 @@
+package filters
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/gif"
+	"testing"
+)
+
+type quietContext struct{}
+
+func (quietContext) Infof(format string, args ...interface{}) {}
+
+// testFrame is a gradient with a square at x.
+func testFrame(x int) *image.RGBA {
+	m := image.NewRGBA(image.Rect(0, 0, 48, 32))
+	for py := 0; py < 32; py++ {
+		for px := 0; px < 48; px++ {
+			m.Set(px, py, color.RGBA{uint8(px * 5), uint8(py * 7), 120, 255})
+		}
+	}
+	for py := 10; py < 20; py++ {
+		for px := x; px < x+10; px++ {
+			m.Set(px, py, color.RGBA{250, 250, 0, 255})
+		}
+	}
+	return m
+}
+
+func TestDecodeGIF(t *testing.T) {
+	p := color.Palette{color.Transparent, color.Black, color.White}
+	full := image.NewPaletted(image.Rect(0, 0, 4, 4), p)
+	for i := range full.Pix {
+		full.Pix[i] = 1
+	}
+	// The second frame only holds the pixel that changes.
+	dot := image.NewPaletted(image.Rect(2, 2, 3, 3), p)
+	dot.Pix[0] = 2
+	var buf bytes.Buffer
+	err := gif.EncodeAll(&buf, &gif.GIF{
+		Image: []*image.Paletted{full, dot},
+		Delay: []int{5, 7},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := buf.Bytes()
+	a, err := DecodeGIF(bytes.NewReader(data), 0)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if len(a.Frames) != 2 || a.Delays[1] != 7 {
+		t.Fatalf("Expected 2 frames with their delays, given %d and %v", len(a.Frames), a.Delays)
+	}
+	second := a.Frames[1]
+	if second.Bounds() != full.Bounds() {
+		t.Errorf("Expected complete frames, given %v", second.Bounds())
+	}
+	if r, _, _, _ := second.At(0, 0).RGBA(); r != 0 {
+		t.Errorf("Expected the first frame under the second one, given %v", second.At(0, 0))
+	}
+	if r, _, _, _ := second.At(2, 2).RGBA(); r != 0xffff {
+		t.Errorf("Expected the changed pixel, given %v", second.At(2, 2))
+	}
+
+	// Frames are rescaled as they are decoded.
+	if a, err = DecodeGIF(bytes.NewReader(data), 2); err != nil || a.Frames[1].Bounds() != image.Rect(0, 0, 2, 2) {
+		t.Errorf("Expected the frames rescaled, given %v", err)
+	}
+	if n, err := CountGIFFrames(bytes.NewReader(data)); n != 2 || err != nil {
+		t.Errorf("Expected 2 frames counted, given %v %v", n, err)
+	}
+	if _, err := DecodeGIF(bytes.NewReader(data[:len(data)-4]), 0); err == nil {
+		t.Errorf("Expected an error for a cut GIF")
+	}
+}
+
+func TestDecodeGIFMaxFrames(t *testing.T) {
+	p := color.Palette{color.Black, color.White}
+	g := &gif.GIF{LoopCount: 3}
+	for i := 0; i < MaxFrames+5; i++ {
+		g.Image = append(g.Image, image.NewPaletted(image.Rect(0, 0, 2, 2), p))
+		g.Delay = append(g.Delay, i)
+	}
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, g); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	a, err := DecodeGIF(bytes.NewReader(data), 0)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if len(a.Frames) != MaxFrames || a.Delays[MaxFrames-1] != MaxFrames-1 || a.LoopCount != 3 {
+		t.Errorf("Expected %d frames, their delays and loop count, given %d %v %v",
+			MaxFrames, len(a.Frames), a.Delays[len(a.Delays)-1], a.LoopCount)
+	}
+	if n, _ := CountGIFFrames(bytes.NewReader(data)); n != MaxFrames {
+		t.Errorf("Expected %d frames counted, given %v", MaxFrames, n)
+	}
+}
+
+// countFrames is a filter that counts the frames it has painted in the
+// pixel n of its canvas, painting over the canvas of the previous frame.
+func countFrames(n int) Filter {
+	return func(c Context, m image.Image, settings *PainterlySettings) image.Image {
+		canvas := image.NewRGBA(m.Bounds())
+		if prev := settings.previousCanvas(canvas.Bounds()); prev != nil {
+			copy(canvas.Pix, prev.Pix)
+		}
+		canvas.Pix[4*n]++
+		settings.keepCanvas(canvas)
+		return canvas
+	}
+}
+
+func TestRunAnimationCoherence(t *testing.T) {
+	Registry["count0"], Registry["count1"] = countFrames(0), countFrames(1)
+	defer delete(Registry, "count0")
+	defer delete(Registry, "count1")
+	p, err := ParsePipeline([]byte(`{"steps":[{"op":"filter","name":"count0"},{"op":"filter","name":"count1"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	frames := []image.Image{testFrame(5), testFrame(5), testFrame(30)}
+	a := &Animation{Frames: frames, Delays: []int{10, 10, 10}}
+	res := p.RunAnimation(quietContext{}, a, &PainterlySettings{Seed: 3})
+	if len(res.Frames) != 3 {
+		t.Fatalf("Expected 3 frames, given %d", len(res.Frames))
+	}
+	for i, frame := range res.Frames {
+		// Every step sees its own canvas of the previous frame.
+		m := ToRGBA(frame)
+		if m.Pix[0] != 0 || m.Pix[4] != uint8(i+1) {
+			t.Errorf("Expected frame %d to be painted over the previous ones, given %v", i, m.Pix[:8])
+		}
+	}
+
+	// Without an animation there is no previous canvas.
+	m := ToRGBA(p.Run(quietContext{}, testFrame(5), &PainterlySettings{}))
+	if m.Pix[4] != 1 {
+		t.Errorf("Expected a single frame, given %v", m.Pix[:8])
+	}
+}
+
+func TestPaintAnimationRegions(t *testing.T) {
+	Registry["count0"], Registry["count1"] = countFrames(0), countFrames(1)
+	defer delete(Registry, "count0")
+	defer delete(Registry, "count1")
+
+	frames := []image.Image{testFrame(5), testFrame(5), testFrame(30)}
+	a := &Animation{Frames: frames, Delays: []int{10, 10, 10}}
+	base := SingleFilter("count1").RunAnimation(quietContext{}, a, &PainterlySettings{})
+	regions := []Region{{Style: "count0", Shape: ShapeRect, W: 1, H: 1}}
+	res := PaintAnimationRegions(quietContext{}, base, a, &PainterlySettings{}, regions, nil)
+	for i, frame := range res.Frames {
+		// The region is painted over its canvas of the previous
+		// frame too.
+		m := ToRGBA(frame)
+		if m.Pix[0] != uint8(i+1) || m.Pix[4] != uint8(i+1) {
+			t.Errorf("Expected frame %d of the region to be painted over the previous ones, given %v", i, m.Pix[:8])
+		}
+	}
+}
+
+func TestEncodeGIF(t *testing.T) {
+	a := &Animation{Frames: []image.Image{testFrame(5), testFrame(30)}, Delays: []int{4, 8}}
+	var buf bytes.Buffer
+	if err := EncodeGIF(&buf, a, nil, false); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	g, err := gif.DecodeAll(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(g.Image) != 2 || g.Delay[1] != 8 {
+		t.Errorf("Expected 2 frames with their delays, given %d and %v", len(g.Image), g.Delay)
+	}
+	if len(g.Image[0].Palette) != len(g.Image[1].Palette) {
+		t.Errorf("Expected the frames to share the palette")
+	}
+}
@@ -0,0 +1,167 @@
+package filters
+
+import (
+	"fmt"
+	colorful "github.com/lucasb-eyer/go-colorful"
+	"image"
+	"image/color"
+	"math"
+)
+
+// A ColorMetric measures how different two colors are. Every metric
+// returns distances in the scale of ColorDistance, so the threshold T
+// of a style means about the same with any of them.
+type ColorMetric string
+
+const (
+	// Euclidean distance of the 16 bit RGBA values.
+	MetricRGB ColorMetric = "rgb"
+	// CIELAB Delta E 1976.
+	MetricLab ColorMetric = "lab"
+	// CIEDE2000 Delta E.
+	MetricCIEDE2000 ColorMetric = "ciede2000"
+)
+
+// Metrics lists the available color metrics.
+var Metrics = []ColorMetric{MetricRGB, MetricLab, MetricCIEDE2000}
+
+// labScale converts Delta E units to the scale of ColorDistance: the
+// distance from black to white is 100 in CIELAB, and 65535*sqrt(3)
+// in RGB.
+var labScale = 65535 * math.Sqrt(3) / 100
+
+// ParseColorMetric returns the metric with the given name, the empty
+// name is MetricRGB.
+func ParseColorMetric(name string) (ColorMetric, error) {
+	if name == "" {
+		return MetricRGB, nil
+	}
+	for _, m := range Metrics {
+		if string(m) == name {
+			return m, nil
+		}
+	}
+	return MetricRGB, fmt.Errorf("unknown color metric %q", name)
+}
+
+// Distance returns the distance between A and B. Differences in
+// alpha count as in ColorDistance, so an empty canvas is always far
+// from the reference.
+func (m ColorMetric) Distance(A, B color.Color) float64 {
+	switch m {
+	case MetricLab, MetricCIEDE2000:
+		l1, a1, b1, alpha1 := toLab(A)
+		l2, a2, b2, alpha2 := toLab(B)
+		var d float64
+		if m == MetricLab {
+			d = math.Sqrt(sq(l1-l2) + sq(a1-a2) + sq(b1-b2))
+		} else {
+			d = DeltaE2000(l1, a1, b1, l2, a2, b2)
+		}
+		d *= labScale
+		da := alpha1 - alpha2
+		return math.Sqrt(d*d + da*da)
+	}
+	return ColorDistance(A, B)
+}
+
+// ImageDifferenceMetric is ImageDifference using the given metric.
+func ImageDifferenceMetric(A *image.RGBA, B image.Image, metric ColorMetric) [][]float64 {
+	ys := A.Bounds().Max.Y
+	xs := A.Bounds().Max.X
+	res := make([][]float64, ys)
+	for y := 0; y < ys; y++ {
+		rowdif := make([]float64, xs)
+		for x := 0; x < xs; x++ {
+			rowdif[x] = metric.Distance(A.At(x, y), B.At(x, y))
+		}
+		res[y] = rowdif
+	}
+	return res
+}
+
+// toLab returns the CIELAB coordinates of c, and its 16 bit alpha.
+func toLab(c color.Color) (l, a, b, alpha float64) {
+	r, g, bl, al := c.RGBA()
+	if al == 0 {
+		return 0, 0, 0, 0
+	}
+	// Colors are premultiplied
+	n := colorful.Color{
+		R: float64(r) / float64(al),
+		G: float64(g) / float64(al),
+		B: float64(bl) / float64(al),
+	}
+	l, a, b = n.Lab()
+	return l * 100, a * 100, b * 100, float64(al)
+}
+
+// DeltaE2000 is the CIEDE2000 color difference of two CIELAB colors,
+// with L in [0, 100].
+func DeltaE2000(L1, a1, b1, L2, a2, b2 float64) float64 {
+	C1 := math.Hypot(a1, b1)
+	C2 := math.Hypot(a2, b2)
+	Cb7 := math.Pow((C1+C2)/2, 7)
+	G := 0.5 * (1 - math.Sqrt(Cb7/(Cb7+math.Pow(25, 7))))
+	a1p, a2p := (1+G)*a1, (1+G)*a2
+	C1p, C2p := math.Hypot(a1p, b1), math.Hypot(a2p, b2)
+	h1p, h2p := hueDegrees(b1, a1p), hueDegrees(b2, a2p)
+
+	dLp := L2 - L1
+	dCp := C2p - C1p
+	dhp := 0.0
+	if C1p*C2p != 0 {
+		dhp = h2p - h1p
+		if dhp > 180 {
+			dhp -= 360
+		} else if dhp < -180 {
+			dhp += 360
+		}
+	}
+	dHp := 2 * math.Sqrt(C1p*C2p) * math.Sin(radians(dhp/2))
+
+	Lbp := (L1 + L2) / 2
+	Cbp := (C1p + C2p) / 2
+	hbp := h1p + h2p
+	if C1p*C2p != 0 {
+		switch {
+		case math.Abs(h1p-h2p) <= 180:
+			hbp = (h1p + h2p) / 2
+		case h1p+h2p < 360:
+			hbp = (h1p + h2p + 360) / 2
+		default:
+			hbp = (h1p + h2p - 360) / 2
+		}
+	}
+
+	T := 1 - 0.17*math.Cos(radians(hbp-30)) + 0.24*math.Cos(radians(2*hbp)) +
+		0.32*math.Cos(radians(3*hbp+6)) - 0.20*math.Cos(radians(4*hbp-63))
+	dTheta := 30 * math.Exp(-sq((hbp-275)/25))
+	Cbp7 := math.Pow(Cbp, 7)
+	Rc := 2 * math.Sqrt(Cbp7/(Cbp7+math.Pow(25, 7)))
+	Sl := 1 + 0.015*sq(Lbp-50)/math.Sqrt(20+sq(Lbp-50))
+	Sc := 1 + 0.045*Cbp
+	Sh := 1 + 0.015*Cbp*T
+	Rt := -math.Sin(radians(2*dTheta)) * Rc
+
+	return math.Sqrt(sq(dLp/Sl) + sq(dCp/Sc) + sq(dHp/Sh) + Rt*(dCp/Sc)*(dHp/Sh))
+}
+
+func hueDegrees(b, a float64) float64 {
+	if a == 0 && b == 0 {
+		return 0
+	}
+	h := math.Atan2(b, a) * 180 / math.Pi
+	if h < 0 {
+		h += 360
+	}
+	return h
+}
+
+func radians(deg float64) float64 {
+	return deg * math.Pi / 180
+}
+
+func sq(x float64) float64 {
+	return x * x
+}
@@ -0,0 +1,67 @@
+package filters
+
+import (
+	"image/color"
+	"math"
+	"testing"
+)
+
+func TestDeltaE2000(t *testing.T) {
+	// Test data from Sharma, Wu and Dalal (2005).
+	cases := []struct {
+		L1, a1, b1, L2, a2, b2, dE float64
+	}{
+		{50, 2.6772, -79.7751, 50, 0, -82.7485, 2.0425},
+		{50, 0, 0, 50, -1, 2, 2.3669},
+		{50, 2.5, 0, 73, 25, -18, 27.1492},
+		{60.2574, -34.0099, 36.2677, 60.4626, -34.1751, 39.4387, 1.2644},
+		{50, 2.5, 0, 50, 0, -2.5, 4.3065},
+	}
+	for _, v := range cases {
+		d := DeltaE2000(v.L1, v.a1, v.b1, v.L2, v.a2, v.b2)
+		if math.Abs(d-v.dE) > 0.0001 {
+			t.Errorf("Expected %v, given %v for %v", v.dE, d, v)
+		}
+	}
+}
+
+func TestColorMetricScale(t *testing.T) {
+	for _, m := range Metrics {
+		d := m.Distance(color.White, color.Black)
+		if math.Abs(d-ColorDistance(color.White, color.Black)) > 2000 {
+			t.Errorf("%v: expected white to black near %v, given %v", m,
+				ColorDistance(color.White, color.Black), d)
+		}
+		if d := m.Distance(color.White, color.White); d != 0 {
+			t.Errorf("%v: expected 0, given %v", m, d)
+		}
+	}
+}
+
+func TestColorDistance(t *testing.T) {
+	dark, light := color.NRGBA{10, 20, 30, 255}, color.NRGBA{13, 24, 30, 255}
+	expected := 257 * 5.0
+	if d := ColorDistance(dark, light); d != expected {
+		t.Errorf("Expected %v from the darker color, given %v", expected, d)
+	}
+	if d := ColorDistance(light, dark); d != expected {
+		t.Errorf("Expected %v from the lighter color, given %v", expected, d)
+	}
+	if d := ColorDistance(color.Transparent, color.White); d != 131070 {
+		t.Errorf("Expected 131070 from transparent to white, given %v", d)
+	}
+}
+
+func TestStyleThresholds(t *testing.T) {
+	// The error of an area one 8 bit level off, in the darker
+	// direction, is above the T of every style.
+	d := ColorDistance(color.NRGBA{100, 100, 100, 255}, color.NRGBA{101, 100, 100, 255})
+	styles := []PainterlyStyle{StyleImpressionist, StyleExpressionist, StyleColoristWash,
+		StylePointillist, StylePsychedelic}
+	for _, s := range styles {
+		r := float64(s.Radius)
+		if areaError := d * (2 * r) * (2 * r) / (r * r); areaError <= s.T {
+			t.Errorf("%v: expected T below %v, given %v", s.Name, areaError, s.T)
+		}
+	}
+}
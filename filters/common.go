@@ -4,19 +4,36 @@ import (
 	"github.com/disintegration/gift"
 	"github.com/disintegration/imaging"
 	colorful "github.com/lucasb-eyer/go-colorful"
+	_ "golang.org/x/image/bmp"
+	_ "golang.org/x/image/tiff"
+	_ "golang.org/x/image/webp"
 	"image"
 	"image/color"
+	"image/draw"
 	_ "image/gif"
 	_ "image/jpeg"
 	_ "image/png"
 	"math"
-	"math/rand"
 )
 
+// ToRGBA returns m as an RGBA image with its origin at (0, 0), the
+// representation the filters work with whatever the format the image
+// was decoded from: YCbCr JPEGs, CMYK TIFFs, paletted GIFs, 16 bit PNGs
+// and so on.
+func ToRGBA(m image.Image) *image.RGBA {
+	if rgba, ok := m.(*image.RGBA); ok && rgba.Bounds().Min == (image.Point{}) {
+		return rgba
+	}
+	b := m.Bounds()
+	rgba := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(rgba, rgba.Bounds(), m, b.Min, draw.Src)
+	return rgba
+}
+
 func RescaleImage(m image.Image, size int) image.Image {
 	bounds := m.Bounds()
-	ys := bounds.Max.Y
-	xs := bounds.Max.X
+	ys := bounds.Dy()
+	xs := bounds.Dx()
 	if xs > ys {
 		return imaging.Resize(m, IntMin(size, xs), 0, imaging.Lanczos)
 	} else {
@@ -162,10 +179,15 @@ func GradientData(src image.Image) ([][]float64, [][]float64) {
 	return mag, ori
 }
 
+// ColorDistance is the euclidean distance of the 16 bit RGBA values
+// of A and B, from 0 to 131070 between transparent black and white.
 func ColorDistance(A, B color.Color) float64 {
 	ar, ag, ab, aa := A.RGBA()
 	br, bg, bb, ba := B.RGBA()
-	dr, dg, db, da := float64(ar-br), float64(ag-bg), float64(ab-bb), float64(aa-ba)
+	// Converted before subtracting, the uint32 difference wraps around
+	// when A is darker.
+	dr, dg, db, da := float64(ar)-float64(br), float64(ag)-float64(bg),
+		float64(ab)-float64(bb), float64(aa)-float64(ba)
 	return math.Sqrt(dr*dr + dg*dg + db*db + da*da)
 }
 
@@ -190,20 +212,25 @@ func RandomizeColor(c color.Color, settings *PainterlySettings) color.NRGBA {
 	//r,g,b,_ := c.RGBA()
 	//return color.NRGBA{uint8(r/255), uint8(g/255), uint8(b/255), uint8(sty.Opacity*255)}
 	sty := settings.Style
+	rnd := settings.Rand()
 	r, g, b, _ := c.RGBA()
-	R := Clamp64(0, rand.NormFloat64()*sty.JitterRed*65535/2+float64(r), 65535)
-	G := Clamp64(0, rand.NormFloat64()*sty.JitterGreen*65535/2+float64(g), 65535)
-	B := Clamp64(0, rand.NormFloat64()*sty.JitterBlue*65535/2+float64(b), 65535)
+	R := Clamp64(0, rnd.NormFloat64()*sty.JitterRed*65535/2+float64(r), 65535)
+	G := Clamp64(0, rnd.NormFloat64()*sty.JitterGreen*65535/2+float64(g), 65535)
+	B := Clamp64(0, rnd.NormFloat64()*sty.JitterBlue*65535/2+float64(b), 65535)
 
 	n := colorful.Color{R / 65535, G / 65535, B / 65535}
 	h, s, v := n.Hsv()
-	H := Overflow64(0, rand.NormFloat64()*sty.JitterHue*45+h, 360)
-	S := Clamp64(0, rand.NormFloat64()*sty.JitterSaturation*0.25+s, 1)
-	V := Clamp64(0, rand.NormFloat64()*sty.JitterValue*0.25+v, 1)
+	H := Overflow64(0, rnd.NormFloat64()*sty.JitterHue*45+h, 360)
+	S := Clamp64(0, rnd.NormFloat64()*sty.JitterSaturation*0.25+s, 1)
+	V := Clamp64(0, rnd.NormFloat64()*sty.JitterValue*0.25+v, 1)
 
 	n2 := colorful.Hsv(H, S, V)
 	r2, g2, b2 := n2.RGB255()
-	return color.NRGBA{r2, g2, b2, uint8(sty.Opacity * 255)}
+	res := color.NRGBA{r2, g2, b2, uint8(sty.Opacity * 255)}
+	if settings.Palette != nil {
+		res = SnapColor(settings.Palette, res)
+	}
+	return res
 }
 
 func Clamp64(a, b, c float64) float64 {
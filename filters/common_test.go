@@ -0,0 +1,66 @@
+package filters
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestToRGBA(t *testing.T) {
+	m := image.NewYCbCr(image.Rect(10, 20, 14, 23), image.YCbCrSubsampleRatio420)
+	for i := range m.Y {
+		m.Y[i] = 200
+	}
+	for i := range m.Cb {
+		m.Cb[i], m.Cr[i] = 128, 128
+	}
+	rgba := ToRGBA(m)
+	if rgba.Bounds() != image.Rect(0, 0, 4, 3) {
+		t.Errorf("Expected the origin moved to 0,0, given %v", rgba.Bounds())
+	}
+	if c := rgba.RGBAAt(3, 2); c != (color.RGBA{200, 200, 200, 255}) {
+		t.Errorf("Expected gray 200, given %v", c)
+	}
+	if ToRGBA(rgba) != rgba {
+		t.Errorf("Expected RGBA images to be kept")
+	}
+}
+
+func TestImageDifference(t *testing.T) {
+	// The canvas is lighter than the reference at (1,0) and darker,
+	// by less, at (2,1). Strokes start at the largest difference.
+	cnv := image.NewRGBA(image.Rect(0, 0, 3, 2))
+	ref := image.NewRGBA(cnv.Bounds())
+	for y := 0; y < 2; y++ {
+		for x := 0; x < 3; x++ {
+			cnv.SetRGBA(x, y, color.RGBA{100, 100, 100, 255})
+			ref.SetRGBA(x, y, color.RGBA{100, 100, 100, 255})
+		}
+	}
+	cnv.SetRGBA(1, 0, color.RGBA{160, 100, 100, 255})
+	cnv.SetRGBA(2, 1, color.RGBA{80, 100, 100, 255})
+	D := ImageDifference(cnv, ref)
+	maxdif, maxx, maxy := 0.0, 0, 0
+	for y := range D {
+		for x, dif := range D[y] {
+			if dif > maxdif {
+				maxdif, maxx, maxy = dif, x, y
+			}
+		}
+	}
+	if maxx != 1 || maxy != 0 {
+		t.Errorf("Expected the largest difference at 1,0, given %v,%v", maxx, maxy)
+	}
+	if D[1][2] != 257*20 {
+		t.Errorf("Expected %v at 2,1, given %v", 257*20, D[1][2])
+	}
+	R := ImageDifference(ref, cnv)
+	for y := range D {
+		for x := range D[y] {
+			if D[y][x] != R[y][x] {
+				t.Errorf("Expected the same difference both ways at %v,%v, given %v and %v",
+					x, y, D[y][x], R[y][x])
+			}
+		}
+	}
+}
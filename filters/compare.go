@@ -0,0 +1,36 @@
+package filters
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+)
+
+// Grid lays images out in rows of the given number of columns, to
+// compare them. Every image is centered in a cell of the size of the
+// largest one, and the cells are separated by gap pixels of bg.
+func Grid(images []image.Image, columns, gap int, bg color.Color) *image.RGBA {
+	if len(images) == 0 {
+		return image.NewRGBA(image.Rect(0, 0, 0, 0))
+	}
+	if columns < 1 || columns > len(images) {
+		columns = len(images)
+	}
+	rows := (len(images) + columns - 1) / columns
+	var cell image.Point
+	for _, m := range images {
+		size := m.Bounds().Size()
+		cell.X = IntMax(cell.X, size.X)
+		cell.Y = IntMax(cell.Y, size.Y)
+	}
+	res := image.NewRGBA(image.Rect(0, 0,
+		columns*cell.X+(columns-1)*gap, rows*cell.Y+(rows-1)*gap))
+	draw.Draw(res, res.Bounds(), image.NewUniform(bg), image.Point{}, draw.Src)
+	for i, m := range images {
+		b := m.Bounds()
+		min := image.Pt((i%columns)*(cell.X+gap), (i/columns)*(cell.Y+gap))
+		min = min.Add(cell.Sub(b.Size()).Div(2))
+		draw.Draw(res, image.Rectangle{min, min.Add(b.Size())}, m, b.Min, draw.Over)
+	}
+	return res
+}
@@ -0,0 +1,41 @@
+package filters
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestGrid(t *testing.T) {
+	red := image.NewRGBA(image.Rect(0, 0, 4, 4))
+	for i := 0; i < len(red.Pix); i += 4 {
+		copy(red.Pix[i:], []uint8{255, 0, 0, 255})
+	}
+	small := image.NewRGBA(image.Rect(5, 5, 7, 7))
+	for i := range small.Pix {
+		small.Pix[i] = 255
+	}
+	images := []image.Image{red, small, image.NewRGBA(image.Rect(0, 0, 4, 4))}
+
+	m := Grid(images, 2, 1, color.Black)
+	if m.Bounds() != image.Rect(0, 0, 9, 9) {
+		t.Fatalf("Expected 2 rows of 2 cells of 4 pixels, given %v", m.Bounds())
+	}
+	if c := m.RGBAAt(0, 0); c != (color.RGBA{255, 0, 0, 255}) {
+		t.Errorf("Expected the first image in the first cell, given %v", c)
+	}
+	if c := m.RGBAAt(4, 0); c != (color.RGBA{0, 0, 0, 255}) {
+		t.Errorf("Expected the gap, given %v", c)
+	}
+	// The small image is centered in its cell.
+	if c := m.RGBAAt(7, 2); c != (color.RGBA{255, 255, 255, 255}) {
+		t.Errorf("Expected the small image centered, given %v", c)
+	}
+	if c := m.RGBAAt(5, 0); c != (color.RGBA{0, 0, 0, 255}) {
+		t.Errorf("Expected the background around the small image, given %v", c)
+	}
+
+	if row := Grid(images, 0, 0, color.Black); row.Bounds() != image.Rect(0, 0, 12, 4) {
+		t.Errorf("Expected a single row, given %v", row.Bounds())
+	}
+}
@@ -0,0 +1,7 @@
+package filters
+
+// Context receives the log messages of the filters. An
+// appengine.Context satisfies it.
+type Context interface {
+	Infof(format string, args ...interface{})
+}
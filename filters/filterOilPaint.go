@@ -1,11 +1,10 @@
 package filters
 
 import (
-	"appengine"
 	"image"
 )
 
-func FilterOilPaint(c appengine.Context, m image.Image) image.Image {
+func FilterOilPaint(c Context, m image.Image) image.Image {
 	bounds := m.Bounds()
 	out := image.NewNRGBA(bounds)
 	ys := bounds.Max.Y
@@ -1,7 +1,6 @@
 package filters
 
 import (
-	"appengine"
 	"code.google.com/p/draw2d/draw2d"
 	"github.com/disintegration/imaging"
 	"image"
@@ -20,7 +19,7 @@ func generateBrushes(minRad, numBrushes int) []int {
 	return brushes
 }
 
-func FilterPainterly(c appengine.Context, m image.Image) image.Image {
+func FilterPainterly(c Context, m image.Image) image.Image {
 	bounds := m.Bounds()
 	canvas := image.NewRGBA(bounds)
 
@@ -1,11 +1,12 @@
 package filters
 
 import (
-	"appengine"
 	"code.google.com/p/draw2d/draw2d"
 	"github.com/disintegration/imaging"
 	"image"
+	"image/color"
 	"math"
+	"math/rand"
 )
 
 func generateBrushesStyles(minRad, numBrushes int) []int {
@@ -17,29 +18,96 @@ func generateBrushesStyles(minRad, numBrushes int) []int {
 	return brushes
 }
 
-func FilterPainterlyStyles(c appengine.Context, m image.Image, settings *PainterlySettings) image.Image {
+func FilterPainterlyStyles(c Context, m image.Image, settings *PainterlySettings) image.Image {
 	bounds := m.Bounds()
 	canvas := image.NewRGBA(bounds)
+	// In animations the previous frame is painted over, so the
+	// strokes are only redone where the frame changed.
+	if prev := settings.previousCanvas(bounds); prev != nil {
+		copy(canvas.Pix, prev.Pix)
+	}
+	defer settings.keepCanvas(canvas)
 
 	// Estos parámetros posteriormente deberán ser... parametrizados:
 	brushes := generateBrushes(settings.Style.Radius, settings.Style.NumOfBrushes)
 
-	for _, radius := range brushes {
+	// The important areas get a lower threshold, more strokes and, at
+	// the end, a finer brush. They are drawn by the user or found with
+	// the saliency map.
+	switch {
+	case settings.DetailMap != nil:
+		settings.detail = grayOf(settings.DetailMap, bounds)
+	case settings.Detail > 0:
+		settings.detail = SaliencyMap(m)
+	}
+	if settings.detail != nil {
+		brushes = append(brushes, IntMax(1, brushes[len(brushes)-1]/2))
+	}
+	for i, radius := range brushes {
 		c.Infof("Brush %v", radius)
+		settings.fine = settings.detail != nil && i == len(brushes)-1
 		refImage := imaging.Blur(m, settings.Style.BlurFactor*float64(radius)*2.0)
 		paintLayerStyles(canvas, refImage, radius, settings, c)
+		settings.replay.layer(canvas)
 	}
+	settings.detail, settings.fine = nil, false
 	return canvas
 }
 
 type PainterlySettings struct {
 	Style   PainterlyStyle
-	Blobkey appengine.BlobKey
+	Blobkey string
+
+	// If Palette is set the strokes only use its colors.
+	Palette color.Palette
+	Dither  bool
+
+	// Metric used to compare the canvas with the reference.
+	Metric ColorMetric
+
+	// Painting imitated by the "reference" filter.
+	Reference *ReferenceStats
+
+	// Seed of the random strokes, renders with the same seed and
+	// settings are equal.
+	Seed int64
+	rnd  *rand.Rand
+
+	// Detail, from 0 to 1, is how much more detail the subject gets
+	// than the background, found with SaliencyMap.
+	Detail float64
+	// DetailMap is drawn by the user instead, white where the brush is
+	// finer and the strokes denser. It's stretched over the image, and
+	// with no Detail it is followed fully.
+	DetailMap image.Image
+	detail    *image.Gray
+	fine      bool
+
+	// coherence is set while painting the frames of an animation.
+	coherence *coherence
+	// replay records the painting, for RunReplay.
+	replay *replay
+}
+
+// Rand returns the random source of the settings, seeded with Seed.
+// Nil settings get a source seeded with 0.
+func (s *PainterlySettings) Rand() *rand.Rand {
+	if s == nil {
+		return rand.New(rand.NewSource(0))
+	}
+	if s.rnd == nil {
+		s.rnd = rand.New(rand.NewSource(s.Seed))
+	}
+	return s.rnd
 }
 
 type PainterlyStyle struct {
 	Name string
-	// Aproximation threshold
+	// Aproximation threshold: strokes are painted where the error
+	// of the area under the brush, the ColorDistance of its (2r)²
+	// pixels divided by r², is over T. The T of every style is below
+	// the error of an area one 8 bit level off in one channel, so only
+	// the areas that already look like the reference are left alone.
 	T float64
 
 	// Brushes
@@ -69,6 +137,12 @@ type PainterlyStyle struct {
 	JitterRed        float64
 	JitterGreen      float64
 	JitterBlue       float64
+
+	// Gradient orientation, in radians, the strokes lean to as if it
+	// were the one of the image, and how much, from 0 to 1. Styles of
+	// a reference painting take them from it.
+	Direction       float64
+	DirectionWeight float64
 }
 
 // A normal painting style, with no curvature filter, and
@@ -148,36 +222,41 @@ var StylePsychedelic = PainterlyStyle{
 }
 
 func paintLayerStyles(cnv *image.RGBA, refImage image.Image, radius int,
-	settings *PainterlySettings, c appengine.Context) image.Image {
-	D := ImageDifference(cnv, refImage)
+	settings *PainterlySettings, c Context) image.Image {
+	D := ImageDifferenceMetric(cnv, refImage, settings.Metric)
 	magGrad, oriGrad := GradientData(refImage)
 	ys := cnv.Bounds().Max.Y
 	xs := cnv.Bounds().Max.X
-	fradius := float64(radius)
-	for y := 0; y < ys; y += int(fradius * settings.Style.GridSize) {
-		for x := 0; x < xs; x += int(fradius * settings.Style.GridSize) {
-			// Calculates the error near (x,y):
-			areaError := float64(0)
-			maxdif := float64(0)
-			maxx := 0
-			maxy := 0
-			for y2 := IntMax(0, y-radius); y2 < IntMin(ys, y+radius); y2++ {
-				for x2 := IntMax(0, x-radius); x2 < IntMin(xs, x+radius); x2++ {
-					dif := D[y2][x2]
-					areaError += dif
-					if dif > maxdif {
-						maxdif = dif
-						maxx = x2
-						maxy = y2
+	step := IntMax(1, int(float64(radius)*settings.Style.GridSize))
+	for y := 0; y < ys; y += step {
+		for x := 0; x < xs; x += step {
+			// The bright areas of the detail map get more strokes.
+			for _, p := range settings.gridPoints(x, y, step, xs, ys) {
+				x, y := p.X, p.Y
+				// Calculates the error near (x,y):
+				areaError := float64(0)
+				maxdif := float64(0)
+				maxx := 0
+				maxy := 0
+				for y2 := IntMax(0, y-radius); y2 < IntMin(ys, y+radius); y2++ {
+					for x2 := IntMax(0, x-radius); x2 < IntMin(xs, x+radius); x2++ {
+						dif := D[y2][x2]
+						areaError += dif
+						if dif > maxdif {
+							maxdif = dif
+							maxx = x2
+							maxy = y2
+						}
 					}
 				}
-			}
-			areaError = areaError / float64(radius*radius)
+				areaError = areaError / float64(radius*radius)
 
-			if areaError > settings.Style.T {
-				newstroke := createCurve(cnv, refImage, magGrad, oriGrad, maxx, maxy, radius,
-					settings, c)
-				drawStroke(cnv, newstroke, &refImage)
+				if areaError > settings.threshold(x, y) {
+					newstroke := createCurve(cnv, refImage, magGrad, oriGrad, maxx, maxy, radius,
+						settings, c)
+					drawStroke(cnv, newstroke, &refImage)
+					settings.replay.stroke(cnv)
+				}
 			}
 			//D = ImageDifference(cnv, refImage)
 		}
@@ -244,7 +323,7 @@ func createCurve(cnv *image.RGBA,
 	gradOri [][]float64,
 	x0, y0, radius int,
 	settings *PainterlySettings,
-	c appengine.Context) []MyStroke {
+	c Context) []MyStroke {
 	// ------
 	MaxStrokeLength := settings.Style.MaximumStroke
 	MinStrokeLength := settings.Style.MinimumStroke
@@ -272,8 +351,8 @@ func createCurve(cnv *image.RGBA,
 		refColor := refImage.At(x, y)
 		cnvColor := cnv.At(x, y)
 		if i > MinStrokeLength &&
-			(ColorDistance(refColor, cnvColor) <
-				ColorDistance(refColor, strokeColor)) {
+			(settings.Metric.Distance(refColor, cnvColor) <
+				settings.Metric.Distance(refColor, strokeColor)) {
 			return output
 		}
 
@@ -286,6 +365,16 @@ func createCurve(cnv *image.RGBA,
 		gy, gx := math.Sincos(gradOri[y][x])
 		dx, dy := -gx, gy
 
+		// Lean to the direction of the style, on the same side
+		if w := settings.Style.DirectionWeight; w > 0 {
+			ry, rx := math.Sincos(settings.Style.Direction)
+			rdx, rdy := -rx, ry
+			if rdx*dx+rdy*dy < 0 {
+				rdx, rdy = -rdx, -rdy
+			}
+			dx, dy = (1-w)*dx+w*rdx, (1-w)*dy+w*rdy
+		}
+
 		// If necesary, reverse direction
 		if lastDX*dx+lastDY*dy < 0 {
 			dx, dy = -dx, -dy
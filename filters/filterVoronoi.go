@@ -1,21 +1,22 @@
 package filters
 
 import (
-	"appengine"
 	"image"
 	"image/color"
 	"math"
 	"math/rand"
 )
 
-func FilterVoronoi(c appengine.Context, m image.Image) image.Image {
+// FilterVoronoi paints m as cells of flat color, the centroids of the
+// cells are picked with rnd.
+func FilterVoronoi(c Context, m image.Image, rnd *rand.Rand) image.Image {
 	bounds := m.Bounds()
 	out := image.NewNRGBA(bounds)
 	numClusters := int(math.Sqrt(float64(bounds.Max.Y * bounds.Max.X)))
 	// Generates the centroids
 	centroids := make(map[int]([]int))
 	for i := 0; i < numClusters; i++ {
-		centroids[i] = []int{rand.Intn(bounds.Max.X), rand.Intn(bounds.Max.Y)}
+		centroids[i] = []int{rnd.Intn(bounds.Max.X), rnd.Intn(bounds.Max.Y)}
 	}
 	maxval := float64(numClusters * numClusters * numClusters)
 	//clSelection := bidimensionalArray(bounds.Max.X, bounds.Max.Y)
@@ -0,0 +1,164 @@
+package filters
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/disintegration/imaging"
+	"image"
+	"image/color"
+	"image/draw"
+	"strings"
+)
+
+// Shapes of the regions of an image.
+const (
+	ShapeRect    = "rect"
+	ShapeEllipse = "ellipse"
+	// ShapeMask regions are the light parts of a mask image.
+	ShapeMask = "mask"
+)
+
+// MaxRegions limits the regions painted in other styles.
+const MaxRegions = 8
+
+// Region is a part of an image painted in another style than the rest.
+type Region struct {
+	Style string `json:"style"`
+	Shape string `json:"shape"`
+	// Rectangles and ellipses are given by their box, in fractions
+	// of the width and height of the image.
+	X float64 `json:"x,omitempty"`
+	Y float64 `json:"y,omitempty"`
+	W float64 `json:"w,omitempty"`
+	H float64 `json:"h,omitempty"`
+	// Mask identifies the mask image of ShapeMask regions.
+	Mask string `json:"mask,omitempty"`
+	// Feather blurs the border of the region, blending both styles,
+	// over a fraction of the longest side of the image.
+	Feather float64 `json:"feather,omitempty"`
+}
+
+// ParseRegions decodes and validates a JSON list of regions.
+func ParseRegions(data []byte) ([]Region, error) {
+	var regions []Region
+	if err := json.Unmarshal(data, &regions); err != nil {
+		return nil, fmt.Errorf("regions: %v", err)
+	}
+	if len(regions) > MaxRegions {
+		return nil, fmt.Errorf("regions: too many regions (%v, max %v)", len(regions), MaxRegions)
+	}
+	for i := range regions {
+		r := &regions[i]
+		r.Style = strings.ToLower(strings.TrimSpace(r.Style))
+		r.Shape = strings.ToLower(strings.TrimSpace(r.Shape))
+		_, isFilter := Registry[r.Style]
+		if _, isPipeline := Pipelines[r.Style]; !isFilter && !isPipeline {
+			return nil, fmt.Errorf("regions: region %v: unknown style %q", i, r.Style)
+		}
+		switch r.Shape {
+		case ShapeRect, ShapeEllipse:
+			if r.W <= 0 || r.H <= 0 {
+				return nil, fmt.Errorf("regions: region %v: the %s is empty", i, r.Shape)
+			}
+		case ShapeMask:
+			if r.Mask == "" {
+				return nil, fmt.Errorf("regions: region %v: the mask is missing", i)
+			}
+		default:
+			return nil, fmt.Errorf("regions: region %v: unknown shape %q", i, r.Shape)
+		}
+		if r.Feather < 0 || r.Feather > 0.5 {
+			return nil, fmt.Errorf("regions: region %v: the feather must be between 0 and 0.5", i)
+		}
+	}
+	return regions, nil
+}
+
+// MaskOf returns the mask of the region over bounds: opaque inside the
+// region and transparent outside, with the border feathered. mask is
+// the image of ShapeMask regions, its light parts are the region and
+// it is stretched over bounds.
+func (r *Region) MaskOf(bounds image.Rectangle, mask image.Image) *image.Alpha {
+	res := image.NewGray(bounds)
+	w, h := float64(bounds.Dx()), float64(bounds.Dy())
+	switch r.Shape {
+	case ShapeMask:
+		if mask == nil {
+			break
+		}
+		draw.Draw(res, bounds, imaging.Resize(mask, bounds.Dx(), bounds.Dy(), imaging.Linear), image.Point{}, draw.Src)
+	case ShapeRect:
+		box := image.Rect(int(r.X*w), int(r.Y*h), int((r.X+r.W)*w), int((r.Y+r.H)*h)).Add(bounds.Min)
+		draw.Draw(res, box.Intersect(bounds), image.White, image.Point{}, draw.Src)
+	case ShapeEllipse:
+		cx, cy := (r.X+r.W/2)*w, (r.Y+r.H/2)*h
+		rx, ry := r.W*w/2, r.H*h/2
+		for y := 0; y < bounds.Dy(); y++ {
+			for x := 0; x < bounds.Dx(); x++ {
+				dx, dy := (float64(x)+0.5-cx)/rx, (float64(y)+0.5-cy)/ry
+				if dx*dx+dy*dy <= 1 {
+					res.SetGray(bounds.Min.X+x, bounds.Min.Y+y, color.Gray{255})
+				}
+			}
+		}
+	}
+	if sigma := r.Feather * float64(IntMax(bounds.Dx(), bounds.Dy())); sigma >= 0.5 {
+		blurred := imaging.Blur(res, sigma)
+		draw.Draw(res, bounds, blurred, image.Point{}, draw.Src)
+	}
+	return &image.Alpha{Pix: res.Pix, Stride: res.Stride, Rect: res.Rect}
+}
+
+// Blend returns base with over on top where the mask is opaque, mixing
+// them where it is translucent. The three have the same bounds.
+func Blend(base, over image.Image, mask *image.Alpha) *image.RGBA {
+	res := image.NewRGBA(base.Bounds())
+	draw.Draw(res, res.Bounds(), base, base.Bounds().Min, draw.Src)
+	draw.DrawMask(res, res.Bounds(), over, over.Bounds().Min, mask, mask.Bounds().Min, draw.Over)
+	return res
+}
+
+// PaintRegions paints every region of m in its own style and blends it
+// over base, the painting of the whole image. masks are the mask
+// images of the regions, by their Mask.
+func PaintRegions(c Context, base, m image.Image, settings *PainterlySettings,
+	regions []Region, masks map[string]image.Image) image.Image {
+	bounds := base.Bounds()
+	for _, r := range regions {
+		s := PainterlySettings{}
+		if settings != nil {
+			s = *settings
+		}
+		// Every region starts with the seed, like the base painting.
+		s.rnd = nil
+		painted := StylePipeline(r.Style).Run(c, m, &s)
+		if painted.Bounds().Size() != bounds.Size() {
+			painted = imaging.Resize(painted, bounds.Dx(), bounds.Dy(), imaging.Lanczos)
+		}
+		base = Blend(base, painted, r.MaskOf(bounds, masks[r.Mask]))
+	}
+	return base
+}
+
+// PaintAnimationRegions is PaintRegions for the frames of an animation,
+// painted as base. Every region paints the frames of a with
+// RunAnimation, so its strokes are kept from frame to frame like those
+// of the base painting, and the regions don't flicker.
+func PaintAnimationRegions(c Context, base, a *Animation, settings *PainterlySettings,
+	regions []Region, masks map[string]image.Image) *Animation {
+	if len(base.Frames) == 0 {
+		return base
+	}
+	bounds := base.Frames[0].Bounds()
+	for _, r := range regions {
+		painted := StylePipeline(r.Style).RunAnimation(c, a, settings)
+		mask := r.MaskOf(bounds, masks[r.Mask])
+		for i, frame := range painted.Frames {
+			if frame.Bounds().Size() != bounds.Size() {
+				frame = imaging.Resize(frame, bounds.Dx(), bounds.Dy(), imaging.Lanczos)
+			}
+			base.Frames[i] = Blend(base.Frames[i], frame, mask)
+		}
+	}
+	return base
+}
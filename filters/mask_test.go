@@ -0,0 +1,80 @@
+package filters
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestParseRegions(t *testing.T) {
+	regions, err := ParseRegions([]byte(`[{"style":"Voronoi","shape":"ellipse","x":0.1,"y":0.1,"w":0.5,"h":0.5,"feather":0.05},
+		{"style":"oilcanvas","shape":"mask","mask":"abc"}]`))
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if len(regions) != 2 || regions[0].Style != "voronoi" || regions[1].Mask != "abc" {
+		t.Errorf("Expected 2 regions, given %+v", regions)
+	}
+
+	bad := []string{
+		`[{"style":"nope","shape":"rect","w":1,"h":1}]`,
+		`[{"style":"voronoi","shape":"star","w":1,"h":1}]`,
+		`[{"style":"voronoi","shape":"rect"}]`,
+		`[{"style":"voronoi","shape":"mask"}]`,
+		`[{"style":"voronoi","shape":"rect","w":1,"h":1,"feather":2}]`,
+		`{"style":"voronoi"}`,
+	}
+	for _, v := range bad {
+		if _, err := ParseRegions([]byte(v)); err == nil {
+			t.Errorf("Expected error for %v", v)
+		}
+	}
+}
+
+func TestMaskOf(t *testing.T) {
+	bounds := image.Rect(0, 0, 100, 50)
+	rect := (&Region{Shape: ShapeRect, X: 0.5, W: 0.5, H: 1}).MaskOf(bounds, nil)
+	if rect.AlphaAt(10, 10).A != 0 || rect.AlphaAt(90, 10).A != 255 {
+		t.Errorf("Expected the right half, given %v and %v", rect.AlphaAt(10, 10), rect.AlphaAt(90, 10))
+	}
+
+	ellipse := (&Region{Shape: ShapeEllipse, W: 1, H: 1}).MaskOf(bounds, nil)
+	if ellipse.AlphaAt(50, 25).A != 255 || ellipse.AlphaAt(1, 1).A != 0 {
+		t.Errorf("Expected the inscribed ellipse")
+	}
+
+	feathered := (&Region{Shape: ShapeRect, X: 0.5, W: 0.5, H: 1, Feather: 0.05}).MaskOf(bounds, nil)
+	if a := feathered.AlphaAt(50, 25).A; a == 0 || a == 255 {
+		t.Errorf("Expected the border blended, given %v", a)
+	}
+	if feathered.AlphaAt(5, 25).A != 0 || feathered.AlphaAt(95, 25).A != 255 {
+		t.Errorf("Expected the feather only near the border")
+	}
+
+	// Masks are stretched over the image.
+	m := image.NewGray(image.Rect(0, 0, 10, 10))
+	for y := 0; y < 10; y++ {
+		m.SetGray(0, y, color.Gray{255})
+		m.SetGray(1, y, color.Gray{255})
+	}
+	masked := (&Region{Shape: ShapeMask, Mask: "m"}).MaskOf(bounds, m)
+	if masked.AlphaAt(5, 25).A != 255 || masked.AlphaAt(80, 25).A != 0 {
+		t.Errorf("Expected the light part of the mask, given %v and %v", masked.AlphaAt(5, 25), masked.AlphaAt(80, 25))
+	}
+}
+
+func TestPaintRegions(t *testing.T) {
+	m := testFrame(5)
+	base := image.NewRGBA(m.Bounds())
+	for i := 0; i < len(base.Pix); i += 4 {
+		copy(base.Pix[i:], []uint8{255, 0, 0, 255})
+	}
+	regions := []Region{{Style: "grayscale", Shape: ShapeRect, W: 0.5, H: 1}}
+	res := ToRGBA(PaintRegions(quietContext{}, base, m, &PainterlySettings{}, regions, nil))
+	if c := res.RGBAAt(40, 5); c != (color.RGBA{255, 0, 0, 255}) {
+		t.Errorf("Expected the base outside the region, given %v", c)
+	}
+	if c := res.RGBAAt(20, 5); c.R != c.G || c.G != c.B {
+		t.Errorf("Expected the region in grayscale, given %v", c)
+	}
+}
@@ -0,0 +1,223 @@
+package filters
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// MaxPaletteColors is the largest palette that can be used.
+const MaxPaletteColors = 64
+
+// Palettes are the built-in artist palettes.
+var Palettes = map[string]color.Palette{
+	// Anders Zorn's limited palette.
+	"zorn": hexPalette("#c89b3c", "#d14a2f", "#231f20", "#f4f1e8"),
+	"vangogh": hexPalette("#1b3a5c", "#3b5ba5", "#f2c12e", "#e8a93a", "#2e8b57",
+		"#d9432b", "#c89b3c", "#f5f2e7", "#2a2a2a"),
+	"monet": hexPalette("#f4f1ea", "#f6d13a", "#3b8b6e", "#3e63b0", "#2b3a8c",
+		"#d4442e", "#8e5c9e", "#a83c4a"),
+	"sepia":   hexPalette("#2b1d0e", "#5a3e1b", "#8c6a3c", "#c4a77d", "#efe3cb"),
+	"gameboy": hexPalette("#0f380f", "#306230", "#8bac0f", "#9bbc0f"),
+}
+
+// PaletteNames returns the built-in palette names in alphabetical order.
+func PaletteNames() []string {
+	names := make([]string, 0, len(Palettes))
+	for k := range Palettes {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ParsePalette reads a list of hex colors (#rrggbb or #rgb) separated
+// by commas, spaces or new lines.
+func ParsePalette(s string) (color.Palette, error) {
+	fields := strings.FieldsFunc(s, func(r rune) bool {
+		return r == ',' || r == ';' || r == ' ' || r == '\n' || r == '\r' || r == '\t'
+	})
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("palette: no colors")
+	}
+	if len(fields) > MaxPaletteColors {
+		return nil, fmt.Errorf("palette: too many colors (%v, max %v)", len(fields), MaxPaletteColors)
+	}
+	p := make(color.Palette, 0, len(fields))
+	for _, f := range fields {
+		c, err := parseHexColor(f)
+		if err != nil {
+			return nil, err
+		}
+		p = append(p, c)
+	}
+	return p, nil
+}
+
+func parseHexColor(s string) (color.NRGBA, error) {
+	h := strings.TrimPrefix(strings.TrimSpace(s), "#")
+	if len(h) == 3 {
+		h = string([]byte{h[0], h[0], h[1], h[1], h[2], h[2]})
+	}
+	v, err := strconv.ParseUint(h, 16, 32)
+	if len(h) != 6 || err != nil {
+		return color.NRGBA{}, fmt.Errorf("palette: invalid color %q", s)
+	}
+	return color.NRGBA{uint8(v >> 16), uint8(v >> 8), uint8(v), 255}, nil
+}
+
+func hexPalette(colors ...string) color.Palette {
+	p, err := ParsePalette(strings.Join(colors, ","))
+	if err != nil {
+		panic(err)
+	}
+	return p
+}
+
+// SnapColor returns the color of the palette nearest to c, keeping
+// the alpha of c.
+func SnapColor(p color.Palette, c color.NRGBA) color.NRGBA {
+	n := color.NRGBAModel.Convert(p.Convert(c)).(color.NRGBA)
+	n.A = c.A
+	return n
+}
+
+// ApplyPalette redraws m using only the colors of the palette,
+// optionally with Floyd-Steinberg dithering.
+func ApplyPalette(m image.Image, p color.Palette, dither bool) image.Image {
+	out := image.NewPaletted(m.Bounds(), p)
+	if dither {
+		draw.FloydSteinberg.Draw(out, out.Bounds(), m, m.Bounds().Min)
+	} else {
+		draw.Draw(out, out.Bounds(), m, m.Bounds().Min, draw.Src)
+	}
+	return out
+}
+
+// ExtractPalette finds the k colors that best represent m. The initial
+// colors come from a median cut, and are then refined with k-means.
+func ExtractPalette(m image.Image, k int) color.Palette {
+	k = IntMax(1, IntMin(k, MaxPaletteColors))
+	samples := samplePixels(m, 10000)
+	if len(samples) == 0 {
+		return color.Palette{color.Black}
+	}
+
+	centroids := medianCut(samples, k)
+	for iter := 0; iter < 8; iter++ {
+		sums := make([][4]int, len(centroids))
+		for _, s := range samples {
+			best, bestDist := 0, 1<<31-1
+			for j, c := range centroids {
+				if d := rgbDist2(s, c); d < bestDist {
+					best, bestDist = j, d
+				}
+			}
+			sums[best][0] += int(s[0])
+			sums[best][1] += int(s[1])
+			sums[best][2] += int(s[2])
+			sums[best][3]++
+		}
+		for j := range centroids {
+			if n := sums[j][3]; n > 0 {
+				centroids[j] = [3]uint8{uint8(sums[j][0] / n), uint8(sums[j][1] / n), uint8(sums[j][2] / n)}
+			}
+		}
+	}
+
+	// Boxes cut through a run of equal colors end up with the same
+	// centroid, only one of them is kept.
+	p := make(color.Palette, 0, len(centroids))
+	seen := make(map[[3]uint8]bool)
+	for _, c := range centroids {
+		if !seen[c] {
+			seen[c] = true
+			p = append(p, color.NRGBA{c[0], c[1], c[2], 255})
+		}
+	}
+	return p
+}
+
+// samplePixels returns about max colors of m, taken in a regular grid.
+func samplePixels(m image.Image, max int) [][3]uint8 {
+	b := m.Bounds()
+	step := 1
+	for (b.Dx()/step)*(b.Dy()/step) > max {
+		step++
+	}
+	var res [][3]uint8
+	for y := b.Min.Y; y < b.Max.Y; y += step {
+		for x := b.Min.X; x < b.Max.X; x += step {
+			c := color.NRGBAModel.Convert(m.At(x, y)).(color.NRGBA)
+			res = append(res, [3]uint8{c.R, c.G, c.B})
+		}
+	}
+	return res
+}
+
+// medianCut splits the samples in k boxes, each time cutting the box
+// with the widest channel range by its median.
+func medianCut(samples [][3]uint8, k int) [][3]uint8 {
+	boxes := [][][3]uint8{samples}
+	for len(boxes) < k {
+		widest, channel, width := -1, 0, 0
+		for i, box := range boxes {
+			if len(box) < 2 {
+				continue
+			}
+			for ch := 0; ch < 3; ch++ {
+				lo, hi := uint8(255), uint8(0)
+				for _, s := range box {
+					if s[ch] < lo {
+						lo = s[ch]
+					}
+					if s[ch] > hi {
+						hi = s[ch]
+					}
+				}
+				if int(hi)-int(lo) > width {
+					widest, channel, width = i, ch, int(hi)-int(lo)
+				}
+			}
+		}
+		if widest < 0 {
+			break
+		}
+		box := boxes[widest]
+		sort.Sort(byChannel{box, channel})
+		half := len(box) / 2
+		boxes[widest] = box[:half]
+		boxes = append(boxes, box[half:])
+	}
+
+	res := make([][3]uint8, len(boxes))
+	for i, box := range boxes {
+		var sum [3]int
+		for _, s := range box {
+			sum[0] += int(s[0])
+			sum[1] += int(s[1])
+			sum[2] += int(s[2])
+		}
+		n := IntMax(1, len(box))
+		res[i] = [3]uint8{uint8(sum[0] / n), uint8(sum[1] / n), uint8(sum[2] / n)}
+	}
+	return res
+}
+
+type byChannel struct {
+	s  [][3]uint8
+	ch int
+}
+
+func (b byChannel) Len() int           { return len(b.s) }
+func (b byChannel) Less(i, j int) bool { return b.s[i][b.ch] < b.s[j][b.ch] }
+func (b byChannel) Swap(i, j int)      { b.s[i], b.s[j] = b.s[j], b.s[i] }
+
+func rgbDist2(a, b [3]uint8) int {
+	dr, dg, db := int(a[0])-int(b[0]), int(a[1])-int(b[1]), int(a[2])-int(b[2])
+	return dr*dr + dg*dg + db*db
+}
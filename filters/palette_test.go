@@ -0,0 +1,120 @@
+package filters
+
+import (
+	"image"
+	"image/color"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestParsePalette(t *testing.T) {
+	p, err := ParsePalette("#f00, 00ff00;#0000FF\n#123")
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	expected := color.Palette{color.NRGBA{255, 0, 0, 255}, color.NRGBA{0, 255, 0, 255},
+		color.NRGBA{0, 0, 255, 255}, color.NRGBA{0x11, 0x22, 0x33, 255}}
+	if len(p) != len(expected) {
+		t.Fatalf("Expected %v colors, given %v", len(expected), p)
+	}
+	for i := range p {
+		if p[i] != expected[i] {
+			t.Errorf("Color %v: expected %v, given %v", i, expected[i], p[i])
+		}
+	}
+
+	bad := []string{"", " , ", "#12", "#gggggg", "#1234567", "red",
+		strings.Repeat("#000,", MaxPaletteColors+1)}
+	for _, v := range bad {
+		if _, err := ParsePalette(v); err == nil {
+			t.Errorf("Expected error for %q", v)
+		}
+	}
+}
+
+func TestBuiltinPalettes(t *testing.T) {
+	names := PaletteNames()
+	if len(names) != len(Palettes) || !sort.StringsAreSorted(names) {
+		t.Errorf("Expected every palette name in order, given %v", names)
+	}
+	for name, p := range Palettes {
+		if len(p) < 2 || len(p) > MaxPaletteColors {
+			t.Errorf("%v: unexpected size %v", name, len(p))
+		}
+	}
+}
+
+func TestExtractPalette(t *testing.T) {
+	red, blue := color.NRGBA{200, 20, 20, 255}, color.NRGBA{20, 20, 200, 255}
+	m := image.NewNRGBA(image.Rect(0, 0, 20, 20))
+	for y := 0; y < 20; y++ {
+		for x := 0; x < 20; x++ {
+			if x < 5 {
+				m.SetNRGBA(x, y, red)
+			} else {
+				m.SetNRGBA(x, y, blue)
+			}
+		}
+	}
+	p := ExtractPalette(m, 8)
+	if len(p) != 2 {
+		t.Fatalf("Expected the 2 colors of the image, given %v", p)
+	}
+	if p.Index(red) == p.Index(blue) || p[p.Index(red)] != red || p[p.Index(blue)] != blue {
+		t.Errorf("Expected red and blue, given %v", p)
+	}
+
+	// k-means moves every color to the middle of its cluster.
+	for y := 0; y < 20; y++ {
+		for x := 0; x < 20; x++ {
+			v := uint8(x % 2 * 10)
+			if x < 10 {
+				m.SetNRGBA(x, y, color.NRGBA{v, v, v, 255})
+			} else {
+				m.SetNRGBA(x, y, color.NRGBA{240 + v, 240 + v, 240 + v, 255})
+			}
+		}
+	}
+	p = ExtractPalette(m, 2)
+	dark, light := color.NRGBA{5, 5, 5, 255}, color.NRGBA{245, 245, 245, 255}
+	if len(p) != 2 || p[p.Index(dark)] != dark || p[p.Index(light)] != light {
+		t.Errorf("Expected the centers of the clusters, given %v", p)
+	}
+}
+
+func TestMedianCut(t *testing.T) {
+	samples := [][3]uint8{{0, 0, 0}, {10, 0, 0}, {0, 200, 0}, {10, 200, 0}}
+	boxes := medianCut(samples, 2)
+	if len(boxes) != 2 {
+		t.Fatalf("Expected 2 boxes, given %v", boxes)
+	}
+	// The green channel is the widest, so it is the one cut.
+	if boxes[0] != [3]uint8{5, 0, 0} || boxes[1] != [3]uint8{5, 200, 0} {
+		t.Errorf("Expected the boxes cut by green, given %v", boxes)
+	}
+}
+
+func TestApplyPalette(t *testing.T) {
+	p := color.Palette{color.Black, color.White}
+	m := image.NewNRGBA(image.Rect(0, 0, 8, 8))
+	for i := 0; i < len(m.Pix); i += 4 {
+		m.Pix[i], m.Pix[i+1], m.Pix[i+2], m.Pix[i+3] = 100, 100, 100, 255
+	}
+	count := func(res image.Image) (black int) {
+		for y := 0; y < 8; y++ {
+			for x := 0; x < 8; x++ {
+				if res.(*image.Paletted).ColorIndexAt(x, y) == 0 {
+					black++
+				}
+			}
+		}
+		return black
+	}
+	if n := count(ApplyPalette(m, p, false)); n != 64 {
+		t.Errorf("Expected every pixel snapped to black, given %v", n)
+	}
+	if n := count(ApplyPalette(m, p, true)); n == 64 || n == 0 {
+		t.Errorf("Expected the gray dithered with black and white, given %v black", n)
+	}
+}
@@ -0,0 +1,238 @@
+package filters
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/disintegration/gift"
+	"github.com/disintegration/imaging"
+	"image"
+	"sort"
+	"strings"
+)
+
+// Operations understood by a Pipeline step.
+const (
+	OpResize  = "resize"
+	OpAdjust  = "adjust"
+	OpFilter  = "filter"
+	OpTexture = "texture"
+	OpSharpen = "sharpen"
+)
+
+// MaxPipelineSteps limits how much work a single render can request.
+const MaxPipelineSteps = 12
+
+// A Step is one stage of a Pipeline. Name selects the filter or
+// texture for the "filter" and "texture" operations, Params holds
+// the numeric arguments of the operation.
+type Step struct {
+	Op     string             `json:"op"`
+	Name   string             `json:"name,omitempty"`
+	Params map[string]float64 `json:"params,omitempty"`
+}
+
+// A Pipeline chains several steps, each one applied to the output
+// of the previous one. It is described by a JSON document like:
+//
+//	{"steps": [
+//		{"op": "filter", "name": "oilpaint"},
+//		{"op": "texture", "name": "canvas", "params": {"amount": 0.3}},
+//		{"op": "texture", "name": "vignette"}
+//	]}
+type Pipeline struct {
+	Title string `json:"-"`
+	Steps []Step `json:"steps"`
+}
+
+// Pipelines are the predefined pipelines, requested by ID.
+var Pipelines = map[string]*Pipeline{
+	"oilcanvas": &Pipeline{
+		Title: "Oil on Canvas",
+		Steps: []Step{
+			{Op: OpFilter, Name: "oilpaint"},
+			{Op: OpTexture, Name: "canvas", Params: map[string]float64{"amount": 0.25}},
+			{Op: OpTexture, Name: "vignette", Params: map[string]float64{"amount": 0.5}},
+		},
+	},
+	"sharpimpressionist": &Pipeline{
+		Title: "Sharp Impresionist",
+		Steps: []Step{
+			{Op: OpAdjust, Params: map[string]float64{"contrast": 10, "saturation": 20}},
+			{Op: OpFilter, Name: "impresionist"},
+			{Op: OpSharpen, Params: map[string]float64{"sigma": 1}},
+		},
+	},
+}
+
+// PipelineNames returns the IDs of the predefined pipelines in
+// alphabetical order.
+func PipelineNames() []string {
+	names := make([]string, 0, len(Pipelines))
+	for k := range Pipelines {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// SingleFilter returns a pipeline that only applies the named filter.
+func SingleFilter(name string) *Pipeline {
+	return &Pipeline{Steps: []Step{{Op: OpFilter, Name: name}}}
+}
+
+// StylePipeline returns the pipeline for a style, that is either the
+// ID of a predefined pipeline or a filter. Unknown styles get the
+// DefaultFilter.
+func StylePipeline(style string) *Pipeline {
+	if p, ok := Pipelines[style]; ok {
+		return p
+	}
+	if _, ok := Registry[style]; !ok {
+		style = DefaultFilter
+	}
+	return SingleFilter(style)
+}
+
+// ParsePipeline decodes and validates a JSON pipeline description.
+func ParsePipeline(data []byte) (*Pipeline, error) {
+	p := &Pipeline{}
+	if err := json.Unmarshal(data, p); err != nil {
+		return nil, fmt.Errorf("pipeline: %v", err)
+	}
+	for i := range p.Steps {
+		p.Steps[i].Op = strings.ToLower(strings.TrimSpace(p.Steps[i].Op))
+		p.Steps[i].Name = strings.ToLower(strings.TrimSpace(p.Steps[i].Name))
+	}
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Validate checks every step against the filter and texture registries.
+// At least one step has to be a filter, so that the image is painted:
+// the other steps alone would give back the original.
+func (p *Pipeline) Validate() error {
+	if len(p.Steps) == 0 {
+		return fmt.Errorf("pipeline: no steps")
+	}
+	if len(p.Steps) > MaxPipelineSteps {
+		return fmt.Errorf("pipeline: too many steps (%v, max %v)", len(p.Steps), MaxPipelineSteps)
+	}
+	for i, s := range p.Steps {
+		switch s.Op {
+		case OpResize:
+			if s.Params["size"] < 1 {
+				return fmt.Errorf("pipeline: step %v: resize needs a positive size", i)
+			}
+		case OpAdjust:
+			for k := range s.Params {
+				if !adjustParams[k] {
+					return fmt.Errorf("pipeline: step %v: unknown adjustment %q", i, k)
+				}
+			}
+		case OpFilter:
+			if _, ok := Registry[s.Name]; !ok {
+				return fmt.Errorf("pipeline: step %v: unknown filter %q", i, s.Name)
+			}
+		case OpTexture:
+			if _, ok := Textures[s.Name]; !ok {
+				return fmt.Errorf("pipeline: step %v: unknown texture %q", i, s.Name)
+			}
+		case OpSharpen:
+		default:
+			return fmt.Errorf("pipeline: step %v: unknown operation %q", i, s.Op)
+		}
+	}
+	for _, s := range p.Steps {
+		if s.Op == OpFilter {
+			return nil
+		}
+	}
+	return fmt.Errorf("pipeline: no filter step")
+}
+
+// Canonical returns the JSON encoding of the pipeline. Two pipelines
+// doing the same work have the same canonical form, since the keys of
+// Params are always encoded in order.
+func (p *Pipeline) Canonical() []byte {
+	b, _ := json.Marshal(p)
+	return b
+}
+
+// Hash identifies the pipeline, it is used in the render cache keys.
+func (p *Pipeline) Hash() string {
+	sum := sha1.Sum(p.Canonical())
+	return hex.EncodeToString(sum[:])
+}
+
+// Run applies every step of the pipeline to m.
+func (p *Pipeline) Run(c Context, m image.Image, settings *PainterlySettings) image.Image {
+	for i, s := range p.Steps {
+		if settings != nil && settings.coherence != nil {
+			settings.coherence.step = i
+		}
+		switch s.Op {
+		case OpResize:
+			m = RescaleImage(m, int(s.Params["size"]))
+		case OpAdjust:
+			m = adjustStep(m, s.Params)
+		case OpFilter:
+			m = Registry[s.Name](c, m, settings)
+		case OpTexture:
+			m = Textures[s.Name](m, s.param("amount", 0.3))
+		case OpSharpen:
+			m = imaging.Sharpen(m, s.param("sigma", 1))
+		}
+	}
+	return m
+}
+
+func (s *Step) param(name string, def float64) float64 {
+	if v, ok := s.Params[name]; ok {
+		return v
+	}
+	return def
+}
+
+var adjustParams = map[string]bool{
+	"brightness":  true,
+	"contrast":    true,
+	"saturation":  true,
+	"gamma":       true,
+	"exposure":    true,
+	"temperature": true,
+	"tint":        true,
+	"autolevels":  true,
+}
+
+func adjustStep(m image.Image, params map[string]float64) image.Image {
+	a := AdjustmentsFromParams(params)
+	m = Adjust(m, &a)
+
+	g := gift.New()
+	if v, ok := params["brightness"]; ok {
+		g.Add(gift.Brightness(float32(v)))
+	}
+	if v, ok := params["gamma"]; ok && v > 0 {
+		g.Add(gift.Gamma(float32(v)))
+	}
+	if len(g.Filters) == 0 {
+		return m
+	}
+	dst := image.NewNRGBA(g.Bounds(m.Bounds()))
+	g.Draw(dst, m)
+	return dst
+}
+
+// WithAdjustments returns a copy of the pipeline that applies the
+// adjustments before any other step.
+func (p *Pipeline) WithAdjustments(a *Adjustments) *Pipeline {
+	if a.IsZero() {
+		return p
+	}
+	steps := append([]Step{{Op: OpAdjust, Params: a.Params()}}, p.Steps...)
+	return &Pipeline{Title: p.Title, Steps: steps}
+}
@@ -0,0 +1,43 @@
+package filters
+
+import "testing"
+
+func TestParsePipeline(t *testing.T) {
+	p, err := ParsePipeline([]byte(`{"steps":[{"op":"Filter","name":"oilpaint"},
+		{"op":"texture","name":"canvas","params":{"amount":0.2}}]}`))
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if len(p.Steps) != 2 || p.Steps[0].Op != OpFilter {
+		t.Errorf("Expected 2 steps starting with filter, given %v", p.Steps)
+	}
+
+	bad := []string{
+		`{"steps":[]}`,
+		`{"steps":[{"op":"filter","name":"nope"}]}`,
+		`{"steps":[{"op":"texture","name":"nope"}]}`,
+		`{"steps":[{"op":"explode"}]}`,
+		`{"steps":[{"op":"resize"}]}`,
+		`{"steps":[{"op":"resize","params":{"size":200}},{"op":"sharpen"}]}`,
+		`{"steps":[{"op":"adjust","params":{"contrast":10}}]}`,
+		`not json`,
+	}
+	for _, v := range bad {
+		if _, err := ParsePipeline([]byte(v)); err == nil {
+			t.Errorf("Expected error for %v", v)
+		}
+	}
+}
+
+func TestPipelineHash(t *testing.T) {
+	a, _ := ParsePipeline([]byte(`{"steps":[{"op":"adjust","params":{"contrast":10,"gamma":1.2}},
+		{"op":"filter","name":"voronoi"}]}`))
+	b, _ := ParsePipeline([]byte(`{"steps":[{"params":{"gamma":1.2,"contrast":10},"op":"ADJUST"},
+		{"name":"voronoi","op":"filter"}]}`))
+	if a.Hash() != b.Hash() {
+		t.Errorf("Expected equal hashes, given %v and %v", a.Hash(), b.Hash())
+	}
+	if a.Hash() == SingleFilter("voronoi").Hash() {
+		t.Errorf("Expected different hashes")
+	}
+}
@@ -0,0 +1,217 @@
+package filters
+
+import (
+	colorful "github.com/lucasb-eyer/go-colorful"
+	"image"
+	"image/color"
+	"math"
+)
+
+// ReferenceStats describe the look of a reference painting, so a
+// photo can be painted like it.
+type ReferenceStats struct {
+	// Main colors of the painting
+	Palette []color.NRGBA
+
+	// Mean and standard deviation of each CIELAB channel
+	LabMean [3]float64
+	LabStd  [3]float64
+
+	// Cumulative histogram of the lightness, from 0 to 1
+	Lightness [101]float64
+
+	// Fraction of the pixels on an edge
+	EdgeDensity float64
+	// How aligned are the strokes, from 0 (random) to 1 (parallel)
+	Coherence float64
+	// Dominant orientation of the gradient, in radians, that the
+	// strokes go across
+	Direction float64
+}
+
+// referenceSize is the size the reference is analyzed at.
+const referenceSize = 300
+
+// AnalyzeReference extracts the color and stroke statistics of m.
+func AnalyzeReference(m image.Image) *ReferenceStats {
+	m = RescaleImage(m, referenceSize)
+	s := &ReferenceStats{}
+	for _, c := range ExtractPalette(m, 12) {
+		s.Palette = append(s.Palette, c.(color.NRGBA))
+	}
+
+	// Color statistics
+	labs := labPixels(m)
+	s.LabMean, s.LabStd = labMeanStd(labs)
+	var hist [101]float64
+	for _, v := range labs {
+		hist[IntMax(0, IntMin(100, int(v[0]+0.5)))]++
+	}
+	acc := 0.0
+	for i := range hist {
+		acc += hist[i]
+		s.Lightness[i] = acc / float64(len(labs))
+	}
+
+	// Stroke statistics, from the structure of the gradient
+	mag, ori := GradientData(m)
+	var sumMag, sumCos, sumSin float64
+	edges, total := 0, 0
+	for y := range mag {
+		for x := range mag[y] {
+			total++
+			if mag[y][x] > 64 {
+				edges++
+			}
+			// Orientations are doubled so opposite gradients add up
+			sumMag += mag[y][x]
+			sumCos += mag[y][x] * math.Cos(2*ori[y][x])
+			sumSin += mag[y][x] * math.Sin(2*ori[y][x])
+		}
+	}
+	if total > 0 {
+		s.EdgeDensity = float64(edges) / float64(total)
+	}
+	if sumMag > 0 {
+		s.Coherence = math.Hypot(sumCos, sumSin) / sumMag
+		s.Direction = math.Atan2(sumSin, sumCos) / 2
+	}
+	return s
+}
+
+// ColorPalette returns the palette of the reference.
+func (s *ReferenceStats) ColorPalette() color.Palette {
+	p := make(color.Palette, len(s.Palette))
+	for i, c := range s.Palette {
+		p[i] = c
+	}
+	return p
+}
+
+// Style derives a painterly style from the statistics. Detailed
+// references get small brushes and a low threshold, references with
+// aligned strokes get long and straight strokes in their direction.
+func (s *ReferenceStats) Style() PainterlyStyle {
+	detail := Clamp64(0, s.EdgeDensity*4, 1)
+	maxStroke := 4 + int(12*s.Coherence)
+	sty := PainterlyStyle{
+		Name:          "Reference",
+		T:             50 + 150*(1-detail),
+		Radius:        4 - int(2*detail+0.5),
+		NumOfBrushes:  3,
+		FC:            Clamp64(0.25, 1-s.Coherence, 1),
+		BlurFactor:    0.5,
+		Opacity:       0.8,
+		GridSize:      1,
+		MinimumStroke: maxStroke / 4,
+		MaximumStroke: maxStroke,
+		// Paintings with very varied lightness have livelier strokes
+		JitterValue:     Clamp64(0, s.LabStd[0]/100, 0.5),
+		Direction:       s.Direction,
+		DirectionWeight: s.Coherence,
+	}
+	return sty
+}
+
+// TransferColor gives m the colors of the reference: the lightness
+// histogram is matched, and the chroma channels are moved to have
+// the mean and deviation of the reference.
+func TransferColor(m image.Image, s *ReferenceStats) image.Image {
+	bounds := m.Bounds()
+	labs := labPixels(m)
+	mean, std := labMeanStd(labs)
+
+	// Cumulative histogram of the target lightness
+	var hist, cdf [101]float64
+	for _, v := range labs {
+		hist[IntMax(0, IntMin(100, int(v[0]+0.5)))]++
+	}
+	acc := 0.0
+	for i := range hist {
+		acc += hist[i]
+		cdf[i] = acc / float64(len(labs))
+	}
+	// For every lightness, the reference lightness with the same rank
+	var lmap [101]float64
+	j := 0
+	for i := range cdf {
+		for j < 100 && s.Lightness[j] < cdf[i] {
+			j++
+		}
+		lmap[i] = float64(j)
+	}
+
+	out := image.NewNRGBA(bounds)
+	i := 0
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			v := labs[i]
+			i++
+			l := lmap[IntMax(0, IntMin(100, int(v[0]+0.5)))]
+			a, b := v[1], v[2]
+			if std[1] > 0 {
+				a = (a-mean[1])/std[1]*s.LabStd[1] + s.LabMean[1]
+			}
+			if std[2] > 0 {
+				b = (b-mean[2])/std[2]*s.LabStd[2] + s.LabMean[2]
+			}
+			r, g, bl := colorful.Lab(l/100, a/100, b/100).Clamped().RGB255()
+			_, _, _, alpha := m.At(x, y).RGBA()
+			out.SetNRGBA(x, y, color.NRGBA{r, g, bl, uint8(alpha >> 8)})
+		}
+	}
+	return out
+}
+
+// FilterReference paints m in the style of the reference of the
+// settings. Without a reference it paints as an impressionist.
+func FilterReference(c Context, m image.Image, settings *PainterlySettings) image.Image {
+	s := PainterlySettings{Style: StyleImpressionist}
+	if settings != nil {
+		s = *settings
+		s.Style = StyleImpressionist
+	}
+	if s.Reference != nil {
+		m = TransferColor(m, s.Reference)
+		s.Style = s.Reference.Style()
+	}
+	return FilterPainterlyStyles(c, m, &s)
+}
+
+// labPixels returns the CIELAB color of every pixel of m, row by row,
+// with L in [0, 100].
+func labPixels(m image.Image) [][3]float64 {
+	bounds := m.Bounds()
+	res := make([][3]float64, 0, bounds.Dx()*bounds.Dy())
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			l, a, b, _ := toLab(m.At(x, y))
+			res = append(res, [3]float64{l, a, b})
+		}
+	}
+	return res
+}
+
+func labMeanStd(labs [][3]float64) (mean, std [3]float64) {
+	if len(labs) == 0 {
+		return
+	}
+	n := float64(len(labs))
+	for _, v := range labs {
+		for k := range v {
+			mean[k] += v[k]
+		}
+	}
+	for k := range mean {
+		mean[k] /= n
+	}
+	for _, v := range labs {
+		for k := range v {
+			std[k] += sq(v[k] - mean[k])
+		}
+	}
+	for k := range std {
+		std[k] = math.Sqrt(std[k] / n)
+	}
+	return
+}
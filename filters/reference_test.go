@@ -0,0 +1,113 @@
+package filters
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"testing"
+)
+
+// stripes returns an image of vertical black and white stripes.
+func stripes(w, h, width int) *image.NRGBA {
+	m := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			v := uint8(0)
+			if x/width%2 == 1 {
+				v = 255
+			}
+			m.SetNRGBA(x, y, color.NRGBA{v, v, v, 255})
+		}
+	}
+	return m
+}
+
+func TestAnalyzeReference(t *testing.T) {
+	s := AnalyzeReference(stripes(60, 60, 6))
+	if len(s.Palette) != 2 {
+		t.Errorf("Expected black and white, given %v", s.Palette)
+	}
+	if s.Coherence < 0.9 {
+		t.Errorf("Expected parallel strokes, given a coherence of %v", s.Coherence)
+	}
+	// The gradient of vertical stripes is horizontal.
+	if math.Abs(math.Sin(s.Direction)) > 0.1 {
+		t.Errorf("Expected a horizontal gradient, given %v", s.Direction)
+	}
+	if s.Lightness[100] != 1 || s.Lightness[50] < 0.4 || s.Lightness[50] > 0.6 {
+		t.Errorf("Expected half of the pixels dark, given %v", s.Lightness)
+	}
+
+	sty := s.Style()
+	if sty.Direction != s.Direction || sty.DirectionWeight != s.Coherence {
+		t.Errorf("Expected the direction of the reference, given %v %v", sty.Direction, sty.DirectionWeight)
+	}
+	flat := (&ReferenceStats{}).Style()
+	if flat.DirectionWeight != 0 || flat.MaximumStroke >= sty.MaximumStroke {
+		t.Errorf("Expected shorter strokes in any direction without aligned strokes, given %v and %v",
+			flat.MaximumStroke, sty.MaximumStroke)
+	}
+}
+
+func TestTransferColor(t *testing.T) {
+	s := &ReferenceStats{}
+	for i := range s.Lightness {
+		s.Lightness[i] = 1
+	}
+	m := image.NewNRGBA(image.Rect(0, 0, 4, 4))
+	for i := 0; i < len(m.Pix); i += 4 {
+		m.Pix[i], m.Pix[i+1], m.Pix[i+2], m.Pix[i+3] = 100, 100, 100, 128
+	}
+	res := TransferColor(m, s).(*image.NRGBA)
+	// Every lightness goes to 0, the lowest of the reference, and
+	// grays stay gray.
+	if c := res.NRGBAAt(1, 1); c.R > 1 || c.G > 1 || c.B > 1 || c.A != 128 {
+		t.Errorf("Expected black with the same alpha, given %v", c)
+	}
+}
+
+func TestCreateCurveDirection(t *testing.T) {
+	red := color.NRGBA{255, 0, 0, 255}
+	ref := image.NewNRGBA(image.Rect(0, 0, 20, 20))
+	for i := 0; i < len(ref.Pix); i += 4 {
+		ref.Pix[i], ref.Pix[i+3] = red.R, red.A
+	}
+	cnv := image.NewRGBA(ref.Bounds())
+	mag, ori := make([][]float64, 20), make([][]float64, 20)
+	for y := range mag {
+		mag[y], ori[y] = make([]float64, 20), make([]float64, 20)
+		for x := range mag[y] {
+			mag[y][x] = 1
+		}
+	}
+
+	tests := []struct {
+		name   string
+		weight float64
+		end    image.Point
+	}{
+		// Strokes go the way of the gradient of the image
+		{"image", 0, image.Point{2, 10}},
+		// or the way of the style, across its direction.
+		{"style", 1, image.Point{10, 18}},
+	}
+	for _, test := range tests {
+		settings := &PainterlySettings{Style: StyleImpressionist}
+		settings.Style.FC = 1
+		settings.Style.MaximumStroke = 4
+		settings.Style.Direction = math.Pi / 2
+		settings.Style.DirectionWeight = test.weight
+		strokes := createCurve(cnv, ref, mag, ori, 10, 10, 2, settings, nil)
+		if len(strokes) != 5 || strokes[4].Point != test.end {
+			t.Errorf("%v: expected the stroke to end at %v, given %v", test.name, test.end, strokes)
+		}
+	}
+}
+
+func TestFilterReference(t *testing.T) {
+	m := stripes(20, 20, 4)
+	res := FilterReference(quietContext{}, m, &PainterlySettings{Reference: AnalyzeReference(m)})
+	if res.Bounds() != m.Bounds() {
+		t.Errorf("Expected the bounds of the image, given %v", res.Bounds())
+	}
+}
@@ -0,0 +1,65 @@
+package filters
+
+import (
+	"image"
+	"sort"
+)
+
+// A Filter transforms an image that has already been rescaled.
+type Filter func(c Context, m image.Image, settings *PainterlySettings) image.Image
+
+// Registry holds every filter that can be requested by name.
+var Registry = map[string]Filter{
+	"grayscale": withPalette(func(c Context, m image.Image, _ *PainterlySettings) image.Image {
+		return FilterGrayscale(c, m)
+	}),
+	"voronoi": withPalette(func(c Context, m image.Image, settings *PainterlySettings) image.Image {
+		return FilterVoronoi(c, m, settings.Rand())
+	}),
+	"oilpaint": withPalette(func(c Context, m image.Image, _ *PainterlySettings) image.Image {
+		return FilterOilPaint(c, m)
+	}),
+	"impresionist": painterlyFilter(StyleImpressionist),
+	"expresionist": painterlyFilter(StyleExpressionist),
+	"coloristwash": painterlyFilter(StyleColoristWash),
+	"pointillist":  painterlyFilter(StylePointillist),
+	"psychedelic":  painterlyFilter(StylePsychedelic),
+	"reference":    withPalette(FilterReference),
+}
+
+// DefaultFilter is used when a style is unknown.
+const DefaultFilter = "grayscale"
+
+func painterlyFilter(style PainterlyStyle) Filter {
+	return withPalette(func(c Context, m image.Image, settings *PainterlySettings) image.Image {
+		s := PainterlySettings{}
+		if settings != nil {
+			s = *settings
+		}
+		s.Style = style
+		return FilterPainterlyStyles(c, m, &s)
+	})
+}
+
+// withPalette restricts the output of f to the palette of the
+// settings. Filters painting flat cells, like voronoi and oilpaint,
+// get every cell snapped to the nearest color of the palette.
+func withPalette(f Filter) Filter {
+	return func(c Context, m image.Image, settings *PainterlySettings) image.Image {
+		res := f(c, m, settings)
+		if settings != nil && settings.Palette != nil {
+			res = ApplyPalette(res, settings.Palette, settings.Dither)
+		}
+		return res
+	}
+}
+
+// FilterNames returns the registered filter names in alphabetical order.
+func FilterNames() []string {
+	names := make([]string, 0, len(Registry))
+	for k := range Registry {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
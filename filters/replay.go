@@ -0,0 +1,80 @@
+package filters
+
+import "image"
+
+// Delays of the frames of a replay, in hundredths of a second. The
+// finished painting is shown longer before the replay starts again.
+const (
+	ReplayDelay      = 8
+	ReplayFinalDelay = 300
+)
+
+// replay records the canvases of the painterly filters while they
+// paint, after every brush layer and every few strokes.
+type replay struct {
+	// every is the number of strokes between snapshots, 0 only takes
+	// them after the layers.
+	every   int
+	strokes int
+	frames  []image.Image
+}
+
+// stroke counts a stroke painted on the canvas.
+func (r *replay) stroke(canvas *image.RGBA) {
+	if r == nil || r.every <= 0 {
+		return
+	}
+	r.strokes++
+	if r.strokes%r.every == 0 {
+		r.snapshot(canvas)
+	}
+}
+
+// layer marks the end of a brush layer.
+func (r *replay) layer(canvas *image.RGBA) {
+	if r != nil {
+		r.snapshot(canvas)
+	}
+}
+
+// snapshot keeps a copy of the canvas. When there are MaxFrames of them
+// every other one is dropped, and the snapshots are taken half as
+// often, so long paintings still fit.
+func (r *replay) snapshot(canvas *image.RGBA) {
+	r.frames = append(r.frames, cloneRGBA(canvas))
+	if len(r.frames) < MaxFrames {
+		return
+	}
+	kept := r.frames[:0]
+	for i := 1; i < len(r.frames); i += 2 {
+		kept = append(kept, r.frames[i])
+	}
+	r.frames = kept
+	r.every *= 2
+}
+
+// RunReplay runs the pipeline on m and returns how the painting was
+// made: the canvases of its painterly filters after every brush layer
+// and every given number of strokes, 0 for only the layers, and then
+// the result.
+func (p *Pipeline) RunReplay(c Context, m image.Image, settings *PainterlySettings, every int) *Animation {
+	s := PainterlySettings{}
+	if settings != nil {
+		s = *settings
+	}
+	s.replay = &replay{every: every}
+	res := p.Run(c, m, &s)
+
+	a := &Animation{}
+	for _, frame := range s.replay.frames {
+		// The steps after a resize paint at another size, and
+		// can't be frames of the replay.
+		if frame.Bounds() == res.Bounds() {
+			a.Frames = append(a.Frames, frame)
+			a.Delays = append(a.Delays, ReplayDelay)
+		}
+	}
+	a.Frames = append(a.Frames, res)
+	a.Delays = append(a.Delays, ReplayFinalDelay)
+	return a
+}
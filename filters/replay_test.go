@@ -0,0 +1,40 @@
+package filters
+
+import "testing"
+
+func TestRunReplay(t *testing.T) {
+	m := testFrame(5)
+	a := StylePipeline("impresionist").RunReplay(quietContext{}, m, &PainterlySettings{Seed: 1}, 10)
+	n := len(a.Frames)
+	// A frame per brush layer at least, and the result.
+	if n < StyleImpressionist.NumOfBrushes+1 || n > MaxFrames {
+		t.Fatalf("Expected between %d and %d frames, given %d", StyleImpressionist.NumOfBrushes+1, MaxFrames, n)
+	}
+	if a.Delays[n-1] != ReplayFinalDelay || a.Delays[0] != ReplayDelay {
+		t.Errorf("Expected the result to be shown longer, given %v", a.Delays)
+	}
+	if a.Frames[0].Bounds() != m.Bounds() {
+		t.Errorf("Expected frames of the size of the painting, given %v", a.Frames[0].Bounds())
+	}
+
+	layers := StylePipeline("impresionist").RunReplay(quietContext{}, m, &PainterlySettings{Seed: 1}, 0)
+	if len(layers.Frames) != StyleImpressionist.NumOfBrushes+1 {
+		t.Errorf("Expected a frame per layer, given %d", len(layers.Frames))
+	}
+}
+
+func TestReplaySnapshots(t *testing.T) {
+	r := &replay{every: 1}
+	canvas := testFrame(0)
+	for i := 0; i < 3*MaxFrames; i++ {
+		r.stroke(canvas)
+	}
+	if len(r.frames) >= MaxFrames || r.every <= 1 {
+		t.Errorf("Expected long paintings to be taken less often, given %d frames every %d strokes",
+			len(r.frames), r.every)
+	}
+	// Without a replay nothing is recorded.
+	var none *replay
+	none.stroke(canvas)
+	none.layer(canvas)
+}
@@ -0,0 +1,140 @@
+package filters
+
+import (
+	"github.com/disintegration/imaging"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+)
+
+// Thresholds of the detail map: the T of a style is lowered down to
+// (1 - maxDetailDrop) times its value where the map is white, and the
+// finer brush only paints where the map is above fineDetail.
+const (
+	maxDetailDrop = 0.75
+	fineDetail    = 0.5
+)
+
+// SaliencyMap estimates how important every pixel of m is, from 0 for
+// the background to 255 for the subject. It mixes the gradient energy,
+// where the edges and textures are, with how much the color of each
+// pixel stands out from its surroundings.
+func SaliencyMap(m image.Image) *image.Gray {
+	bounds := m.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	res := image.NewGray(image.Rect(0, 0, w, h))
+	if w == 0 || h == 0 {
+		return res
+	}
+	src := ToRGBA(m)
+	mag, _ := GradientData(src)
+	surround := imaging.Blur(src, float64(IntMax(w, h))/8)
+
+	energy := make([]float64, w*h)
+	contrast := make([]float64, w*h)
+	var maxEnergy, maxContrast float64
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			i := y*w + x
+			if y < len(mag) && x < len(mag[y]) {
+				energy[i] = mag[y][x]
+			}
+			contrast[i] = MetricLab.Distance(src.At(x, y), surround.At(x, y))
+			maxEnergy = math.Max(maxEnergy, energy[i])
+			maxContrast = math.Max(maxContrast, contrast[i])
+		}
+	}
+	for i := range energy {
+		v := 0.0
+		if maxEnergy > 0 {
+			v += energy[i] / maxEnergy / 2
+		}
+		if maxContrast > 0 {
+			v += contrast[i] / maxContrast / 2
+		}
+		res.Pix[i] = uint8(v * 255)
+	}
+
+	// Single edges become areas, so the subject is painted as a whole.
+	return normalizeGray(imaging.Blur(res, float64(IntMax(w, h))/50))
+}
+
+// normalizeGray stretches the values of m to the whole 0-255 range.
+func normalizeGray(m image.Image) *image.Gray {
+	bounds := m.Bounds()
+	res := image.NewGray(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	var lo, hi uint8 = 255, 0
+	for y := 0; y < bounds.Dy(); y++ {
+		for x := 0; x < bounds.Dx(); x++ {
+			v := color.GrayModel.Convert(m.At(bounds.Min.X+x, bounds.Min.Y+y)).(color.Gray).Y
+			res.Pix[y*res.Stride+x] = v
+			if v < lo {
+				lo = v
+			}
+			if v > hi {
+				hi = v
+			}
+		}
+	}
+	if hi <= lo {
+		return res
+	}
+	for i, v := range res.Pix {
+		res.Pix[i] = uint8(int(v-lo) * 255 / int(hi-lo))
+	}
+	return res
+}
+
+// detailAt returns the detail map at (x, y) in [0, 1], 0 when the
+// settings have no map.
+func (s *PainterlySettings) detailAt(x, y int) float64 {
+	if s.detail == nil || !(image.Point{x, y}.In(s.detail.Rect)) {
+		return 0
+	}
+	return float64(s.detail.GrayAt(x, y).Y) / 255
+}
+
+// threshold returns the approximation threshold at (x, y): the T of
+// the style, lowered where the detail map is bright. In the fine layer
+// only the important areas are painted.
+func (s *PainterlySettings) threshold(x, y int) float64 {
+	if s.detail == nil {
+		return s.Style.T
+	}
+	d := s.detailAt(x, y)
+	if s.fine && d < fineDetail {
+		return math.Inf(1)
+	}
+	amount := s.Detail
+	if amount == 0 {
+		amount = 1
+	}
+	return s.Style.T * (1 - maxDetailDrop*amount*d)
+}
+
+// gridPoints returns the points of the grid cell at (x, y) where the
+// strokes of a layer start: only (x, y) itself, and also the middle of
+// the cell where the detail map is above fineDetail.
+func (s *PainterlySettings) gridPoints(x, y, step, xs, ys int) []image.Point {
+	points := []image.Point{{x, y}}
+	half := step / 2
+	if s.detail == nil || half == 0 || s.detailAt(x, y) < fineDetail {
+		return points
+	}
+	for _, p := range []image.Point{{x + half, y}, {x, y + half}, {x + half, y + half}} {
+		if p.X < xs && p.Y < ys {
+			points = append(points, p)
+		}
+	}
+	return points
+}
+
+// grayOf returns m stretched over bounds, in grays. Transparent pixels
+// are black.
+func grayOf(m image.Image, bounds image.Rectangle) *image.Gray {
+	resized := imaging.Resize(m, bounds.Dx(), bounds.Dy(), imaging.Linear)
+	res := image.NewGray(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(res, res.Rect, resized, resized.Bounds().Min, draw.Src)
+	return res
+}
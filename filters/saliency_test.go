@@ -0,0 +1,90 @@
+package filters
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"testing"
+)
+
+func TestSaliencyMap(t *testing.T) {
+	// A red square on a flat gray background.
+	m := image.NewRGBA(image.Rect(0, 0, 100, 100))
+	for y := 0; y < 100; y++ {
+		for x := 0; x < 100; x++ {
+			c := color.RGBA{128, 128, 128, 255}
+			if x >= 40 && x < 60 && y >= 40 && y < 60 {
+				c = color.RGBA{220, 30, 30, 255}
+			}
+			m.SetRGBA(x, y, c)
+		}
+	}
+	s := SaliencyMap(m)
+	if s.Bounds() != m.Bounds() {
+		t.Fatalf("Expected the bounds of the image, given %v", s.Bounds())
+	}
+	if subject, corner := s.GrayAt(50, 50).Y, s.GrayAt(2, 2).Y; subject <= corner || subject < 128 {
+		t.Errorf("Expected the square to stand out, given %v and %v", subject, corner)
+	}
+
+	flat := SaliencyMap(image.NewRGBA(image.Rect(0, 0, 10, 10)))
+	if flat.GrayAt(5, 5).Y != 0 {
+		t.Errorf("Expected nothing salient in a flat image")
+	}
+}
+
+func TestDetailThreshold(t *testing.T) {
+	settings := &PainterlySettings{Style: StyleImpressionist}
+	if settings.threshold(5, 5) != StyleImpressionist.T {
+		t.Errorf("Expected the T of the style without a detail map")
+	}
+
+	settings.Detail = 1
+	settings.detail = image.NewGray(image.Rect(0, 0, 10, 10))
+	settings.detail.SetGray(5, 5, color.Gray{255})
+	if v := settings.threshold(5, 5); v != StyleImpressionist.T*(1-maxDetailDrop) {
+		t.Errorf("Expected a lower T on the subject, given %v", v)
+	}
+	if v := settings.threshold(1, 1); v != StyleImpressionist.T {
+		t.Errorf("Expected the T of the style in the background, given %v", v)
+	}
+
+	settings.fine = true
+	if v := settings.threshold(1, 1); !math.IsInf(v, 1) {
+		t.Errorf("Expected the fine brush to skip the background, given %v", v)
+	}
+	if v := settings.threshold(5, 5); math.IsInf(v, 1) {
+		t.Errorf("Expected the fine brush on the subject")
+	}
+}
+
+func TestDetailMap(t *testing.T) {
+	// The user paints the left half white, the map is stretched over
+	// the image.
+	drawn := image.NewNRGBA(image.Rect(0, 0, 10, 10))
+	for y := 0; y < 10; y++ {
+		for x := 0; x < 5; x++ {
+			drawn.Set(x, y, color.White)
+		}
+	}
+	settings := &PainterlySettings{detail: grayOf(drawn, image.Rect(0, 0, 40, 20))}
+	if settings.detail.Bounds() != image.Rect(0, 0, 40, 20) {
+		t.Fatalf("Expected the map stretched, given %v", settings.detail.Bounds())
+	}
+	if settings.detailAt(5, 10) != 1 || settings.detailAt(35, 10) != 0 {
+		t.Errorf("Expected the left half detailed, given %v and %v", settings.detailAt(5, 10), settings.detailAt(35, 10))
+	}
+
+	if points := settings.gridPoints(4, 4, 4, 40, 20); len(points) != 4 {
+		t.Errorf("Expected denser strokes on the left, given %v", points)
+	}
+	if points := settings.gridPoints(32, 4, 4, 40, 20); len(points) != 1 {
+		t.Errorf("Expected the grid of the style on the right, given %v", points)
+	}
+	if points := settings.gridPoints(4, 18, 4, 40, 20); len(points) != 2 {
+		t.Errorf("Expected the points out of the image dropped, given %v", points)
+	}
+	if points := (&PainterlySettings{}).gridPoints(4, 4, 4, 40, 20); len(points) != 1 {
+		t.Errorf("Expected the grid of the style without a map, given %v", points)
+	}
+}
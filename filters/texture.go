@@ -0,0 +1,68 @@
+package filters
+
+import (
+	"image"
+	"image/color"
+	"math"
+)
+
+// A Texture is applied over a finished image, amount goes from 0
+// (no effect) to 1.
+type Texture func(m image.Image, amount float64) image.Image
+
+// Textures holds the textures usable in a pipeline.
+var Textures = map[string]Texture{
+	"canvas":   TextureCanvas,
+	"vignette": TextureVignette,
+}
+
+// TextureCanvas simulates the weave of a painting canvas.
+func TextureCanvas(m image.Image, amount float64) image.Image {
+	amount = Clamp64(0, amount, 1)
+	return shadeImage(m, func(x, y int) float64 {
+		// Threads go in both directions, with some noise so
+		// the weave doesn't look too regular.
+		weave := math.Sin(float64(x)*math.Pi/2) * math.Sin(float64(y)*math.Pi/2)
+		noise := float64(hashNoise(x, y))/255 - 0.5
+		return 1 + amount*(0.15*weave+0.1*noise)
+	})
+}
+
+// TextureVignette darkens the corners of the image.
+func TextureVignette(m image.Image, amount float64) image.Image {
+	amount = Clamp64(0, amount, 1)
+	b := m.Bounds()
+	cx, cy := float64(b.Min.X+b.Max.X)/2, float64(b.Min.Y+b.Max.Y)/2
+	maxd := math.Hypot(float64(b.Dx())/2, float64(b.Dy())/2)
+	return shadeImage(m, func(x, y int) float64 {
+		d := math.Hypot(float64(x)-cx, float64(y)-cy) / maxd
+		return math.Max(0, 1-amount*d*d)
+	})
+}
+
+// shadeImage multiplies every pixel of m by the factor given by shade.
+func shadeImage(m image.Image, shade func(x, y int) float64) image.Image {
+	bounds := m.Bounds()
+	out := image.NewNRGBA(bounds)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := color.NRGBAModel.Convert(m.At(x, y)).(color.NRGBA)
+			f := shade(x, y)
+			out.SetNRGBA(x, y, color.NRGBA{
+				R: uint8(Clamp64(0, float64(c.R)*f, 255)),
+				G: uint8(Clamp64(0, float64(c.G)*f, 255)),
+				B: uint8(Clamp64(0, float64(c.B)*f, 255)),
+				A: c.A,
+			})
+		}
+	}
+	return out
+}
+
+// hashNoise returns a pseudo random value for a pixel, it is stable
+// so the same image always gets the same texture.
+func hashNoise(x, y int) uint8 {
+	h := uint32(x)*374761393 + uint32(y)*668265263
+	h = (h ^ (h >> 13)) * 1274126177
+	return uint8(h >> 24)
+}
@@ -0,0 +1,28 @@
+package filters
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestTextureVignette(t *testing.T) {
+	// Bounds that don't start at (0,0) get the same vignette.
+	for _, r := range []image.Rectangle{image.Rect(0, 0, 40, 20), image.Rect(300, 200, 340, 220)} {
+		m := image.NewNRGBA(r)
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			for x := r.Min.X; x < r.Max.X; x++ {
+				m.SetNRGBA(x, y, color.NRGBA{200, 200, 200, 255})
+			}
+		}
+		res := TextureVignette(m, 0.5).(*image.NRGBA)
+		center := res.NRGBAAt(r.Min.X+20, r.Min.Y+10)
+		corner := res.NRGBAAt(r.Min.X, r.Min.Y)
+		if center.R != 200 {
+			t.Errorf("%v: expected the center untouched, given %v", r, center)
+		}
+		if corner.R < 95 || corner.R > 105 {
+			t.Errorf("%v: expected the corner at half the brightness, given %v", r, corner)
+		}
+	}
+}
@@ -0,0 +1,401 @@
+package gopherpaint
+
+import (
+	"archive/zip"
+	"filters"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Album is a named, ordered collection of images of a user.
+type Album struct {
+	ID      string
+	OwnerID string
+	Name    string
+	// Blobkeys of the images, in the order they are shown.
+	Blobkeys []string
+	// Cover is the image shown for the album, by default the first.
+	Cover string
+	// Style and Params are the default painting of the album, if Style
+	// is empty every image keeps its own.
+	Style        string
+	Params       string
+	CreationTime time.Time
+}
+
+// CoverKey returns the blob key of the cover image.
+func (a *Album) CoverKey() string {
+	if a.Cover != "" {
+		return a.Cover
+	}
+	if len(a.Blobkeys) > 0 {
+		return a.Blobkeys[0]
+	}
+	return ""
+}
+
+func (a *Album) index(blobkey string) int {
+	for i, k := range a.Blobkeys {
+		if k == blobkey {
+			return i
+		}
+	}
+	return -1
+}
+
+// albumImage is an image of an album, as shown in its page.
+type albumImage struct {
+	Image
+	Query template.URL
+}
+
+func Albums_Create(repo AlbumRepository, ownerID, name string) (*Album, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return nil, badRequest(fmt.Errorf("the album needs a name"))
+	}
+	a := &Album{
+		ID:           randomKey(8),
+		OwnerID:      ownerID,
+		Name:         name,
+		CreationTime: time.Now(),
+	}
+	return a, repo.Put(a)
+}
+
+func Albums_OfUser_GET(repo AlbumRepository, ownerID string) ([]Album, error) {
+	return repo.OfUser(ownerID)
+}
+
+func Albums_GetOne(repo AlbumRepository, ownerID, id string) (*Album, error) {
+	return repo.Get(ownerID, id)
+}
+
+// Albums_Update loads an album of the user, changes it with f and
+// saves it.
+func Albums_Update(repo AlbumRepository, ownerID, id string, f func(a *Album) error) error {
+	a, err := repo.Get(ownerID, id)
+	if err != nil {
+		return err
+	}
+	if err := f(a); err != nil {
+		return err
+	}
+	return repo.Put(a)
+}
+
+// Albums_AddImage appends an image of the user to the album, images
+// already in the album are left where they are.
+func Albums_AddImage(st *Storage, ownerID, id, blobkey string) error {
+	if _, err := Images_GetOne(st.Images, ownerID, blobkey); err != nil {
+		return err
+	}
+	return Albums_Update(st.Albums, ownerID, id, func(a *Album) error {
+		if a.index(blobkey) < 0 {
+			a.Blobkeys = append(a.Blobkeys, blobkey)
+		}
+		return nil
+	})
+}
+
+func Albums_RemoveImage(repo AlbumRepository, ownerID, id, blobkey string) error {
+	return Albums_Update(repo, ownerID, id, func(a *Album) error {
+		if i := a.index(blobkey); i >= 0 {
+			a.Blobkeys = append(a.Blobkeys[:i], a.Blobkeys[i+1:]...)
+		}
+		if a.Cover == blobkey {
+			a.Cover = ""
+		}
+		return nil
+	})
+}
+
+// Albums_MoveImage moves an image of the album to position pos,
+// counting from 0.
+func Albums_MoveImage(repo AlbumRepository, ownerID, id, blobkey string, pos int) error {
+	return Albums_Update(repo, ownerID, id, func(a *Album) error {
+		i := a.index(blobkey)
+		if i < 0 {
+			return ErrNotFound
+		}
+		if pos < 0 || pos >= len(a.Blobkeys) {
+			return badRequest(fmt.Errorf("invalid position %d", pos))
+		}
+		keys := append(a.Blobkeys[:i:i], a.Blobkeys[i+1:]...)
+		keys = append(keys[:pos], append([]string{blobkey}, keys[pos:]...)...)
+		a.Blobkeys = keys
+		return nil
+	})
+}
+
+func Albums_SetCover(repo AlbumRepository, ownerID, id, blobkey string) error {
+	return Albums_Update(repo, ownerID, id, func(a *Album) error {
+		if a.index(blobkey) < 0 {
+			return ErrNotFound
+		}
+		a.Cover = blobkey
+		return nil
+	})
+}
+
+// Albums_SetStyle sets the default painting of the album, an empty
+// style lets every image keep its own.
+func Albums_SetStyle(repo AlbumRepository, ownerID, id, style, params string) error {
+	if style != "" && !validStyle(style) {
+		return badRequest(fmt.Errorf("unknown style %q", style))
+	}
+	return Albums_Update(repo, ownerID, id, func(a *Album) error {
+		a.Style = style
+		a.Params = params
+		return nil
+	})
+}
+
+func Albums_Delete(repo AlbumRepository, ownerID, id string) error {
+	if _, err := repo.Get(ownerID, id); err != nil {
+		return err
+	}
+	return repo.Delete(ownerID, id)
+}
+
+// albumImages returns the images of the album, in order, with the
+// query to render each of them. The style given overrides the one of
+// the album, that overrides the one of the images. Images deleted since
+// they were added are skipped.
+func albumImages(st *Storage, a *Album, style, params string) ([]albumImage, error) {
+	if style == "" {
+		style, params = a.Style, a.Params
+	}
+	var res []albumImage
+	for _, k := range a.Blobkeys {
+		m, err := Images_GetOne(st.Images, a.OwnerID, k)
+		if err == ErrNotFound {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		q := m.RenderQuery()
+		if style != "" {
+			q = renderQuery(m.Blobkey, style, params)
+		}
+		res = append(res, albumImage{*m, q})
+	}
+	return res, nil
+}
+
+// handleAlbums lists the albums of the user.
+func handleAlbums(w http.ResponseWriter, r *http.Request) {
+	c := loggerFor(r)
+	u := auth.Current(r)
+	if u == nil {
+		url, err := auth.LoginURL(r, r.URL.String())
+		if err != nil {
+			serveError(c, w, err, r)
+			return
+		}
+		http.Redirect(w, r, url, http.StatusFound)
+		return
+	}
+	albums, err := Albums_OfUser_GET(storageFor(r).Albums, u.ID)
+	if err != nil {
+		serveError(c, w, err, r)
+		return
+	}
+	context := make(map[string]interface{})
+	context["csrf"] = csrfToken(w, r)
+	context["IsLogged"] = true
+	context["UserName"] = u.String()
+	context["LogoutURL"], err = auth.LogoutURL(r, "/")
+	if err != nil {
+		c.Errorf("Error albums logged: %v", err)
+	}
+	context["Albums"] = albums
+	templates["albums"].Execute(w, context)
+}
+
+// handleAlbum shows an album, painted in the style of the query, the
+// one of the album or the ones of its images.
+func handleAlbum(w http.ResponseWriter, r *http.Request) {
+	c := loggerFor(r)
+	st := storageFor(r)
+	u := auth.Current(r)
+	if u == nil {
+		url, err := auth.LoginURL(r, r.URL.String())
+		if err != nil {
+			serveError(c, w, err, r)
+			return
+		}
+		http.Redirect(w, r, url, http.StatusFound)
+		return
+	}
+	r.ParseForm()
+	a, err := Albums_GetOne(st.Albums, u.ID, r.FormValue("id"))
+	if err != nil {
+		if err == ErrNotFound {
+			http.NotFound(w, r)
+			return
+		}
+		serveError(c, w, err, r)
+		return
+	}
+	style := r.FormValue("style")
+	params := requestParams(r.Form).Encode()
+	images, err := albumImages(st, a, style, params)
+	if err != nil {
+		serveError(c, w, err, r)
+		return
+	}
+	others, err := Images_OfUser_GET(st.Images, u.ID)
+	if err != nil {
+		serveError(c, w, err, r)
+		return
+	}
+	var candidates []Image
+	for _, m := range others {
+		if a.index(m.Blobkey) < 0 {
+			candidates = append(candidates, m)
+		}
+	}
+
+	context := make(map[string]interface{})
+	context["csrf"] = csrfToken(w, r)
+	context["IsLogged"] = true
+	context["UserName"] = u.String()
+	context["LogoutURL"], err = auth.LogoutURL(r, "/")
+	if err != nil {
+		c.Errorf("Error albums logged: %v", err)
+	}
+	context["Album"] = a
+	context["AlbumImages"] = images
+	context["Candidates"] = candidates
+	context["Filters"] = filters.FilterNames()
+	context["Pipelines"] = pipelinePresets()
+	context["style"] = style
+	context["here"] = r.URL.String()
+	download := url.Values{"id": {a.ID}, "style": {style}}.Encode()
+	if params != "" {
+		download += "&" + params
+	}
+	context["download"] = template.URL(download)
+	templates["album"].Execute(w, context)
+}
+
+// handleAlbumEdit changes an album as the action of the form says.
+func handleAlbumEdit(w http.ResponseWriter, r *http.Request) {
+	c := loggerFor(r)
+	st := storageFor(r)
+	u := auth.Current(r)
+	if r.Method != "POST" || u == nil {
+		http.Redirect(w, r, "/albums", http.StatusFound)
+		return
+	}
+	if err := checkCSRF(r, r.FormValue("csrf")); err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	r.ParseForm()
+	id := r.FormValue("id")
+	blobkey := r.FormValue("blobKey")
+	dest := "/album?id=" + url.QueryEscape(id)
+	var err error
+	switch r.FormValue("action") {
+	case "create":
+		var a *Album
+		a, err = Albums_Create(st.Albums, u.ID, r.FormValue("name"))
+		if err == nil {
+			dest = "/album?id=" + a.ID
+		}
+	case "rename":
+		name := strings.TrimSpace(r.FormValue("name"))
+		if name == "" {
+			err = badRequest(fmt.Errorf("the album needs a name"))
+			break
+		}
+		err = Albums_Update(st.Albums, u.ID, id, func(a *Album) error {
+			a.Name = name
+			return nil
+		})
+	case "add":
+		err = Albums_AddImage(st, u.ID, id, blobkey)
+	case "remove":
+		err = Albums_RemoveImage(st.Albums, u.ID, id, blobkey)
+	case "move":
+		pos, perr := strconv.Atoi(r.FormValue("pos"))
+		if perr != nil {
+			err = badRequest(perr)
+			break
+		}
+		err = Albums_MoveImage(st.Albums, u.ID, id, blobkey, pos)
+	case "cover":
+		err = Albums_SetCover(st.Albums, u.ID, id, blobkey)
+	case "style":
+		err = Albums_SetStyle(st.Albums, u.ID, id, r.FormValue("style"), requestParams(r.Form).Encode())
+	case "delete":
+		err = Albums_Delete(st.Albums, u.ID, id)
+		dest = "/albums"
+	default:
+		err = badRequest(fmt.Errorf("unknown action %q", r.FormValue("action")))
+	}
+	if err != nil {
+		if status := errorStatus(err); status != http.StatusInternalServerError {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		serveError(c, w, err, r)
+		return
+	}
+	http.Redirect(w, r, dest, http.StatusFound)
+}
+
+// handleAlbumDownload renders every image of an album in the same
+// style, and sends them in a ZIP file.
+func handleAlbumDownload(w http.ResponseWriter, r *http.Request) {
+	c := loggerFor(r)
+	st := storageFor(r)
+	u := auth.Current(r)
+	if u == nil {
+		http.Error(w, "sign in required", http.StatusUnauthorized)
+		return
+	}
+	r.ParseForm()
+	a, err := Albums_GetOne(st.Albums, u.ID, r.FormValue("id"))
+	if err != nil {
+		http.Error(w, http.StatusText(errorStatus(err)), errorStatus(err))
+		return
+	}
+	images, err := albumImages(st, a, r.FormValue("style"), requestParams(r.Form).Encode())
+	if err != nil {
+		serveError(c, w, err, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", "attachment; filename=album.zip")
+	zw := zip.NewWriter(w)
+	for i, m := range images {
+		q, _ := url.ParseQuery(string(m.Query))
+		data, err := renderImage(c, st, &m.Image, q, 800, renderRequester(r))
+		if err != nil {
+			// The headers are gone, the best we can do is to
+			// leave the image out.
+			c.Errorf("album %v: rendering %v: %v", a.ID, m.Blobkey, err)
+			continue
+		}
+		_, ext := renderType(data)
+		f, err := zw.CreateHeader(&zip.FileHeader{
+			Name:   fmt.Sprintf("%03d-%s.%s", i+1, m.Blobkey, ext),
+			Method: zip.Store,
+		})
+		if err != nil {
+			c.Errorf("album %v: %v", a.ID, err)
+			return
+		}
+		f.Write(data)
+	}
+	zw.Close()
+}
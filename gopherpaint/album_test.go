@@ -0,0 +1,94 @@
+//go:build !appengine
+// +build !appengine
+
+package gopherpaint
+
+import (
+	"archive/zip"
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestAlbums(t *testing.T) {
+	mux, st, done := setupAPITest(t)
+	defer done()
+	var err error
+	if templates, err = loadTemplates(filepath.Join("..", "templates")); err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for i := 0; i < 3; i++ {
+		ids = append(ids, apiUpload(t, mux, "a").ID)
+	}
+	edit := func(user string, form url.Values) *httptest.ResponseRecorder {
+		return apiDo(mux, "POST", "/album/edit", user, strings.NewReader(form.Encode()), "application/x-www-form-urlencoded")
+	}
+
+	w := edit("a", url.Values{"action": {"create"}, "name": {"Holidays"}})
+	if w.Code != http.StatusFound || !strings.HasPrefix(w.Header().Get("Location"), "/album?id=") {
+		t.Fatalf("Expected a redirect to the album, given %v %q", w.Code, w.Header().Get("Location"))
+	}
+	id := strings.TrimPrefix(w.Header().Get("Location"), "/album?id=")
+	for _, k := range ids {
+		edit("a", url.Values{"action": {"add"}, "id": {id}, "blobKey": {k}})
+	}
+	edit("a", url.Values{"action": {"add"}, "id": {id}, "blobKey": {ids[0]}})
+	edit("a", url.Values{"action": {"move"}, "id": {id}, "blobKey": {ids[2]}, "pos": {"0"}})
+	edit("a", url.Values{"action": {"cover"}, "id": {id}, "blobKey": {ids[1]}})
+	edit("a", url.Values{"action": {"style"}, "id": {id}, "style": {"grayscale"}})
+
+	a, err := st.Albums.Get("a", id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{ids[2], ids[0], ids[1]}; !reflect.DeepEqual(a.Blobkeys, expected) {
+		t.Errorf("Expected the order %v, given %v", expected, a.Blobkeys)
+	}
+	if a.CoverKey() != ids[1] || a.Style != "grayscale" {
+		t.Errorf("Expected the cover and the style set, given %+v", a)
+	}
+
+	if w = edit("b", url.Values{"action": {"add"}, "id": {id}, "blobKey": {ids[0]}}); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for the album of another user, given %v", w.Code)
+	}
+	other := apiUpload(t, mux, "b").ID
+	if w = edit("a", url.Values{"action": {"add"}, "id": {id}, "blobKey": {other}}); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for the image of another user, given %v", w.Code)
+	}
+	if w = edit("a", url.Values{"action": {"style"}, "id": {id}, "style": {"nope"}}); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an unknown style, given %v", w.Code)
+	}
+
+	w = apiDo(mux, "GET", "/album?id="+id, "a", nil, "")
+	if w.Code != http.StatusOK || strings.Count(w.Body.String(), "style=grayscale") < 3 {
+		t.Errorf("Expected the album painted in grayscale, given %v", w.Code)
+	}
+
+	Images_Delete(st, "a", ids[0])
+	w = apiDo(mux, "GET", "/album/download?id="+id+"&style=voronoi&seed=2", "a", nil, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected the album as a ZIP file, given %v", w.Code)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(zr.File) != 2 || !strings.HasSuffix(zr.File[0].Name, ids[2]+".png") {
+		t.Errorf("Expected the two images left, in order, given %v files", len(zr.File))
+	}
+
+	edit("a", url.Values{"action": {"remove"}, "id": {id}, "blobKey": {ids[1]}})
+	if a, _ = st.Albums.Get("a", id); len(a.Blobkeys) != 2 || a.Cover != "" {
+		t.Errorf("Expected the image and the cover removed, given %+v", a)
+	}
+	edit("a", url.Values{"action": {"delete"}, "id": {id}})
+	if _, err = st.Albums.Get("a", id); err != ErrNotFound {
+		t.Errorf("Expected the album deleted, given %v", err)
+	}
+}
@@ -0,0 +1,484 @@
+package gopherpaint
+
+import (
+	"encoding/json"
+	"filters"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The JSON API lives under apiPrefix:
+//
+//	GET    /api/v1/styles                  filters, pipelines, palettes and metrics
+//	POST   /api/v1/uploads                 URL where to post a new image
+//	GET    /api/v1/images?limit=&page_token=  images of the user, newest first
+//	POST   /api/v1/images                  upload an image, as the "file" field
+//	GET    /api/v1/images/{id}             one image
+//	PATCH  /api/v1/images/{id}             change the style, params and visibility
+//	DELETE /api/v1/images/{id}             delete an image
+//	POST   /api/v1/images/{id}/renders     render an image
+//
+// Clients without a browser session sign in with an API token, as
+// "Authorization: Bearer <token>", that needs the scope of the request.
+// Errors are answered as {"error": {"code": ..., "message": ...}}.
+const apiPrefix = "/api/v1/"
+
+const (
+	defaultPageSize = 20
+	maxPageSize     = 100
+)
+
+// apiError is an error with the HTTP status and the code it is
+// reported with.
+type apiError struct {
+	Status  int    `json:"-"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *apiError) Error() string {
+	return e.Message
+}
+
+// badRequest marks err as caused by the input of the client.
+func badRequest(err error) *apiError {
+	return &apiError{http.StatusBadRequest, "bad_request", err.Error()}
+}
+
+var (
+	errUnauthenticated = &apiError{http.StatusUnauthorized, "unauthenticated", "sign in required"}
+	errMethod          = &apiError{http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed"}
+	errNoEndpoint      = &apiError{http.StatusNotFound, "not_found", "no such endpoint"}
+	errInvalidToken    = &apiError{http.StatusUnauthorized, "invalid_token", "invalid or revoked token"}
+	errForbidden       = &apiError{http.StatusForbidden, "forbidden", "forbidden"}
+)
+
+// methodScopes are the scopes needed by the methods on an image.
+var methodScopes = map[string]string{
+	"GET":    ScopeRead,
+	"PATCH":  ScopeWrite,
+	"PUT":    ScopeWrite,
+	"DELETE": ScopeDelete,
+}
+
+// needScope fails if the user is signed in with a token without scope.
+func needScope(u *User, scope string) error {
+	if !u.Can(scope) {
+		return &apiError{http.StatusForbidden, "insufficient_scope", "the token doesn't allow " + scope}
+	}
+	return nil
+}
+
+// errorStatus returns the HTTP status of err.
+func errorStatus(err error) int {
+	if e, ok := err.(*apiError); ok {
+		return e.Status
+	}
+	if err == ErrNotFound {
+		return http.StatusNotFound
+	}
+	return http.StatusInternalServerError
+}
+
+// apiImage is an Image as seen by API clients.
+type apiImage struct {
+	ID         string            `json:"id"`
+	Style      string            `json:"style"`
+	Params     map[string]string `json:"params,omitempty"`
+	Visibility string            `json:"visibility"`
+	Created    time.Time         `json:"created"`
+	MD5        string            `json:"md5,omitempty"`
+	Size       int64             `json:"size"`
+	RenderURL  string            `json:"render_url"`
+	Status     string            `json:"status"`
+	FailReason string            `json:"fail_reason,omitempty"`
+	// DuplicateOf is set on upload when the user already had an
+	// image with the same content.
+	DuplicateOf string `json:"duplicate_of,omitempty"`
+}
+
+func newAPIImage(m *Image) *apiImage {
+	res := &apiImage{
+		ID:         m.Blobkey,
+		Style:      m.Style,
+		Visibility: m.EffectiveVisibility(),
+		Created:    m.CreationTime,
+		MD5:        m.MD5,
+		Size:       m.Size,
+		RenderURL:  "/render?" + string(m.RenderQuery()),
+		Status:     "ready",
+	}
+	if m.Failed() {
+		res.Status = m.Status
+		res.FailReason = m.FailReason
+	}
+	if q, err := url.ParseQuery(m.Params); err == nil && len(q) > 0 {
+		res.Params = make(map[string]string)
+		for k := range q {
+			res.Params[k] = q.Get(k)
+		}
+	}
+	return res
+}
+
+type apiPipeline struct {
+	ID    string         `json:"id"`
+	Title string         `json:"title"`
+	Steps []filters.Step `json:"steps"`
+}
+
+type apiStyles struct {
+	Filters   []string              `json:"filters"`
+	Pipelines []apiPipeline         `json:"pipelines"`
+	Palettes  []string              `json:"palettes"`
+	Metrics   []filters.ColorMetric `json:"metrics"`
+	Params    []string              `json:"params"`
+}
+
+// apiRenderRequest is the body of a render request. Style, Pipeline
+// and Spec select the pipeline like the parameters of /render do.
+type apiRenderRequest struct {
+	Style    string            `json:"style"`
+	Pipeline string            `json:"pipeline"`
+	Spec     json.RawMessage   `json:"spec"`
+	Params   map[string]string `json:"params"`
+	Size     int               `json:"size"`
+}
+
+type apiRender struct {
+	URL          string `json:"url"`
+	Size         int    `json:"size"`
+	PipelineHash string `json:"pipeline_hash"`
+}
+
+// apiImageUpdate is the body of an image update, the fields left
+// empty are kept.
+type apiImageUpdate struct {
+	Style      string            `json:"style"`
+	Params     map[string]string `json:"params"`
+	Visibility string            `json:"visibility"`
+}
+
+// renderSizes are the sizes an image can be rendered at.
+var renderSizes = map[int]bool{200: true, 800: true}
+
+func handleAPI(w http.ResponseWriter, r *http.Request) {
+	c := loggerFor(r)
+	res, status, err := serveAPI(r)
+	if err != nil {
+		status = errorStatus(err)
+		e, ok := err.(*apiError)
+		if !ok {
+			c.Errorf("api %v %v: %v", r.Method, r.URL.Path, err)
+			e = &apiError{status, "internal", "internal error"}
+			if err == ErrNotFound {
+				e = &apiError{status, "not_found", "not found"}
+			}
+		}
+		res = map[string]*apiError{"error": e}
+	}
+	if res == nil {
+		w.WriteHeader(status)
+		return
+	}
+	if data, ok := res.([]byte); ok {
+		contentType, _ := renderType(data)
+		w.Header().Set("Content-Type", contentType)
+		w.WriteHeader(status)
+		w.Write(data)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Cache-Control", "private, no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(res)
+}
+
+// serveAPI routes an API request. It returns the value to answer with,
+// encoded as JSON unless it is a []byte holding a PNG image or nil for
+// an empty answer.
+func serveAPI(r *http.Request) (interface{}, int, error) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, apiPrefix), "/")
+	parts := strings.Split(path, "/")
+	if parts[0] == "styles" && len(parts) == 1 {
+		if r.Method != "GET" {
+			return nil, 0, errMethod
+		}
+		return styles(), http.StatusOK, nil
+	}
+
+	u := auth.Current(r)
+	if _, ok := bearerToken(r); ok && u == nil {
+		return nil, 0, errInvalidToken
+	} else if u == nil {
+		return nil, 0, errUnauthenticated
+	}
+	st := storageFor(r)
+	switch {
+	case parts[0] == "uploads" && len(parts) == 1:
+		if r.Method != "POST" {
+			return nil, 0, errMethod
+		}
+		if err := needScope(u, ScopeUpload); err != nil {
+			return nil, 0, err
+		}
+		uploadURL, err := st.Blobs.UploadURL(apiPrefix + "images")
+		if err != nil {
+			return nil, 0, err
+		}
+		return map[string]string{"upload_url": uploadURL}, http.StatusOK, nil
+	case parts[0] == "images" && len(parts) == 1:
+		switch r.Method {
+		case "GET":
+			if err := needScope(u, ScopeRead); err != nil {
+				return nil, 0, err
+			}
+			return apiListImages(st, u, r.URL.Query())
+		case "POST":
+			if err := needScope(u, ScopeUpload); err != nil {
+				return nil, 0, err
+			}
+			return apiUploadImage(st, u, r)
+		}
+		return nil, 0, errMethod
+	case parts[0] == "images" && len(parts) == 2:
+		scope, ok := methodScopes[r.Method]
+		if !ok {
+			return nil, 0, errMethod
+		}
+		if err := needScope(u, scope); err != nil {
+			return nil, 0, err
+		}
+		switch r.Method {
+		case "GET":
+			m, err := Images_GetOne(st.Images, u.ID, parts[1])
+			if err != nil {
+				return nil, 0, err
+			}
+			return newAPIImage(m), http.StatusOK, nil
+		case "PATCH", "PUT":
+			return apiUpdateImage(st, u, parts[1], r)
+		case "DELETE":
+			if err := Images_Delete(st, u.ID, parts[1]); err != nil {
+				return nil, 0, err
+			}
+			return nil, http.StatusNoContent, nil
+		}
+		return nil, 0, errMethod
+	case parts[0] == "images" && len(parts) == 3 && parts[2] == "renders":
+		if r.Method != "POST" {
+			return nil, 0, errMethod
+		}
+		if err := needScope(u, ScopeRender); err != nil {
+			return nil, 0, err
+		}
+		return apiRenderImage(loggerFor(r), st, u, parts[1], r)
+	}
+	return nil, 0, errNoEndpoint
+}
+
+func styles() *apiStyles {
+	res := &apiStyles{
+		Filters:  filters.FilterNames(),
+		Palettes: filters.PaletteNames(),
+		Metrics:  filters.Metrics,
+		Params:   renderParams,
+	}
+	for _, id := range filters.PipelineNames() {
+		p := filters.Pipelines[id]
+		res.Pipelines = append(res.Pipelines, apiPipeline{id, p.Title, p.Steps})
+	}
+	return res
+}
+
+func apiListImages(st *Storage, u *User, q url.Values) (interface{}, int, error) {
+	limit := defaultPageSize
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxPageSize {
+			return nil, 0, badRequest(fmt.Errorf("limit must go from 1 to %d", maxPageSize))
+		}
+		limit = n
+	}
+	// The page token is the offset of the page, clients shouldn't
+	// rely on it.
+	offset := 0
+	if v := q.Get("page_token"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return nil, 0, badRequest(fmt.Errorf("invalid page_token %q", v))
+		}
+		offset = n
+	}
+
+	pics, err := Images_OfUser_GET(st.Images, u.ID)
+	if err != nil {
+		return nil, 0, err
+	}
+	page := struct {
+		Images        []*apiImage `json:"images"`
+		NextPageToken string      `json:"next_page_token,omitempty"`
+	}{Images: []*apiImage{}}
+	for i := offset; i < len(pics) && i < offset+limit; i++ {
+		page.Images = append(page.Images, newAPIImage(&pics[i]))
+	}
+	if offset+limit < len(pics) {
+		page.NextPageToken = strconv.Itoa(offset + limit)
+	}
+	return page, http.StatusOK, nil
+}
+
+func apiUploadImage(st *Storage, u *User, r *http.Request) (interface{}, int, error) {
+	blobs, other, err := st.Blobs.ParseUpload(r)
+	if err != nil {
+		return nil, 0, badRequest(fmt.Errorf("upload the image as multipart/form-data to the upload_url of %suploads: %v", apiPrefix, err))
+	}
+	file := blobs["file"]
+	if len(file) == 0 {
+		return nil, 0, badRequest(fmt.Errorf("no file uploaded"))
+	}
+	style := other.Get("style")
+	if style == "" {
+		style = filters.DefaultFilter
+	} else if !validStyle(style) {
+		return nil, 0, badRequest(fmt.Errorf("unknown style %q", style))
+	}
+	reuse := other.Get("duplicate") == "reuse"
+	m, duplicate, err := uploadImage(st, u.ID, file[0], style, reuse)
+	if err != nil {
+		return nil, 0, err
+	}
+	res := newAPIImage(m)
+	if duplicate {
+		return res, http.StatusOK, nil
+	}
+	if d, err := Images_Duplicate(st.Images, u.ID, file[0]); err == nil {
+		res.DuplicateOf = d.Blobkey
+	}
+	return res, http.StatusCreated, nil
+}
+
+func apiUpdateImage(st *Storage, u *User, id string, r *http.Request) (interface{}, int, error) {
+	var req apiImageUpdate
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, 0, badRequest(fmt.Errorf("invalid JSON body: %v", err))
+	}
+	if req.Style == "" && req.Visibility == "" {
+		return nil, 0, badRequest(fmt.Errorf("nothing to update"))
+	}
+	if req.Visibility != "" {
+		if err := needScope(u, ScopeShare); err != nil {
+			return nil, 0, err
+		}
+	}
+	if req.Style != "" {
+		if !validStyle(req.Style) {
+			return nil, 0, badRequest(fmt.Errorf("unknown style %q", req.Style))
+		}
+		q, err := apiParams(req.Params)
+		if err != nil {
+			return nil, 0, err
+		}
+		if err := Images_UpdateStyle(st, u.ID, id, req.Style, requestParams(q).Encode()); err != nil {
+			return nil, 0, err
+		}
+	}
+	if req.Visibility != "" {
+		if err := Images_UpdateVisibility(st.Images, u.ID, id, req.Visibility); err != nil {
+			return nil, 0, err
+		}
+	}
+	m, err := Images_GetOne(st.Images, u.ID, id)
+	if err != nil {
+		return nil, 0, err
+	}
+	return newAPIImage(m), http.StatusOK, nil
+}
+
+// apiRenderImage renders an image of the user, by default with its
+// saved style. It answers with the image itself, a GIF for animations
+// and a PNG otherwise, if the client accepts image/png or image/gif,
+// otherwise with the URL where the render, already cached, can be
+// fetched.
+func apiRenderImage(c Logger, st *Storage, u *User, id string, r *http.Request) (interface{}, int, error) {
+	m, err := Images_GetOne(st.Images, u.ID, id)
+	if err != nil {
+		return nil, 0, err
+	}
+	var req apiRenderRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, 0, badRequest(fmt.Errorf("invalid JSON body: %v", err))
+	}
+	if req.Style == "" && req.Pipeline == "" && len(req.Spec) == 0 {
+		req.Style = m.Style
+	}
+	if req.Size == 0 {
+		req.Size = 200
+	}
+	if !renderSizes[req.Size] {
+		return nil, 0, badRequest(fmt.Errorf("size must be 200 or 800"))
+	}
+	q, err := apiParams(req.Params)
+	if err != nil {
+		return nil, 0, err
+	}
+	if req.Style != "" && !validStyle(req.Style) {
+		return nil, 0, badRequest(fmt.Errorf("unknown style %q", req.Style))
+	}
+	q.Set("blobKey", id)
+	q.Set("style", req.Style)
+	if req.Pipeline != "" {
+		q.Set("pipeline", req.Pipeline)
+	}
+	if len(req.Spec) > 0 {
+		q.Set("spec", string(req.Spec))
+	}
+	q.Set("size", strconv.Itoa(req.Size))
+
+	data, err := renderImage(c, st, m, q, req.Size, renderRequester(r))
+	if err != nil {
+		return nil, 0, err
+	}
+	if accept := r.Header.Get("Accept"); strings.Contains(accept, "image/png") || strings.Contains(accept, "image/gif") {
+		return data, http.StatusOK, nil
+	}
+	pipeline, _ := requestPipeline(q)
+	return &apiRender{
+		URL:          "/render?" + q.Encode(),
+		Size:         req.Size,
+		PipelineHash: pipeline.Hash(),
+	}, http.StatusCreated, nil
+}
+
+// apiParams turns the render parameters of an API request into a
+// query, rejecting unknown parameters.
+func apiParams(params map[string]string) (url.Values, error) {
+	q := url.Values{}
+	for k, v := range params {
+		if !isRenderParam(k) {
+			return nil, badRequest(fmt.Errorf("unknown parameter %q", k))
+		}
+		q.Set(k, v)
+	}
+	return q, nil
+}
+
+func isRenderParam(k string) bool {
+	for _, p := range renderParams {
+		if p == k {
+			return true
+		}
+	}
+	return false
+}
+
+// validStyle tells if style is a filter or a predefined pipeline.
+func validStyle(style string) bool {
+	_, isFilter := filters.Registry[style]
+	_, isPipeline := filters.Pipelines[style]
+	return isFilter || isPipeline
+}
@@ -0,0 +1,355 @@
+//go:build !appengine
+// +build !appengine
+
+package gopherpaint
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// setupAPITest serves the app from a temporary local storage, signed
+// in as the user of the X-User header or with a token.
+func setupAPITest(t *testing.T) (*http.ServeMux, *Storage, func()) {
+	st, done := newTestStorage(t)
+	storageFor = func(r *http.Request) *Storage { return st }
+	loggerFor = func(r *http.Request) Logger { return StdLogger{} }
+	auth = tokenAuth{HeaderAuth{UserHeader: "X-User"}}
+	mux := http.NewServeMux()
+	RegisterHandlers(mux)
+	return mux, st, done
+}
+
+func apiDo(mux *http.ServeMux, method, path, user string, body io.Reader, contentType string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, body)
+	if strings.HasPrefix(user, tokenPrefix) {
+		r.Header.Set("Authorization", "Bearer "+user)
+	} else if user != "" {
+		// Signed in users post from the pages of the app.
+		r.Header.Set("X-User", user)
+		r.AddCookie(&http.Cookie{Name: csrfCookie, Value: "test"})
+		r.Header.Set("X-CSRF-Token", "test")
+	}
+	if contentType != "" {
+		r.Header.Set("Content-Type", contentType)
+	}
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	return w
+}
+
+// testImage is the image uploaded by apiUpload, always the same.
+func testImage() image.Image {
+	m := image.NewNRGBA(image.Rect(0, 0, 16, 16))
+	for i := range m.Pix {
+		m.Pix[i] = uint8(i)
+	}
+	m.Set(3, 3, color.White)
+	return m
+}
+
+// uploadBody returns a multipart upload of testImage with the fields,
+// and its content type.
+func uploadBody(fields map[string]string) (*bytes.Buffer, string) {
+	body := &bytes.Buffer{}
+	mw := multipart.NewWriter(body)
+	fw, _ := mw.CreateFormFile("file", "photo.png")
+	png.Encode(fw, testImage())
+	for k, v := range fields {
+		mw.WriteField(k, v)
+	}
+	mw.Close()
+	return body, mw.FormDataContentType()
+}
+
+func apiUpload(t *testing.T, mux *http.ServeMux, user string) *apiImage {
+	body, contentType := uploadBody(map[string]string{"style": "voronoi"})
+	w := apiDo(mux, "POST", "/api/v1/images", user, body, contentType)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected 201 on upload, given %v: %s", w.Code, w.Body)
+	}
+	img := &apiImage{}
+	if err := json.Unmarshal(w.Body.Bytes(), img); err != nil {
+		t.Fatal(err)
+	}
+	return img
+}
+
+func TestAPIImages(t *testing.T) {
+	mux, _, done := setupAPITest(t)
+	defer done()
+
+	var ids []string
+	for i := 0; i < 3; i++ {
+		ids = append(ids, apiUpload(t, mux, "a").ID)
+	}
+	apiUpload(t, mux, "b")
+
+	var page struct {
+		Images        []apiImage `json:"images"`
+		NextPageToken string     `json:"next_page_token"`
+	}
+	w := apiDo(mux, "GET", "/api/v1/images?limit=2", "a", nil, "")
+	json.Unmarshal(w.Body.Bytes(), &page)
+	if len(page.Images) != 2 || page.NextPageToken == "" {
+		t.Fatalf("Expected a first page of 2 images, given %s", w.Body)
+	}
+	w = apiDo(mux, "GET", "/api/v1/images?limit=2&page_token="+page.NextPageToken, "a", nil, "")
+	page.NextPageToken = ""
+	json.Unmarshal(w.Body.Bytes(), &page)
+	if len(page.Images) != 1 || page.NextPageToken != "" {
+		t.Fatalf("Expected a last page of 1 image, given %s", w.Body)
+	}
+
+	w = apiDo(mux, "PATCH", "/api/v1/images/"+ids[0], "a",
+		strings.NewReader(`{"style": "oilcanvas", "params": {"seed": "4"}}`), "application/json")
+	img := &apiImage{}
+	json.Unmarshal(w.Body.Bytes(), img)
+	if w.Code != http.StatusOK || img.Style != "oilcanvas" || img.Params["seed"] != "4" {
+		t.Errorf("Expected the style updated, given %v %s", w.Code, w.Body)
+	}
+
+	w = apiDo(mux, "POST", "/api/v1/images/"+ids[1]+"/renders", "a",
+		strings.NewReader(`{"size": 200}`), "application/json")
+	if w.Code != http.StatusCreated || !strings.Contains(w.Body.String(), "/render?") {
+		t.Errorf("Expected a render URL, given %v %s", w.Code, w.Body)
+	}
+
+	if w = apiDo(mux, "GET", "/api/v1/images/"+ids[2], "b", nil, ""); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for the image of another user, given %v", w.Code)
+	}
+	if w = apiDo(mux, "DELETE", "/api/v1/images/"+ids[2], "a", nil, ""); w.Code != http.StatusNoContent {
+		t.Errorf("Expected 204 on delete, given %v %s", w.Code, w.Body)
+	}
+	if w = apiDo(mux, "GET", "/api/v1/images/"+ids[2], "a", nil, ""); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 after delete, given %v", w.Code)
+	}
+}
+
+func TestAPIErrors(t *testing.T) {
+	mux, _, done := setupAPITest(t)
+	defer done()
+	id := apiUpload(t, mux, "a").ID
+
+	tests := []struct {
+		method, path, user, body string
+		status                   int
+		code                     string
+	}{
+		{"GET", "/api/v1/images", "", "", http.StatusUnauthorized, "unauthenticated"},
+		{"GET", "/api/v1/images?limit=1000", "a", "", http.StatusBadRequest, "bad_request"},
+		{"GET", "/api/v1/nothing", "a", "", http.StatusNotFound, "not_found"},
+		{"POST", "/api/v1/styles", "a", "", http.StatusMethodNotAllowed, "method_not_allowed"},
+		{"PATCH", "/api/v1/images/" + id, "a", `{"style": "nope"}`, http.StatusBadRequest, "bad_request"},
+		{"PATCH", "/api/v1/images/" + id, "a", `{"style": "voronoi", "params": {"x": "1"}}`, http.StatusBadRequest, "bad_request"},
+		{"POST", "/api/v1/images/" + id + "/renders", "a", `{"size": 123}`, http.StatusBadRequest, "bad_request"},
+		{"POST", "/api/v1/images/" + id + "/renders", "a", `{"spec": {"steps": []}}`, http.StatusBadRequest, "bad_request"},
+		{"POST", "/api/v1/images/" + id + "/renders", "a", `{"spec": {"steps": [{"op": "resize", "params": {"size": 200}}]}}`, http.StatusBadRequest, "bad_request"},
+	}
+	for _, test := range tests {
+		w := apiDo(mux, test.method, test.path, test.user, strings.NewReader(test.body), "application/json")
+		var res struct {
+			Error apiError `json:"error"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &res)
+		if w.Code != test.status || res.Error.Code != test.code || res.Error.Message == "" {
+			t.Errorf("%v %v: expected %v %v, given %v %s", test.method, test.path, test.status, test.code, w.Code, w.Body)
+		}
+	}
+
+	w := apiDo(mux, "GET", "/api/v1/styles", "", nil, "")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"oilcanvas"`) {
+		t.Errorf("Expected the styles, given %v %s", w.Code, w.Body)
+	}
+}
+
+func TestAPITokens(t *testing.T) {
+	mux, st, done := setupAPITest(t)
+	defer done()
+	id := apiUpload(t, mux, "a").ID
+
+	token, reader := NewToken("a", "reader", []string{ScopeRead})
+	st.Tokens.Put(token)
+	revoked, old := NewToken("a", "old", Scopes)
+	st.Tokens.Put(revoked)
+	st.Tokens.Delete(revoked.ID)
+
+	tests := []struct {
+		method, path, user string
+		status             int
+	}{
+		{"GET", "/api/v1/images/" + id, reader, http.StatusOK},
+		{"DELETE", "/api/v1/images/" + id, reader, http.StatusForbidden},
+		{"POST", "/delete?blobKey=" + id, reader, http.StatusForbidden},
+		{"GET", "/account", reader, http.StatusForbidden},
+		{"GET", "/api/v1/images", old, http.StatusUnauthorized},
+		{"GET", "/api/v1/images", reader[:len(reader)-1], http.StatusUnauthorized},
+		{"GET", "/", "gpt_nothing", http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		w := apiDo(mux, test.method, test.path, test.user, nil, "")
+		if w.Code != test.status {
+			t.Errorf("%v %v: expected %v, given %v %s", test.method, test.path, test.status, w.Code, w.Body)
+		}
+	}
+	if m, err := st.Images.Get("a", id); err != nil || m == nil {
+		t.Errorf("Expected the image kept, given %v", err)
+	}
+	if t2, _ := st.Tokens.Get(token.ID); t2.LastUsed.IsZero() {
+		t.Errorf("Expected the last use of the token saved")
+	}
+}
+
+func TestRenderTokenScopes(t *testing.T) {
+	mux, st, done := setupAPITest(t)
+	defer done()
+	id := apiUpload(t, mux, "a").ID
+
+	token, renderer := NewToken("a", "renderer", []string{ScopeRender})
+	st.Tokens.Put(token)
+	token, writer := NewToken("a", "writer", []string{ScopeWrite})
+	st.Tokens.Put(token)
+
+	tests := []struct {
+		method, path, user, body string
+		status                   int
+	}{
+		{"GET", "/render?style=voronoi&blobKey=" + id, renderer, "", http.StatusOK},
+		{"POST", "/share/create", renderer, "blobKey=" + id, http.StatusForbidden},
+		{"POST", "/share/revoke", renderer, "id=x", http.StatusForbidden},
+		{"POST", "/visibility", renderer, "blobKey=" + id + "&visibility=public", http.StatusForbidden},
+		{"POST", "/share/save", renderer, "blobKey=" + id + "&style=grayscale", http.StatusForbidden},
+		{"POST", "/versions/edit", renderer, "blobKey=" + id, http.StatusForbidden},
+		{"POST", "/album/edit", renderer, "action=create&name=x", http.StatusForbidden},
+		{"GET", "/album/download?id=x", renderer, "", http.StatusForbidden},
+		{"PATCH", "/api/v1/images/" + id, renderer, `{"style":"voronoi"}`, http.StatusForbidden},
+		{"PATCH", "/api/v1/images/" + id, writer, `{"visibility":"public"}`, http.StatusForbidden},
+		{"PATCH", "/api/v1/images/" + id, writer, `{"style":"voronoi"}`, http.StatusOK},
+	}
+	for _, test := range tests {
+		contentType := "application/x-www-form-urlencoded"
+		if strings.HasPrefix(test.path, apiPrefix) {
+			contentType = "application/json"
+		}
+		w := apiDo(mux, test.method, test.path, test.user, strings.NewReader(test.body), contentType)
+		if w.Code != test.status {
+			t.Errorf("%v %v: expected %v, given %v %s", test.method, test.path, test.status, w.Code, w.Body)
+		}
+	}
+	if m, _ := st.Images.Get("a", id); m.Visibility == VisibilityPublic {
+		t.Errorf("Expected the visibility unchanged")
+	}
+}
+
+func TestAPIDuplicates(t *testing.T) {
+	mux, st, done := setupAPITest(t)
+	defer done()
+
+	first := apiUpload(t, mux, "a")
+	if first.DuplicateOf != "" {
+		t.Errorf("Expected the first upload not to be a duplicate, given %q", first.DuplicateOf)
+	}
+	second := apiUpload(t, mux, "a")
+	if second.ID == first.ID || second.DuplicateOf != first.ID {
+		t.Errorf("Expected a copy of %v, given %+v", first.ID, second)
+	}
+	if other := apiUpload(t, mux, "b"); other.DuplicateOf != "" {
+		t.Errorf("Expected the images of other users not to count, given %q", other.DuplicateOf)
+	}
+
+	body, contentType := uploadBody(map[string]string{"duplicate": "reuse"})
+	w := apiDo(mux, "POST", "/api/v1/images", "a", body, contentType)
+	reused := &apiImage{}
+	json.Unmarshal(w.Body.Bytes(), reused)
+	if w.Code != http.StatusOK || (reused.ID != first.ID && reused.ID != second.ID) {
+		t.Errorf("Expected the existing image, given %v %+v", w.Code, reused)
+	}
+	if pics, _ := st.Images.OfUser("a"); len(pics) != 2 {
+		t.Errorf("Expected no new image, given %v", len(pics))
+	}
+
+	// The copies share their renders.
+	m1, _ := st.Images.Get("a", first.ID)
+	m2, _ := st.Images.Get("a", second.ID)
+	q := url.Values{"style": {"grayscale"}}
+	renderImage(StdLogger{}, st, m1, q, 200, "a")
+	st.Blobs.Delete(m2.Blobkey)
+	if _, err := renderImage(StdLogger{}, st, m2, q, 200, "a"); err != nil {
+		t.Errorf("Expected the render of the copy from the cache, given %v", err)
+	}
+}
+
+// deletedBlobs records the blobs deleted from a BlobStore.
+type deletedBlobs struct {
+	BlobStore
+	keys []string
+}
+
+func (d *deletedBlobs) Delete(key string) error {
+	d.keys = append(d.keys, key)
+	return d.BlobStore.Delete(key)
+}
+
+func TestUploadDuplicates(t *testing.T) {
+	mux, st, done := setupAPITest(t)
+	defer done()
+	var err error
+	if templates, err = loadTemplates(filepath.Join("..", "templates")); err != nil {
+		t.Fatal(err)
+	}
+	first := apiUpload(t, mux, "a")
+
+	// The form keeps a file the user already has, like the API, and
+	// offers the image they had.
+	upload := func(user string, fields map[string]string) *url.URL {
+		body, contentType := uploadBody(fields)
+		w := apiDo(mux, "POST", "/upload", user, body, contentType)
+		location, _ := url.Parse(w.Header().Get("Location"))
+		if w.Code != http.StatusFound || location == nil {
+			t.Fatalf("Expected a redirect, given %v %s", w.Code, w.Body)
+		}
+		return location
+	}
+	location := upload("a", nil)
+	if location.Path != "/prepare" || location.Query().Get("blobKey") == first.ID ||
+		location.Query().Get("duplicateOf") != first.ID {
+		t.Errorf("Expected a new copy of %v, given %v", first.ID, location)
+	}
+	if pics, _ := st.Images.OfUser("a"); len(pics) != 2 {
+		t.Errorf("Expected the copy kept, given %v images", len(pics))
+	}
+	w := apiDo(mux, "GET", location.String(), "a", nil, "")
+	if !strings.Contains(w.Body.String(), `href="/prepare?blobKey=`+first.ID+`"`) {
+		t.Errorf("Expected the image the user had offered")
+	}
+	w = apiDo(mux, "GET", "/prepare?blobKey="+first.ID+"&duplicateOf=nothing", "a", nil, "")
+	if strings.Contains(w.Body.String(), "new copy") {
+		t.Errorf("Expected only images of the user offered")
+	}
+
+	location = upload("a", map[string]string{"duplicate": "reuse"})
+	if key := location.Query().Get("blobKey"); location.Query().Get("duplicate") != "1" || key == "" {
+		t.Errorf("Expected the image the user had, given %v", location)
+	}
+	if pics, _ := st.Images.OfUser("a"); len(pics) != 2 {
+		t.Errorf("Expected no new image, given %v", len(pics))
+	}
+
+	// Uploads without a user are deleted.
+	blobs := &deletedBlobs{BlobStore: st.Blobs}
+	st.Blobs = blobs
+	if location = upload("", nil); location.String() != "/" || len(blobs.keys) != 1 {
+		t.Errorf("Expected the anonymous upload deleted, given %v and %v deleted", location, blobs.keys)
+	}
+}
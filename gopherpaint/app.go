@@ -1,55 +1,52 @@
 package gopherpaint
 
 import (
-	"appengine"
-	"appengine/blobstore"
-	"appengine/memcache"
-	"appengine/user"
+	"bufio"
 	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
 	"errors"
 	"filters"
 	"html/template"
 	"image"
+	"image/color"
 	_ "image/gif"
 	_ "image/jpeg"
 	"image/png"
+	"io"
+	"math"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 	"time"
 )
 
-var templates = map[string]*template.Template{
-	"prepare": template.Must(template.ParseFiles("templates/prepare.html", "templates/scripts.html",
-		"templates/navbar.html", "templates/footer.html")),
-	"home":  template.Must(template.ParseFiles("templates/home.html", "templates/scripts.html", "templates/navbar.html", "templates/footer.html")),
-	"share": template.Must(template.ParseFiles("templates/share.html", "templates/scripts.html", "templates/navbar.html", "templates/footer.html")),
-}
-
-func init() {
-	http.HandleFunc("/delete", handleDelete)
-	http.HandleFunc("/upload", handleUpload)
-	http.HandleFunc("/prepare", handleSetupPaint)
-	http.HandleFunc("/render", handlePreview)
-	http.HandleFunc("/share", handleShare)
-	http.HandleFunc("/", handler)
-}
-
-func serveError(c appengine.Context, w http.ResponseWriter, err error, r *http.Request) {
+func serveError(c Logger, w http.ResponseWriter, err error, r *http.Request) {
 	c.Errorf("%v", err)
 	http.Redirect(w, r, "/", http.StatusFound)
 }
 
 func handleUpload(w http.ResponseWriter, r *http.Request) {
-	c := appengine.NewContext(r)
-	blobs, _, err := blobstore.ParseUpload(r)
+	c := loggerFor(r)
+	st := storageFor(r)
+	blobs, other, err := st.Blobs.ParseUpload(r)
 	if err != nil {
 		serveError(c, w, err, r)
 		return
 	}
 
 	// if not logged in then fail
-	u := user.Current(c)
+	u := auth.Current(r)
 	if u == nil {
+		deleteUploads(st, blobs)
 		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+	if err := checkCSRF(r, other.Get("csrf")); err != nil {
+		deleteUploads(st, blobs)
+		http.Error(w, err.Error(), errorStatus(err))
+		return
 	}
 
 	file := blobs["file"]
@@ -57,24 +54,178 @@ func handleUpload(w http.ResponseWriter, r *http.Request) {
 		serveError(c, w, errors.New("no files uploaded"), r)
 		return
 	}
-	ImagesPOST(c, u, file[0], "grayscale")
-	http.Redirect(w, r, "/prepare?blobKey="+string(file[0].BlobKey), http.StatusFound)
+	// Like in the API, files the user already has are kept as new
+	// images unless they ask to reuse the old one, that is offered.
+	m, duplicate, err := uploadImage(st, u.ID, file[0], "grayscale", other.Get("duplicate") == "reuse")
+	if err != nil {
+		if e, ok := err.(*apiError); ok {
+			// The home page explains the errors by their code.
+			http.Redirect(w, r, "/?error="+e.Code, http.StatusFound)
+			return
+		}
+		serveError(c, w, err, r)
+		return
+	}
+	dest := "/prepare?blobKey=" + m.Blobkey
+	if duplicate {
+		dest += "&duplicate=1"
+	} else if d, err := Images_Duplicate(st.Images, u.ID, file[0]); err == nil {
+		dest += "&duplicateOf=" + url.QueryEscape(d.Blobkey)
+	}
+	http.Redirect(w, r, dest, http.StatusFound)
+}
+
+// uploadImage saves an uploaded blob as a new image of the user. If
+// reuse is set and the user already has an image with the same content,
+// the blob is deleted and that image is returned instead. Blobs over
+// the quota of the user, or that aren't images, are deleted too. Images
+// that can't be read are saved as failed.
+func uploadImage(st *Storage, ownerID string, blob *BlobInfo, style string, reuse bool) (*Image, bool, error) {
+	if reuse {
+		m, err := Images_Duplicate(st.Images, ownerID, blob)
+		if err == nil {
+			return m, true, st.Blobs.Delete(blob.Key)
+		} else if err != ErrNotFound {
+			return nil, false, err
+		}
+	}
+	if err := checkUploadQuota(st, ownerID, blob.Size); err != nil {
+		st.Blobs.Delete(blob.Key)
+		return nil, false, err
+	}
+	reason, err := validateBlob(st, blob.Key)
+	if err != nil {
+		st.Blobs.Delete(blob.Key)
+		return nil, false, err
+	}
+	if err := ImagesPOST(st.Images, ownerID, blob, style); err != nil {
+		return nil, false, err
+	}
+	if reason != "" {
+		if err := Images_MarkFailed(st.Images, ownerID, blob.Key, reason); err != nil {
+			return nil, false, err
+		}
+	}
+	m, err := Images_GetOne(st.Images, ownerID, blob.Key)
+	return m, false, err
+}
+
+// handleReference receives the painting a photo should imitate, and
+// shows the photo painted in its style.
+func handleReference(w http.ResponseWriter, r *http.Request) {
+	c := loggerFor(r)
+	st := storageFor(r)
+	blobs, other, err := st.Blobs.ParseUpload(r)
+	if err != nil {
+		serveError(c, w, err, r)
+		return
+	}
+	u := auth.Current(r)
+	if u == nil {
+		deleteUploads(st, blobs)
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+	if err := checkCSRF(r, other.Get("csrf")); err != nil {
+		deleteUploads(st, blobs)
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	file := blobs["file"]
+	if len(file) == 0 {
+		serveError(c, w, errors.New("no reference uploaded"), r)
+		return
+	}
+	if _, err := Assets_Upload(st, u.ID, file[0], AssetReference); err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	q := url.Values{
+		"blobKey":   {other.Get("blobKey")},
+		"style":     {"reference"},
+		"reference": {file[0].Key},
+	}
+	http.Redirect(w, r, "/share?"+q.Encode(), http.StatusFound)
+}
+
+// deleteUploads deletes the blobs of an upload nobody can keep.
+func deleteUploads(st *Storage, blobs map[string][]*BlobInfo) {
+	for _, infos := range blobs {
+		for _, b := range infos {
+			st.Blobs.Delete(b.Key)
+		}
+	}
+}
+
+// handleMask receives a mask for the regions of an image, uploaded or
+// painted in the browser, and goes back to the styles of the image
+// with it. With use=detail the mask is the detail map of the image
+// instead, and the other one is kept. Masks are kept as assets of the
+// user, only the renders of their images can use them.
+func handleMask(w http.ResponseWriter, r *http.Request) {
+	c := loggerFor(r)
+	st := storageFor(r)
+	blobs, other, err := st.Blobs.ParseUpload(r)
+	if err != nil {
+		serveError(c, w, err, r)
+		return
+	}
+	u := auth.Current(r)
+	if u == nil {
+		deleteUploads(st, blobs)
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+	if err := checkCSRF(r, other.Get("csrf")); err != nil {
+		deleteUploads(st, blobs)
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	file := blobs["file"]
+	if len(file) == 0 {
+		serveError(c, w, errors.New("no mask uploaded"), r)
+		return
+	}
+	kind := AssetMask
+	if other.Get("use") == "detail" {
+		kind = AssetDetailMap
+	}
+	if _, err := Assets_Upload(st, u.ID, file[0], kind); err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	q := url.Values{"blobKey": {other.Get("blobKey")}}
+	for _, k := range []string{"mask", "detailmap"} {
+		if v := other.Get(k); v != "" {
+			q.Set(k, v)
+		}
+	}
+	if kind == AssetDetailMap {
+		q.Set("detailmap", file[0].Key)
+	} else {
+		q.Set("mask", file[0].Key)
+	}
+	http.Redirect(w, r, "/prepare?"+q.Encode(), http.StatusFound)
 }
 
 func handleDelete(w http.ResponseWriter, r *http.Request) {
-	c := appengine.NewContext(r)
+	c := loggerFor(r)
 	if r.Method != "POST" {
 		serveError(c, w, errors.New("Ilegal method attemp"), r)
 		return
 	}
 	r.ParseForm()
 	blobkey := r.FormValue("blobKey")
-	usr := user.Current(c)
+	usr := auth.Current(r)
 	if usr == nil {
 		http.Redirect(w, r, "/", http.StatusFound)
 		return
 	}
-	err := Images_Delete(c, usr, blobkey)
+	if err := checkCSRF(r, r.FormValue("csrf")); err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	err := Images_Delete(storageFor(r), usr.ID, blobkey)
 	if err != nil {
 		serveError(c, w, err, r)
 	}
@@ -84,29 +235,48 @@ func handleDelete(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, "/", http.StatusFound)
 }
 
+// handleShare previews the image in a style, to share or download it.
+// The style is only saved with handleStyleSave.
 func handleShare(w http.ResponseWriter, r *http.Request) {
-	c := appengine.NewContext(r)
+	c := loggerFor(r)
 	context := make(map[string]interface{})
+	context["csrf"] = csrfToken(w, r)
 	r.ParseForm()
 	imgkey := r.FormValue("blobKey")
 	context["imgkey"] = imgkey
 	newstyle := r.FormValue("style")
 	context["style"] = newstyle
-	u := user.Current(c)
+	params := requestParams(r.Form).Encode()
+	context["query"] = renderQuery(imgkey, newstyle, params)
+	context["compare"] = template.URL(url.Values{
+		"blobKey": {imgkey},
+		"v":       {(&Version{Style: newstyle, Params: params}).query()},
+	}.Encode())
+	u := auth.Current(r)
 	if u != nil {
-		_, err := Images_UpdateStyle(c, u, imgkey, newstyle)
+		var err error
+		context["params"] = params
+		if m, err := Images_GetOne(storageFor(r).Images, u.ID, imgkey); err == nil {
+			context["visibility"] = m.EffectiveVisibility()
+			context["saved"] = m.Style == newstyle && m.Params == params
+		}
+		context["Visibilities"] = Visibilities
+		context["Shares"], err = Shares_OfImage(storageFor(r).Shares, u.ID, imgkey)
 		if err != nil {
 			c.Errorf("handleShare: %v", err)
 		}
+		context["Lifetimes"] = shareLifetimes
+		context["now"] = time.Now()
+		context["here"] = r.URL.String()
 
 		context["IsLogged"] = true
 		context["UserName"] = u.String()
-		context["LogoutURL"], err = user.LogoutURL(c, "/")
+		context["LogoutURL"], err = auth.LogoutURL(r, "/")
 		if err != nil {
 			c.Errorf("Error share logged:", err)
 		}
 	} else {
-		url, err := user.LoginURL(c, r.URL.String())
+		url, err := auth.LoginURL(r, r.URL.String())
 		if err != nil {
 			c.Errorf("Error SetupPaint no logged:", err)
 		}
@@ -117,15 +287,188 @@ func handleShare(w http.ResponseWriter, r *http.Request) {
 	templates["share"].Execute(w, context)
 }
 
+// handleStyleSave saves the style and params of the form as the ones
+// of the image, a new version if they changed, and goes back to its
+// preview.
+func handleStyleSave(w http.ResponseWriter, r *http.Request) {
+	c := loggerFor(r)
+	u := auth.Current(r)
+	if r.Method != "POST" || u == nil {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+	if err := checkCSRF(r, r.FormValue("csrf")); err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	r.ParseForm()
+	imgkey, style := r.FormValue("blobKey"), r.FormValue("style")
+	params, err := url.ParseQuery(r.FormValue("params"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	p := requestParams(params).Encode()
+	if err := Images_UpdateStyle(storageFor(r), u.ID, imgkey, style, p); err != nil {
+		if status := errorStatus(err); status != http.StatusInternalServerError {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		serveError(c, w, err, r)
+		return
+	}
+	http.Redirect(w, r, "/share?"+string(renderQuery(imgkey, style, p)), http.StatusFound)
+}
+
+// handleVisibility changes who can render an image of the user.
+func handleVisibility(w http.ResponseWriter, r *http.Request) {
+	c := loggerFor(r)
+	u := auth.Current(r)
+	if r.Method != "POST" || u == nil {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+	if err := checkCSRF(r, r.FormValue("csrf")); err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	err := Images_UpdateVisibility(storageFor(r).Images, u.ID, r.FormValue("blobKey"), r.FormValue("visibility"))
+	if err != nil {
+		if status := errorStatus(err); status != http.StatusInternalServerError {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		serveError(c, w, err, r)
+		return
+	}
+	http.Redirect(w, r, localRedirect(r.FormValue("rd")), http.StatusFound)
+}
+
+// handleAccount shows the API tokens of the user.
+func handleAccount(w http.ResponseWriter, r *http.Request) {
+	showAccount(w, r, "")
+}
+
+// showAccount renders the account page, with the secret of a token
+// just created, if any.
+func showAccount(w http.ResponseWriter, r *http.Request, newToken string) {
+	c := loggerFor(r)
+	u := auth.Current(r)
+	if u == nil {
+		url, err := auth.LoginURL(r, r.URL.String())
+		if err != nil {
+			serveError(c, w, err, r)
+			return
+		}
+		http.Redirect(w, r, url, http.StatusFound)
+		return
+	}
+	tokens, err := storageFor(r).Tokens.OfUser(u.ID)
+	if err != nil {
+		serveError(c, w, err, r)
+		return
+	}
+	context := make(map[string]interface{})
+	context["csrf"] = csrfToken(w, r)
+	context["IsLogged"] = true
+	context["UserName"] = u.String()
+	context["LogoutURL"], err = auth.LogoutURL(r, "/")
+	if err != nil {
+		c.Errorf("Error account logged: %v", err)
+	}
+	context["Tokens"] = tokens
+	context["Scopes"] = Scopes
+	context["NewToken"] = newToken
+	w.Header().Set("Cache-Control", "private, no-store")
+	templates["account"].Execute(w, context)
+}
+
+// handleTokenCreate creates an API token with the scopes checked in
+// the form, and shows it once.
+func handleTokenCreate(w http.ResponseWriter, r *http.Request) {
+	c := loggerFor(r)
+	u := auth.Current(r)
+	if r.Method != "POST" || u == nil {
+		http.Redirect(w, r, "/account", http.StatusFound)
+		return
+	}
+	if err := checkCSRF(r, r.FormValue("csrf")); err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	r.ParseForm()
+	name := strings.TrimSpace(r.FormValue("name"))
+	scopes := r.Form["scope"]
+	for _, s := range scopes {
+		if !validScope(s) {
+			http.Error(w, "unknown scope "+s, http.StatusBadRequest)
+			return
+		}
+	}
+	if name == "" || len(scopes) == 0 {
+		http.Error(w, "a token needs a name and at least one scope", http.StatusBadRequest)
+		return
+	}
+	t, secret := NewToken(u.ID, name, scopes)
+	if err := storageFor(r).Tokens.Put(t); err != nil {
+		serveError(c, w, err, r)
+		return
+	}
+	showAccount(w, r, secret)
+}
+
+// handleTokenRevoke deletes an API token of the user.
+func handleTokenRevoke(w http.ResponseWriter, r *http.Request) {
+	c := loggerFor(r)
+	u := auth.Current(r)
+	if r.Method != "POST" || u == nil {
+		http.Redirect(w, r, "/account", http.StatusFound)
+		return
+	}
+	if err := checkCSRF(r, r.FormValue("csrf")); err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	tokens := storageFor(r).Tokens
+	t, err := tokens.Get(r.FormValue("id"))
+	if err == nil && t.OwnerID == u.ID {
+		err = tokens.Delete(t.ID)
+	}
+	if err != nil && err != ErrNotFound {
+		serveError(c, w, err, r)
+		return
+	}
+	http.Redirect(w, r, "/account", http.StatusFound)
+}
+
 func handleSetupPaint(w http.ResponseWriter, r *http.Request) {
-	c := appengine.NewContext(r)
+	c := loggerFor(r)
 	context := make(map[string]interface{})
+	context["csrf"] = csrfToken(w, r)
 	context["imgkey"] = r.FormValue("blobKey")
+	context["duplicate"] = r.FormValue("duplicate") == "1"
+	context["Pipelines"] = pipelinePresets()
+	referenceURL, err := storageFor(r).Blobs.UploadURL("/reference")
+	if err != nil {
+		c.Errorf("Error SetupPaint reference upload: %v", err)
+	} else {
+		context["referenceURL"] = referenceURL
+	}
+	maskURL, err := storageFor(r).Blobs.UploadURL("/mask")
+	if err != nil {
+		c.Errorf("Error SetupPaint mask upload: %v", err)
+	} else {
+		context["maskURL"] = maskURL
+	}
+	context["mask"] = r.FormValue("mask")
+	context["detailmap"] = r.FormValue("detailmap")
+	context["Filters"] = filters.FilterNames()
+	context["Palettes"] = filters.PaletteNames()
+	context["Metrics"] = filters.Metrics
 
-	u := user.Current(c)
-	var err error
+	u := auth.Current(r)
 	if u == nil {
-		url, err := user.LoginURL(c, r.URL.String())
+		url, err := auth.LoginURL(r, r.URL.String())
 		if err != nil {
 			c.Errorf("Error SetupPaint no logged:", err)
 		}
@@ -134,22 +477,29 @@ func handleSetupPaint(w http.ResponseWriter, r *http.Request) {
 	} else {
 		context["IsLogged"] = true
 		context["UserName"] = u.String()
-		context["LogoutURL"], err = user.LogoutURL(c, "/")
+		context["LogoutURL"], err = auth.LogoutURL(r, "/")
 		if err != nil {
 			c.Errorf("Error SetupPaint logged:", err)
 		}
+		if key := r.FormValue("duplicateOf"); key != "" {
+			if d, err := Images_GetOne(storageFor(r).Images, u.ID, key); err == nil {
+				context["duplicateOf"] = d.Blobkey
+			}
+		}
 	}
 
 	templates["prepare"].Execute(w, context)
 }
 
 func handler(w http.ResponseWriter, r *http.Request) {
-	c := appengine.NewContext(r)
+	c := loggerFor(r)
+	st := storageFor(r)
 	context := make(map[string]interface{})
-	u := user.Current(c)
+	context["csrf"] = csrfToken(w, r)
+	u := auth.Current(r)
 	var err error
 	if u == nil {
-		url, err := user.LoginURL(c, r.URL.String())
+		url, err := auth.LoginURL(r, r.URL.String())
 		if err != nil {
 			serveError(c, w, err, r)
 			return
@@ -159,22 +509,29 @@ func handler(w http.ResponseWriter, r *http.Request) {
 	} else {
 		context["IsLogged"] = true
 		context["UserName"] = u.String()
-		context["LogoutURL"], err = user.LogoutURL(c, "/")
+		context["LogoutURL"], err = auth.LogoutURL(r, "/")
 		if err != nil {
 			serveError(c, w, err, r)
 			return
 		}
-		pics, err := Images_OfUser_GET(c, u)
+		pics, err := Images_OfUser_GET(st.Images, u.ID)
 		if err != nil {
 			serveError(c, w, err, r)
 			return
 		}
 		context["Images"] = pics
+		context["Usage"], err = Quotas_Usage(st, u.ID, pics)
+		if err != nil {
+			serveError(c, w, err, r)
+			return
+		}
+		context["IsAdmin"] = u.Admin
 	}
-	uploadURL, err := blobstore.UploadURL(c, "/upload", nil)
-	context["uploadURL"] = uploadURL.Path
+	context["error"] = r.FormValue("error")
+	context["uploadURL"], err = st.Blobs.UploadURL("/upload")
 	if err != nil {
 		serveError(c, w, err, r)
+		return
 	}
 	w.Header().Set("Cache-Control", "private, no-store, max-age=0, no-cache, must-revalidate, post-check=0, pre-check=0")
 	templates["home"].Execute(w, context)
@@ -192,78 +549,408 @@ func handlePreview(w http.ResponseWriter, r *http.Request) {
 }
 
 func handleRender(w http.ResponseWriter, r *http.Request, size int) {
-	c := appengine.NewContext(r)
+	c := loggerFor(r)
+	st := storageFor(r)
 	r.ParseForm()
-	blobkey := (appengine.BlobKey)(r.FormValue("blobKey"))
-	attachment := r.FormValue("attachment")
-	style := r.FormValue("style")
+	m, s, err := renderableImage(st, auth.Current(r), r.FormValue("blobKey"), r.FormValue("share"))
+	if err != nil {
+		http.Error(w, http.StatusText(errorStatus(err)), errorStatus(err))
+		return
+	}
+	q := r.Form
+	if s != nil {
+		// Share holders only get the pinned painting, whatever the
+		// query says.
+		q = s.query()
+	}
+	data, err := renderImage(c, st, m, q, size, renderRequester(r))
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
 
 	// Set the headers
-	w.Header().Set("Content-type", "image/png")
-	w.Header().Set("Cache-control", "public, max-age=259200")
-	if attachment == "1" {
+	contentType, _ := renderType(data)
+	w.Header().Set("Content-type", contentType)
+	if m.EffectiveVisibility() == VisibilityPublic {
+		w.Header().Set("Cache-control", "public, max-age=259200")
+	} else {
+		w.Header().Set("Cache-control", "private, max-age=259200")
+	}
+	if r.FormValue("attachment") == "1" {
 		w.Header().Set("Content-Disposition", "attachment")
 	}
+	w.Write(data)
+}
 
-	// First tries to retrieve it from memcache:
-	item, err := memcache.Get(c, (string)(blobkey)+"_"+style+"_"+string(size))
-	if err == nil {
-		// Yay, we have the picture in cache
-		w.Write(item.Value)
-		return
+// renderableImage returns the image of blobkey if u can render it. The
+// owner always can, anyone with an active share of the image can if it
+// is unlisted, and everyone can if it is public. Private images of
+// other users are reported as not found. The share is returned when
+// access comes from it, and then only its painting can be rendered.
+func renderableImage(st *Storage, u *User, blobkey, shareID string) (*Image, *Share, error) {
+	if u != nil {
+		m, err := Images_GetOne(st.Images, u.ID, blobkey)
+		if err != ErrNotFound {
+			return m, nil, err
+		}
+	}
+	m, err := st.Images.ByBlobkey(blobkey)
+	if err != nil {
+		return nil, nil, err
 	}
+	switch m.EffectiveVisibility() {
+	case VisibilityPublic:
+		return m, nil, nil
+	case VisibilityUnlisted:
+		if shareID == "" {
+			return nil, nil, errForbidden
+		}
+		s, err := activeShare(st, shareID)
+		if err == ErrNotFound || (err == nil && s.Blobkey != blobkey) {
+			return nil, nil, errForbidden
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		return m, s, nil
+	}
+	return nil, nil, ErrNotFound
+}
 
-	rimg := blobstore.NewReader(c, blobkey)
-	img, _, err := image.Decode(rimg)
+// renderImage paints m with the render parameters in q, and returns it
+// PNG encoded, or as a GIF if it is animated. Renders are cached by the content of the image, so the
+// copies of a file uploaded twice share them.
+func renderImage(c Logger, st *Storage, m *Image, q url.Values, size int, requester string) ([]byte, error) {
+	return cachedRender(c, st, m, q, size, "", requester, func(w io.Writer, pipeline *filters.Pipeline, in *renderInput) error {
+		if in.Animation != nil {
+			// The palette of the first frame is used for all of them.
+			anim := pipeline.RunAnimation(c, in.Animation, in.Settings)
+			if len(in.Regions) > 0 {
+				anim = filters.PaintAnimationRegions(c, anim, in.Animation, in.Settings, in.Regions, in.Masks)
+			}
+			return filters.EncodeGIF(w, anim, in.Settings.Palette, in.Settings.Dither)
+		}
+		return png.Encode(w, in.paintRegions(c, pipeline.Run(c, in.Image, in.Settings), in.Image))
+	})
+}
+
+// renderInput is the image to paint, rescaled, with the settings asked
+// for in the query.
+type renderInput struct {
+	Image     image.Image
+	Animation *filters.Animation
+	Settings  *filters.PainterlySettings
+	// Regions painted in other styles, with their masks.
+	Regions []filters.Region
+	Masks   map[string]image.Image
+}
+
+// paintRegions paints the regions of the input over painted, the
+// painting of the frame m.
+func (in *renderInput) paintRegions(c Logger, painted, m image.Image) image.Image {
+	if len(in.Regions) == 0 {
+		return painted
+	}
+	return filters.PaintRegions(c, painted, m, in.Settings, in.Regions, in.Masks)
+}
+
+// cachedRender paints the image with paint, and caches what it writes.
+// Renders of different kinds of outputs of the same image and
+// parameters are told apart by kind, "" for the paintings.
+func cachedRender(c Logger, st *Storage, m *Image, q url.Values, size int, kind, requester string,
+	paint func(w io.Writer, pipeline *filters.Pipeline, in *renderInput) error) ([]byte, error) {
+	if m.Failed() {
+		return nil, imageFailed(m.FailReason)
+	}
+	pipeline, err := requestPipeline(q)
 	if err != nil {
-		return
+		return nil, badRequest(err)
 	}
+	adjustments := requestAdjustments(q)
+	pipeline = pipeline.WithAdjustments(&adjustments)
 
-	img = filters.RescaleImage(img, size)
-	switch style {
-	case "voronoi":
-		img = filters.FilterVoronoi(c, img)
-	case "oilpaint":
-		img = filters.FilterOilPaint(c, img)
-	case "impresionist":
-		img = filters.FilterPainterlyStyles(c, img, &filters.PainterlySettings{
-			Style:   filters.StyleImpressionist,
-			Blobkey: blobkey,
-		})
-	case "expresionist":
-		img = filters.FilterPainterlyStyles(c, img, &filters.PainterlySettings{
-			Style:   filters.StyleExpressionist,
-			Blobkey: blobkey,
-		})
-	case "coloristwash":
-		img = filters.FilterPainterlyStyles(c, img, &filters.PainterlySettings{
-			Style:   filters.StyleColoristWash,
-			Blobkey: blobkey,
-		})
-	case "pointillist":
-		img = filters.FilterPainterlyStyles(c, img, &filters.PainterlySettings{
-			Style:   filters.StylePointillist,
-			Blobkey: blobkey,
-		})
-	case "psychedelic":
-		img = filters.FilterPainterlyStyles(c, img, &filters.PainterlySettings{
-			Style:   filters.StylePsychedelic,
-			Blobkey: blobkey,
-		})
-	default:
-		style = "grayscale"
-		img = filters.FilterGrayscale(c, img)
+	// First tries to retrieve it from the cache:
+	source := m.ContentKey()
+	if kind != "" {
+		source += "_" + kind
+	}
+	cacheKey := renderKey(source, pipeline, requestParams(q), size)
+	if data, err := st.Cache.Get(cacheKey); err == nil {
+		// Yay, we have the picture in cache
+		return data, nil
+	}
+
+	// Only the renders that miss the cache count for the quota of the
+	// requester. They are reserved before painting, and given back if
+	// the painting fails.
+	if err := reserveRender(st, requester); err != nil {
+		return nil, err
 	}
+	data, err := paintRender(c, st, m, q, size, pipeline, paint)
+	if err != nil {
+		if err := refundRender(st, requester); err != nil {
+			c.Errorf("refunding a render of %v: %v", requester, err)
+		}
+		return nil, err
+	}
+	st.Cache.Set(cacheKey, data)
+	return data, nil
+}
 
+// paintRender decodes the input of a render and paints it.
+func paintRender(c Logger, st *Storage, m *Image, q url.Values, size int, pipeline *filters.Pipeline,
+	paint func(w io.Writer, pipeline *filters.Pipeline, in *renderInput) error) ([]byte, error) {
+	in, err := loadRenderInput(c, st, m, q, size)
+	if err != nil {
+		return nil, err
+	}
 	buffer := bytes.NewBuffer([]byte{})
-	png.Encode(buffer, img)
-	w.Write(buffer.Bytes())
+	if err := paint(buffer, pipeline, in); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
 
-	if buffer.Len() < (1000*1000 - 300) {
-		mcItem := &memcache.Item{
-			Key:   (string)(blobkey) + "_" + style + "_" + string(size),
-			Value: buffer.Bytes(),
+// loadRenderInput decodes the image, rescaled to size, and the settings
+// of the query.
+func loadRenderInput(c Logger, st *Storage, m *Image, q url.Values, size int) (*renderInput, error) {
+	rimg, err := st.Blobs.Open(m.Blobkey)
+	if err != nil {
+		return nil, err
+	}
+	img, anim, err := decodeImage(rimg, size)
+	rimg.Close()
+	if err != nil {
+		// It won't get better, so the image is marked and not
+		// decoded again.
+		reason := "the image can't be decoded: " + err.Error()
+		if err := Images_MarkFailed(st.Images, m.OwnerID, m.Blobkey, reason); err != nil {
+			c.Errorf("marking %v as failed: %v", m.Blobkey, err)
 		}
-		memcache.Add(c, mcItem)
+		return nil, imageFailed(reason)
+	}
+
+	img = filters.ToRGBA(filters.RescaleImage(img, size))
+	if anim != nil {
+		for i, frame := range anim.Frames {
+			anim.Frames[i] = filters.ToRGBA(frame)
+		}
+	}
+	settings := &filters.PainterlySettings{
+		Blobkey: m.Blobkey,
+		Dither:  q.Get("dither") == "1",
+	}
+	settings.Seed, _ = strconv.ParseInt(q.Get("seed"), 10, 64)
+	settings.Detail, _ = strconv.ParseFloat(q.Get("detail"), 64)
+	settings.Detail = math.Max(0, math.Min(1, settings.Detail))
+	if key := q.Get("detailmap"); key != "" {
+		settings.DetailMap, err = loadMask(st, m.OwnerID, key, AssetDetailMap)
+	}
+	if err == nil {
+		settings.Reference, err = referenceStats(st, m.OwnerID, q.Get("reference"))
+	}
+	if err == nil {
+		settings.Palette, err = requestPalette(q, img, settings.Reference)
+	}
+	if err == nil {
+		settings.Metric, err = filters.ParseColorMetric(q.Get("metric"))
+	}
+	in := &renderInput{Image: img, Animation: anim, Settings: settings}
+	if err == nil && q.Get("regions") != "" {
+		in.Regions, err = filters.ParseRegions([]byte(q.Get("regions")))
+		if err == nil {
+			in.Masks, err = regionMasks(st, m.OwnerID, in.Regions)
+		}
+	}
+	if err == ErrNotFound {
+		return nil, err
+	} else if err != nil {
+		return nil, badRequest(err)
+	}
+	return in, nil
+}
+
+// regionMasks loads the mask images of the regions, by blob key, from
+// the masks of the owner.
+func regionMasks(st *Storage, ownerID string, regions []filters.Region) (map[string]image.Image, error) {
+	masks := make(map[string]image.Image)
+	for _, r := range regions {
+		if r.Shape != filters.ShapeMask || masks[r.Mask] != nil {
+			continue
+		}
+		m, err := loadMask(st, ownerID, r.Mask, AssetMask)
+		if err != nil {
+			return nil, err
+		}
+		masks[r.Mask] = m
+	}
+	return masks, nil
+}
+
+// loadMask decodes the mask, or detail map, uploaded as key by the
+// owner. Keys of other blobs are ErrNotFound.
+func loadMask(st *Storage, ownerID, key, kind string) (image.Image, error) {
+	rc, err := Assets_Open(st, ownerID, key, kind)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	m, _, err := image.Decode(rc)
+	if err != nil {
+		return nil, errors.New("unreadable mask image")
+	}
+	return m, nil
+}
+
+// decodeImage decodes an uploaded image. Animated GIFs are decoded
+// with all their frames in anim, already rescaled to size, and img is
+// their first frame.
+func decodeImage(r io.Reader, size int) (img image.Image, anim *filters.Animation, err error) {
+	br := bufio.NewReader(r)
+	if header, _ := br.Peek(4); string(header) != "GIF8" {
+		img, _, err = image.Decode(br)
+		return img, nil, err
+	}
+	anim, err = filters.DecodeGIF(br, size)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(anim.Frames) == 1 {
+		return anim.Frames[0], nil, nil
+	}
+	return anim.Frames[0], anim, nil
+}
+
+// renderType returns the content type and file extension of a render:
+// animations are GIFs and everything else PNG.
+func renderType(data []byte) (contentType, ext string) {
+	if bytes.HasPrefix(data, []byte("GIF8")) {
+		return "image/gif", "gif"
+	}
+	return "image/png", "png"
+}
+
+// requestPipeline returns the pipeline asked for in the query. It
+// can be given as an inline JSON spec, as the ID of a predefined
+// pipeline or as a style, that is either a filter or a pipeline ID.
+func requestPipeline(q url.Values) (*filters.Pipeline, error) {
+	if spec := q.Get("spec"); spec != "" {
+		return filters.ParsePipeline([]byte(spec))
+	}
+	if id := q.Get("pipeline"); id != "" {
+		p, ok := filters.Pipelines[id]
+		if !ok {
+			return nil, errors.New("unknown pipeline " + id)
+		}
+		return p, nil
+	}
+	return filters.StylePipeline(q.Get("style")), nil
+}
+
+// renderParams are the query parameters that, besides the style,
+// change how an image is rendered. They are saved with the Image.
+var renderParams = []string{"exposure", "contrast", "saturation", "temperature", "tint", "autolevels",
+	"palette", "colors", "dither", "metric", "reference", "seed", "regions", "detail", "detailmap"}
+
+// renderKey identifies a render of the content key source in the cache.
+func renderKey(source string, pipeline *filters.Pipeline, params url.Values, size int) string {
+	h := sha1.New()
+	h.Write(pipeline.Canonical())
+	io.WriteString(h, params.Encode())
+	return source + "_" + hex.EncodeToString(h.Sum(nil)) + "_" + strconv.Itoa(size)
+}
+
+// requestParams returns the render parameters present in the query.
+func requestParams(q url.Values) url.Values {
+	res := url.Values{}
+	for _, k := range renderParams {
+		if v := q.Get(k); v != "" && v != "0" {
+			res.Set(k, v)
+		}
+	}
+	return res
+}
+
+// requestAdjustments reads the photo adjustments of the query,
+// invalid values are ignored.
+func requestAdjustments(q url.Values) filters.Adjustments {
+	num := func(k string) float64 {
+		v, _ := strconv.ParseFloat(q.Get(k), 64)
+		return v
+	}
+	a := filters.Adjustments{
+		Exposure:    num("exposure"),
+		Contrast:    num("contrast"),
+		Saturation:  num("saturation"),
+		Temperature: num("temperature"),
+		Tint:        num("tint"),
+		AutoLevels:  q.Get("autolevels") == "1",
+	}
+	a.Clamp()
+	return a
+}
+
+// requestPalette returns the palette the strokes are restricted to.
+// It can be "auto", extracted from the image with the given number of
+// colors, "reference", the colors of the reference painting, the name
+// of a built-in palette or a list of hex colors.
+func requestPalette(q url.Values, img image.Image, ref *filters.ReferenceStats) (color.Palette, error) {
+	name := q.Get("palette")
+	switch {
+	case name == "":
+		return nil, nil
+	case name == "reference" && ref != nil:
+		return ref.ColorPalette(), nil
+	case name == "auto":
+		colors, err := strconv.Atoi(q.Get("colors"))
+		if err != nil || colors < 2 {
+			colors = 8
+		}
+		return filters.ExtractPalette(img, colors), nil
+	}
+	if p, ok := filters.Palettes[name]; ok {
+		return p, nil
+	}
+	return filters.ParsePalette(name)
+}
+
+// referenceStats returns the statistics of the reference painting
+// stored in the given blob, if any. The reference has to be an asset
+// of the owner of the painted image.
+func referenceStats(st *Storage, ownerID, blobkey string) (*filters.ReferenceStats, error) {
+	if blobkey == "" {
+		return nil, nil
+	}
+	rimg, err := Assets_Open(st, ownerID, blobkey, AssetReference)
+	if err != nil {
+		return nil, err
+	}
+	defer rimg.Close()
+	cacheKey := "refstats2_" + blobkey
+	stats := &filters.ReferenceStats{}
+	if err := cacheGetGob(st.Cache, cacheKey, stats); err == nil {
+		return stats, nil
+	}
+	img, _, err := image.Decode(rimg)
+	if err != nil {
+		return nil, errors.New("unreadable reference image")
+	}
+	stats = filters.AnalyzeReference(img)
+	cacheSetGob(st.Cache, cacheKey, stats)
+	return stats, nil
+}
+
+type pipelinePreset struct {
+	ID    string
+	Title string
+}
+
+// pipelinePresets lists the predefined pipelines for the templates.
+func pipelinePresets() []pipelinePreset {
+	var res []pipelinePreset
+	for _, id := range filters.PipelineNames() {
+		res = append(res, pipelinePreset{id, filters.Pipelines[id].Title})
 	}
+	return res
 }
@@ -0,0 +1,48 @@
+//go:build appengine
+// +build appengine
+
+package gopherpaint
+
+import (
+	"appengine"
+	"appengine/user"
+	"net/http"
+)
+
+func init() {
+	err := Setup(Config{
+		TemplateDir: "templates",
+		Storage:     appengineStorage,
+		Logger: func(r *http.Request) Logger {
+			return appengine.NewContext(r)
+		},
+		Auth: appengineAuth{},
+		Tiers: []Tier{
+			{Name: "free", MaxImages: 200, MaxBytes: 500 << 20, MaxRendersPerDay: 1000},
+			{Name: "unlimited"},
+		},
+	})
+	if err != nil {
+		panic(err)
+	}
+	RegisterHandlers(http.DefaultServeMux)
+}
+
+// appengineAuth signs in with the App Engine users service.
+type appengineAuth struct{}
+
+func (appengineAuth) Current(r *http.Request) *User {
+	u := user.Current(appengine.NewContext(r))
+	if u == nil {
+		return nil
+	}
+	return &User{ID: u.ID, Email: u.Email, Name: u.String(), Admin: u.Admin}
+}
+
+func (appengineAuth) LoginURL(r *http.Request, dest string) (string, error) {
+	return user.LoginURL(appengine.NewContext(r), dest)
+}
+
+func (appengineAuth) LogoutURL(r *http.Request, dest string) (string, error) {
+	return user.LogoutURL(appengine.NewContext(r), dest)
+}
@@ -0,0 +1,90 @@
+package gopherpaint
+
+import (
+	"errors"
+	"io"
+	"time"
+)
+
+// Kinds of assets.
+const (
+	AssetReference = "reference"
+	AssetMask      = "mask"
+	AssetDetailMap = "detailmap"
+)
+
+// An Asset is an image uploaded to paint the images of a user, not to
+// be painted: a reference painting, the mask of a region or a detail
+// map. Only the renders of the images of its owner can use it.
+type Asset struct {
+	OwnerID      string
+	Blobkey      string
+	Kind         string
+	Size         int64
+	CreationTime time.Time
+}
+
+// maxAssets is how many assets a user keeps, the oldest ones are
+// deleted when there are more.
+const maxAssets = 50
+
+// Assets_Upload saves an uploaded blob as an asset of the user. Blobs
+// over the quota of the user, or that aren't images, are deleted.
+func Assets_Upload(st *Storage, ownerID string, blob *BlobInfo, kind string) (*Asset, error) {
+	err := checkAssetQuota(st, ownerID, blob.Size)
+	if err == nil {
+		var reason string
+		reason, err = validateBlob(st, blob.Key)
+		if err == nil && reason != "" {
+			err = badRequest(errors.New(reason))
+		}
+	}
+	if err != nil {
+		st.Blobs.Delete(blob.Key)
+		return nil, err
+	}
+	a := &Asset{
+		OwnerID:      ownerID,
+		Blobkey:      blob.Key,
+		Kind:         kind,
+		Size:         blob.Size,
+		CreationTime: time.Now(),
+	}
+	if err := st.Assets.Put(a); err != nil {
+		return nil, err
+	}
+	assets, err := st.Assets.OfUser(ownerID)
+	if err != nil {
+		return nil, err
+	}
+	for i := maxAssets; i < len(assets); i++ {
+		if err := Assets_Delete(st, ownerID, assets[i].Blobkey); err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+// Assets_Open opens the asset of the user of the given kind. Blobs that
+// aren't, whoever they belong to, are ErrNotFound.
+func Assets_Open(st *Storage, ownerID, blobkey, kind string) (io.ReadCloser, error) {
+	a, err := st.Assets.Get(ownerID, blobkey)
+	if err != nil {
+		return nil, err
+	}
+	if a.Kind != kind {
+		return nil, ErrNotFound
+	}
+	return st.Blobs.Open(blobkey)
+}
+
+// Assets_Delete deletes the asset of the user, with its blob.
+func Assets_Delete(st *Storage, ownerID, blobkey string) error {
+	if _, err := st.Assets.Get(ownerID, blobkey); err != nil {
+		return err
+	}
+	if err := st.Assets.Delete(ownerID, blobkey); err != nil {
+		return err
+	}
+	return st.Blobs.Delete(blobkey)
+}
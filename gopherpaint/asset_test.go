@@ -0,0 +1,72 @@
+//go:build !appengine
+// +build !appengine
+
+package gopherpaint
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestReferenceUpload(t *testing.T) {
+	mux, st, done := setupAPITest(t)
+	defer done()
+	m := apiUpload(t, mux, "a")
+
+	body, contentType := uploadBody(map[string]string{"blobKey": m.ID})
+	if w := apiDo(mux, "POST", "/reference", "", body, contentType); w.Code != http.StatusFound || w.Header().Get("Location") != "/" {
+		t.Errorf("Expected anonymous references refused, given %v %v", w.Code, w.Header())
+	}
+
+	text := &bytes.Buffer{}
+	mw := multipart.NewWriter(text)
+	fw, _ := mw.CreateFormFile("file", "notes.txt")
+	fw.Write([]byte("not a painting"))
+	mw.Close()
+	if w := apiDo(mux, "POST", "/reference", "a", text, mw.FormDataContentType()); w.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("Expected a reference that isn't an image refused, given %v", w.Code)
+	}
+	if assets, _ := st.Assets.OfUser("a"); len(assets) != 0 {
+		t.Errorf("Expected no references kept, given %v", assets)
+	}
+
+	before, _ := Quotas_Usage(st, "a", nil)
+	body, contentType = uploadBody(map[string]string{"blobKey": m.ID})
+	w := apiDo(mux, "POST", "/reference", "a", body, contentType)
+	loc, _ := url.Parse(w.Header().Get("Location"))
+	key := loc.Query().Get("reference")
+	if w.Code != http.StatusFound || loc.Path != "/share" || key == "" {
+		t.Fatalf("Expected a redirection to the preview, given %v %v", w.Code, loc)
+	}
+	assets, _ := st.Assets.OfUser("a")
+	if len(assets) != 1 || assets[0].Blobkey != key || assets[0].Kind != AssetReference {
+		t.Errorf("Expected the reference kept, given %v", assets)
+	}
+	if after, _ := Quotas_Usage(st, "a", nil); after.Bytes != before.Bytes+assets[0].Size {
+		t.Errorf("Expected the reference counted in the quota, given %v and %v", before.Bytes, after.Bytes)
+	}
+
+	render := "/render?blobKey=" + m.ID + "&style=reference&reference=" + key
+	if w := apiDo(mux, "GET", render, "a", nil, ""); w.Code != http.StatusOK {
+		t.Errorf("Expected the reference used, given %v: %s", w.Code, w.Body)
+	}
+	b := apiUpload(t, mux, "b")
+	render = "/render?blobKey=" + b.ID + "&style=reference&reference=" + key
+	if w := apiDo(mux, "GET", render, "b", nil, ""); w.Code != http.StatusNotFound {
+		t.Errorf("Expected the reference of another user not found, given %v", w.Code)
+	}
+	render = "/render?blobKey=" + b.ID + "&style=reference&reference=" + b.ID
+	if w := apiDo(mux, "GET", render, "b", nil, ""); w.Code != http.StatusNotFound {
+		t.Errorf("Expected an image that isn't a reference not found, given %v", w.Code)
+	}
+
+	if err := Assets_Delete(st, "a", key); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.Blobs.Open(key); err != ErrNotFound {
+		t.Errorf("Expected the blob deleted with the reference, given %v", err)
+	}
+}
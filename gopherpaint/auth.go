@@ -0,0 +1,99 @@
+package gopherpaint
+
+import (
+	"net/http"
+	"net/url"
+)
+
+// User is the person signed in.
+type User struct {
+	ID    string
+	Email string
+	Name  string
+	Admin bool
+	// Token is set when the user is signed in with an API token.
+	Token *Token
+}
+
+// Can tells if the user is allowed the requests of scope. Browser
+// sessions are allowed everything, tokens only their scopes.
+func (u *User) Can(scope string) bool {
+	return u.Token == nil || u.Token.HasScope(scope)
+}
+
+func (u *User) String() string {
+	if u.Name != "" {
+		return u.Name
+	}
+	return u.Email
+}
+
+// An Authenticator tells who is making a request.
+type Authenticator interface {
+	// Current returns the signed in user, or nil.
+	Current(r *http.Request) *User
+	// LoginURL returns where to sign in, coming back to dest.
+	LoginURL(r *http.Request, dest string) (string, error)
+	// LogoutURL returns where to sign out, going then to dest.
+	LogoutURL(r *http.Request, dest string) (string, error)
+}
+
+// A HandlerAuthenticator serves pages of its own, like a login form
+// or the callback of an identity provider. They are added by
+// RegisterHandlers.
+type HandlerAuthenticator interface {
+	Authenticator
+	RegisterHandlers(mux *http.ServeMux)
+}
+
+// SingleUserAuth signs everyone in as the same user. It is meant for
+// private installations, like a personal computer.
+type SingleUserAuth struct {
+	User User
+}
+
+func (a SingleUserAuth) Current(r *http.Request) *User {
+	u := a.User
+	return &u
+}
+
+func (a SingleUserAuth) LoginURL(r *http.Request, dest string) (string, error) {
+	return dest, nil
+}
+
+func (a SingleUserAuth) LogoutURL(r *http.Request, dest string) (string, error) {
+	return dest, nil
+}
+
+// HeaderAuth trusts the user given in the headers of the request by
+// an authenticating reverse proxy. The proxy must remove those headers
+// from the requests of its clients.
+type HeaderAuth struct {
+	// Header with the user ID, like X-Forwarded-User.
+	UserHeader string
+	// Header with the e-mail, optional.
+	EmailHeader string
+	// Where the proxy signs in and out, they get a "rd" parameter
+	// with the destination.
+	Login, Logout string
+}
+
+func (a HeaderAuth) Current(r *http.Request) *User {
+	id := r.Header.Get(a.UserHeader)
+	if id == "" {
+		return nil
+	}
+	u := &User{ID: id, Name: id}
+	if a.EmailHeader != "" {
+		u.Email = r.Header.Get(a.EmailHeader)
+	}
+	return u
+}
+
+func (a HeaderAuth) LoginURL(r *http.Request, dest string) (string, error) {
+	return a.Login + "?" + url.Values{"rd": {dest}}.Encode(), nil
+}
+
+func (a HeaderAuth) LogoutURL(r *http.Request, dest string) (string, error) {
+	return a.Logout + "?" + url.Values{"rd": {dest}}.Encode(), nil
+}
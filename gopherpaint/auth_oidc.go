@@ -0,0 +1,293 @@
+package gopherpaint
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// OIDCAuth signs in with an OpenID Connect provider, using the
+// authorization code flow. The user is kept in a session cookie
+// afterwards.
+type OIDCAuth struct {
+	ClientID     string
+	ClientSecret string
+	// RedirectURL is the absolute URL of /auth/callback, it must be
+	// registered in the provider.
+	RedirectURL string
+	// Admins are the verified e-mails of the administrators.
+	Admins   []string
+	Sessions *Sessions
+	Client   *http.Client
+
+	provider oidcProvider
+}
+
+// oidcProvider is the part of the discovery document of a provider
+// that the app uses.
+type oidcProvider struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	UserinfoEndpoint      string `json:"userinfo_endpoint"`
+	EndSessionEndpoint    string `json:"end_session_endpoint"`
+}
+
+// oidcStateCookie holds the state of a login in progress.
+const oidcStateCookie = "gopherpaint_oidc"
+
+// NewOIDCAuth discovers the endpoints of the provider at issuer.
+func NewOIDCAuth(issuer, clientID, clientSecret, redirectURL string, sessions *Sessions) (*OIDCAuth, error) {
+	a := &OIDCAuth{
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		RedirectURL:  redirectURL,
+		Sessions:     sessions,
+		Client:       &http.Client{Timeout: 30 * time.Second},
+	}
+	resp, err := a.Client.Get(strings.TrimSuffix(issuer, "/") + "/.well-known/openid-configuration")
+	if err != nil {
+		return nil, fmt.Errorf("oidc discovery: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("oidc discovery: %v", resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&a.provider); err != nil {
+		return nil, fmt.Errorf("oidc discovery: %v", err)
+	}
+	if a.provider.AuthorizationEndpoint == "" || a.provider.TokenEndpoint == "" || a.provider.UserinfoEndpoint == "" {
+		return nil, errors.New("oidc discovery: the provider lacks some endpoints")
+	}
+	if strings.TrimSuffix(a.provider.Issuer, "/") != strings.TrimSuffix(issuer, "/") {
+		return nil, fmt.Errorf("oidc discovery: the provider is %q, not %q", a.provider.Issuer, issuer)
+	}
+	return a, nil
+}
+
+func (a *OIDCAuth) Current(r *http.Request) *User {
+	u := a.Sessions.Get(r)
+	if u != nil {
+		u.Admin = a.isAdmin(u.Email)
+	}
+	return u
+}
+
+// isAdmin tells if email is one of the Admins.
+func (a *OIDCAuth) isAdmin(email string) bool {
+	for _, admin := range a.Admins {
+		if email != "" && strings.EqualFold(admin, email) {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *OIDCAuth) LoginURL(r *http.Request, dest string) (string, error) {
+	return "/auth/login?" + url.Values{"rd": {dest}}.Encode(), nil
+}
+
+func (a *OIDCAuth) LogoutURL(r *http.Request, dest string) (string, error) {
+	return "/auth/logout?" + url.Values{"rd": {dest}}.Encode(), nil
+}
+
+// RegisterHandlers adds the login, callback and logout handlers.
+func (a *OIDCAuth) RegisterHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("/auth/login", a.handleLogin)
+	mux.HandleFunc("/auth/callback", a.handleCallback)
+	mux.HandleFunc("/auth/logout", a.handleLogout)
+}
+
+// handleLogin sends the user to the provider, remembering the state
+// and the nonce of the login, and where to go back, in a cookie.
+func (a *OIDCAuth) handleLogin(w http.ResponseWriter, r *http.Request) {
+	state, nonce := randomKey(16), randomKey(16)
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    a.Sessions.sign([]byte(state + " " + nonce + " " + localRedirect(r.FormValue("rd")))),
+		Path:     "/auth/",
+		MaxAge:   600,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+	})
+	q := url.Values{
+		"response_type": {"code"},
+		"client_id":     {a.ClientID},
+		"redirect_uri":  {a.RedirectURL},
+		"scope":         {"openid email profile"},
+		"state":         {state},
+		"nonce":         {nonce},
+	}
+	http.Redirect(w, r, a.provider.AuthorizationEndpoint+"?"+q.Encode(), http.StatusFound)
+}
+
+func (a *OIDCAuth) handleCallback(w http.ResponseWriter, r *http.Request) {
+	c := loggerFor(r)
+	cookie, err := r.Cookie(oidcStateCookie)
+	if err != nil {
+		http.Error(w, "login expired, please try again", http.StatusBadRequest)
+		return
+	}
+	payload, ok := a.Sessions.verify(cookie.Value)
+	parts := strings.SplitN(string(payload), " ", 3)
+	if !ok || len(parts) != 3 || parts[0] != r.FormValue("state") {
+		http.Error(w, "invalid login state", http.StatusBadRequest)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: oidcStateCookie, Path: "/auth/", MaxAge: -1})
+	if e := r.FormValue("error"); e != "" {
+		http.Error(w, "login failed: "+e, http.StatusForbidden)
+		return
+	}
+
+	u, err := a.exchange(r.FormValue("code"), parts[1])
+	if err != nil {
+		c.Errorf("oidc: %v", err)
+		http.Error(w, "login failed", http.StatusBadGateway)
+		return
+	}
+	if err := a.Sessions.Set(w, r, u); err != nil {
+		serveError(c, w, err, r)
+		return
+	}
+	http.Redirect(w, r, parts[2], http.StatusFound)
+}
+
+func (a *OIDCAuth) handleLogout(w http.ResponseWriter, r *http.Request) {
+	a.Sessions.Clear(w)
+	http.Redirect(w, r, localRedirect(r.FormValue("rd")), http.StatusFound)
+}
+
+// exchange trades the authorization code for an access and an ID
+// token, checks that the ID token is the one of the login of nonce,
+// and asks the provider who the user is.
+func (a *OIDCAuth) exchange(code, nonce string) (*User, error) {
+	form := url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {code},
+		"redirect_uri": {a.RedirectURL},
+	}
+	req, err := http.NewRequest("POST", a.provider.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(a.ClientID), url.QueryEscape(a.ClientSecret))
+	var token struct {
+		AccessToken string `json:"access_token"`
+		IDToken     string `json:"id_token"`
+	}
+	if err := a.getJSON(req, &token); err != nil {
+		return nil, fmt.Errorf("token: %v", err)
+	}
+	claims, err := a.verifyIDToken(token.IDToken, nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err = http.NewRequest("GET", a.provider.UserinfoEndpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token.AccessToken)
+	var info struct {
+		Sub           string `json:"sub"`
+		Email         string `json:"email"`
+		EmailVerified bool   `json:"email_verified"`
+		Name          string `json:"name"`
+	}
+	if err := a.getJSON(req, &info); err != nil {
+		return nil, fmt.Errorf("userinfo: %v", err)
+	}
+	if info.Sub != claims.Subject {
+		return nil, fmt.Errorf("userinfo: subject %q, the id_token is of %q", info.Sub, claims.Subject)
+	}
+	// Only e-mails the provider says are verified are kept,
+	// administrators are found by them.
+	u := &User{ID: info.Sub, Name: info.Name}
+	if info.EmailVerified {
+		u.Email = info.Email
+	}
+	return u, nil
+}
+
+// idTokenClaims are the claims of an ID token that are checked.
+type idTokenClaims struct {
+	Issuer   string       `json:"iss"`
+	Subject  string       `json:"sub"`
+	Audience oidcAudience `json:"aud"`
+	Expires  int64        `json:"exp"`
+	Nonce    string       `json:"nonce"`
+}
+
+// oidcAudience is the aud claim, one client ID or a list of them.
+type oidcAudience []string
+
+func (aud *oidcAudience) UnmarshalJSON(data []byte) error {
+	var one string
+	if err := json.Unmarshal(data, &one); err == nil {
+		*aud = oidcAudience{one}
+		return nil
+	}
+	return json.Unmarshal(data, (*[]string)(aud))
+}
+
+func (aud oidcAudience) has(clientID string) bool {
+	for _, v := range aud {
+		if v == clientID {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyIDToken checks that the ID token was issued by the provider,
+// for this app and the login of nonce, and hasn't expired. It comes
+// straight from the token endpoint, so its signature isn't checked,
+// as the specification allows.
+func (a *OIDCAuth) verifyIDToken(raw, nonce string) (*idTokenClaims, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("id_token: missing or malformed")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return nil, fmt.Errorf("id_token: %v", err)
+	}
+	claims := &idTokenClaims{}
+	if err := json.Unmarshal(payload, claims); err != nil {
+		return nil, fmt.Errorf("id_token: %v", err)
+	}
+	switch {
+	case claims.Issuer != a.provider.Issuer:
+		return nil, fmt.Errorf("id_token: issued by %q", claims.Issuer)
+	case !claims.Audience.has(a.ClientID):
+		return nil, fmt.Errorf("id_token: issued for %q", claims.Audience)
+	case time.Now().Unix() >= claims.Expires:
+		return nil, errors.New("id_token: expired")
+	case subtle.ConstantTimeCompare([]byte(claims.Nonce), []byte(nonce)) != 1:
+		return nil, errors.New("id_token: of another login")
+	case claims.Subject == "":
+		return nil, errors.New("id_token: no subject")
+	}
+	return claims, nil
+}
+
+func (a *OIDCAuth) getJSON(req *http.Request, v interface{}) error {
+	req.Header.Set("Accept", "application/json")
+	resp, err := a.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.New(resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
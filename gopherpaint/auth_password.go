@@ -0,0 +1,169 @@
+package gopherpaint
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/bcrypt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+)
+
+// PasswordAuth signs in with the users and passwords of a file. Every
+// line of the file is a user name and its bcrypt hash, separated by a
+// colon, like the files made by htpasswd -B.
+type PasswordAuth struct {
+	File string
+	// Admins are the names of the administrators.
+	Admins   []string
+	Sessions *Sessions
+}
+
+// Current returns the user of the session if it is still in the file,
+// so users removed from it are signed out.
+func (a *PasswordAuth) Current(r *http.Request) *User {
+	u := a.Sessions.Get(r)
+	if u == nil {
+		return nil
+	}
+	users, err := readPasswords(a.File)
+	if err != nil {
+		loggerFor(r).Errorf("password file: %v", err)
+		return nil
+	}
+	if _, ok := users[u.ID]; !ok {
+		return nil
+	}
+	u.Admin = a.isAdmin(u.ID)
+	return u
+}
+
+// isAdmin tells if the user of name is one of the Admins.
+func (a *PasswordAuth) isAdmin(name string) bool {
+	for _, admin := range a.Admins {
+		if admin == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *PasswordAuth) LoginURL(r *http.Request, dest string) (string, error) {
+	return "/auth/login?" + url.Values{"rd": {dest}}.Encode(), nil
+}
+
+func (a *PasswordAuth) LogoutURL(r *http.Request, dest string) (string, error) {
+	return "/auth/logout?" + url.Values{"rd": {dest}}.Encode(), nil
+}
+
+// RegisterHandlers adds the login form and the logout handler.
+func (a *PasswordAuth) RegisterHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("/auth/login", a.handleLogin)
+	mux.HandleFunc("/auth/logout", func(w http.ResponseWriter, r *http.Request) {
+		a.Sessions.Clear(w)
+		http.Redirect(w, r, localRedirect(r.FormValue("rd")), http.StatusFound)
+	})
+}
+
+func (a *PasswordAuth) handleLogin(w http.ResponseWriter, r *http.Request) {
+	c := loggerFor(r)
+	dest := localRedirect(r.FormValue("rd"))
+	context := map[string]interface{}{
+		"IsLogged": false,
+		"LoginURL": r.URL.String(),
+		"rd":       dest,
+	}
+	if r.Method == "POST" {
+		name := r.FormValue("name")
+		ok, err := a.Check(name, r.FormValue("password"))
+		if err != nil {
+			c.Errorf("password login: %v", err)
+		}
+		if ok {
+			u := &User{ID: name, Name: name}
+			if err := a.Sessions.Set(w, r, u); err != nil {
+				serveError(c, w, err, r)
+				return
+			}
+			http.Redirect(w, r, dest, http.StatusFound)
+			return
+		}
+		w.WriteHeader(http.StatusUnauthorized)
+		context["failed"] = true
+	}
+	templates["login"].Execute(w, context)
+}
+
+// Check tells if password is the one of the user.
+func (a *PasswordAuth) Check(name, password string) (bool, error) {
+	users, err := readPasswords(a.File)
+	if err != nil {
+		return false, err
+	}
+	hash, ok := users[name]
+	if !ok {
+		// Spend the same time as with a real user.
+		dummyHashOnce.Do(func() {
+			dummyHash, _ = bcrypt.GenerateFromPassword([]byte("dummy"), bcrypt.DefaultCost)
+		})
+		hash = string(dummyHash)
+	}
+	err = bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+	return ok && err == nil, nil
+}
+
+var (
+	dummyHash     []byte
+	dummyHashOnce sync.Once
+)
+
+// readPasswords returns the hashes in a password file by user.
+func readPasswords(file string) (map[string]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	users := make(map[string]string)
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.Index(line, ":")
+		if i < 0 {
+			return nil, fmt.Errorf("%s: invalid line %q", file, line)
+		}
+		users[line[:i]] = line[i+1:]
+	}
+	return users, s.Err()
+}
+
+// SetPassword adds a user to a password file, or changes its
+// password. The file is created if it doesn't exist.
+func SetPassword(file, name, password string) error {
+	if name == "" || strings.ContainsAny(name, ":\n") {
+		return errors.New("invalid user name")
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	var lines []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if line != "" && !strings.HasPrefix(line, name+":") {
+			lines = append(lines, line)
+		}
+	}
+	lines = append(lines, name+":"+string(hash))
+	return ioutil.WriteFile(file, []byte(strings.Join(lines, "\n")+"\n"), 0600)
+}
@@ -0,0 +1,293 @@
+package gopherpaint
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSessions(t *testing.T) {
+	s := &Sessions{Key: []byte("key")}
+	w := httptest.NewRecorder()
+	s.Set(w, httptest.NewRequest("GET", "/", nil), &User{ID: "alice", Email: "a@example.com"})
+	cookie := w.Result().Cookies()[0]
+	if cookie.SameSite != http.SameSiteLaxMode || !cookie.HttpOnly {
+		t.Errorf("Expected a lax, HTTP only, cookie, given %+v", cookie)
+	}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(cookie)
+	if u := s.Get(r); u == nil || u.ID != "alice" || u.Email != "a@example.com" {
+		t.Errorf("Expected alice, given %v", u)
+	}
+
+	other := &Sessions{Key: []byte("other key")}
+	if u := other.Get(r); u != nil {
+		t.Errorf("Expected no user with another key, given %v", u)
+	}
+	payload, _ := json.Marshal(sessionData{User: User{ID: "mallory"}, Expires: time.Now().Add(time.Hour).Unix()})
+	sig := cookie.Value[strings.Index(cookie.Value, "."):]
+	r = httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(&http.Cookie{Name: cookie.Name, Value: base64.RawURLEncoding.EncodeToString(payload) + sig})
+	if u := s.Get(r); u != nil {
+		t.Errorf("Expected no user with a tampered cookie, given %v", u)
+	}
+
+	// Sessions signed when the user was an administrator don't keep it.
+	payload, _ = json.Marshal(sessionData{User: User{ID: "alice", Admin: true}, Expires: time.Now().Add(time.Hour).Unix()})
+	r = httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(&http.Cookie{Name: cookie.Name, Value: s.sign(payload)})
+	if u := s.Get(r); u == nil || u.Admin {
+		t.Errorf("Expected alice without admin, given %+v", u)
+	}
+
+	expired := &Sessions{Key: []byte("key"), MaxAge: -time.Hour}
+	w = httptest.NewRecorder()
+	expired.Set(w, httptest.NewRequest("GET", "/", nil), &User{ID: "alice"})
+	r = httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(w.Result().Cookies()[0])
+	if u := s.Get(r); u != nil {
+		t.Errorf("Expected no user with an expired session, given %v", u)
+	}
+}
+
+func TestLocalRedirect(t *testing.T) {
+	tests := map[string]string{
+		"/prepare?blobKey=a":     "/prepare?blobKey=a",
+		"http://evil.example":    "/",
+		"//evil.example/path":    "/",
+		"/\\evil.example":        "/",
+		"":                       "/",
+		"javascript:alert(1)":    "/",
+		"/account#tokens":        "/account#tokens",
+		"https://evil.example/a": "/",
+	}
+	for dest, expected := range tests {
+		if given := localRedirect(dest); given != expected {
+			t.Errorf("%q: expected %q, given %q", dest, expected, given)
+		}
+	}
+}
+
+func TestPasswordAuth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gopherpaint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "passwords")
+	SetPassword(file, "alice", "old")
+	SetPassword(file, "bob", "bobpass")
+	SetPassword(file, "alice", "secret")
+
+	a := &PasswordAuth{File: file}
+	tests := []struct {
+		name, password string
+		ok             bool
+	}{
+		{"alice", "secret", true},
+		{"alice", "old", false},
+		{"bob", "bobpass", true},
+		{"carol", "secret", false},
+		{"alice", "", false},
+	}
+	for _, test := range tests {
+		if ok, err := a.Check(test.name, test.password); ok != test.ok || err != nil {
+			t.Errorf("%v/%v: expected %v, given %v (%v)", test.name, test.password, test.ok, ok, err)
+		}
+	}
+	a.Sessions = &Sessions{Key: []byte("key")}
+	a.Admins = []string{"alice"}
+	w := httptest.NewRecorder()
+	a.Sessions.Set(w, httptest.NewRequest("GET", "/", nil), &User{ID: "alice", Name: "alice"})
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(w.Result().Cookies()[0])
+	if u := a.Current(r); u == nil || !u.Admin {
+		t.Errorf("Expected alice as admin, given %+v", u)
+	}
+	a.Admins = []string{"bob"}
+	if u := a.Current(r); u == nil || u.Admin {
+		t.Errorf("Expected alice no longer admin, given %+v", u)
+	}
+	// Users removed from the file are signed out, even with their
+	// session.
+	ioutil.WriteFile(file, []byte("bob:x\n"), 0600)
+	if u := a.Current(r); u != nil {
+		t.Errorf("Expected alice signed out, given %+v", u)
+	}
+
+	if err := SetPassword(file, "eve:admin", "x"); err == nil {
+		t.Errorf("Expected an error for a name with a colon")
+	}
+}
+
+// fakeProvider is an OpenID Connect provider that signs everyone in
+// as the same user, with an ID token of the claims and the userinfo.
+func fakeProvider(t *testing.T, claims, userinfo map[string]interface{}) *httptest.Server {
+	mux := http.NewServeMux()
+	var srv *httptest.Server
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 srv.URL,
+			"authorization_endpoint": srv.URL + "/authorize",
+			"token_endpoint":         srv.URL + "/token",
+			"userinfo_endpoint":      srv.URL + "/userinfo",
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		id, secret, _ := r.BasicAuth()
+		if id != "paint" || secret != "s3cret" || r.FormValue("code") != "thecode" {
+			http.Error(w, "invalid_grant", http.StatusBadRequest)
+			return
+		}
+		payload, _ := json.Marshal(claims)
+		idToken := "eyJhbGciOiJSUzI1NiJ9." + base64.RawURLEncoding.EncodeToString(payload) + ".sig"
+		json.NewEncoder(w).Encode(map[string]string{"access_token": "at", "token_type": "Bearer", "id_token": idToken})
+	})
+	mux.HandleFunc("/userinfo", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer at" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode(userinfo)
+	})
+	srv = httptest.NewServer(mux)
+	return srv
+}
+
+func TestOIDCAuth(t *testing.T) {
+	claims := map[string]interface{}{}
+	userinfo := map[string]interface{}{
+		"sub": "1234", "email": "alice@example.com", "email_verified": true, "name": "Alice",
+	}
+	provider := fakeProvider(t, claims, userinfo)
+	defer provider.Close()
+	loggerFor = func(r *http.Request) Logger { return StdLogger{} }
+
+	a, err := NewOIDCAuth(provider.URL, "paint", "s3cret", "http://app/auth/callback", &Sessions{Key: []byte("key")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Admins = []string{"ALICE@example.com"}
+	mux := http.NewServeMux()
+	a.RegisterHandlers(mux)
+
+	loginURL, _ := a.LoginURL(nil, "/prepare?blobKey=x")
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", loginURL, nil))
+	authorize, err := url.Parse(w.Header().Get("Location"))
+	if err != nil || !strings.HasPrefix(authorize.String(), provider.URL+"/authorize") {
+		t.Fatalf("Expected a redirect to the provider, given %q", authorize)
+	}
+	state := authorize.Query().Get("state")
+	stateCookie := w.Result().Cookies()[0]
+	valid := map[string]interface{}{
+		"iss":   provider.URL,
+		"sub":   "1234",
+		"aud":   []string{"other", "paint"},
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"nonce": authorize.Query().Get("nonce"),
+	}
+	if valid["nonce"] == "" {
+		t.Errorf("Expected a nonce in the login")
+	}
+	callback := func(code string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/auth/callback?code="+code+"&state="+state, nil)
+		r.AddCookie(stateCookie)
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		return w
+	}
+
+	// ID tokens of other providers, apps or logins are rejected.
+	tests := []struct {
+		claim string
+		value interface{}
+	}{
+		{"iss", "https://evil.example"},
+		{"aud", "other"},
+		{"exp", time.Now().Add(-time.Minute).Unix()},
+		{"nonce", "replayed"},
+		{"sub", "5678"},
+		{"nonce", nil},
+	}
+	for _, test := range tests {
+		for k, v := range valid {
+			claims[k] = v
+		}
+		if test.value == nil {
+			delete(claims, test.claim)
+		} else {
+			claims[test.claim] = test.value
+		}
+		if w := callback("thecode"); w.Code != http.StatusBadGateway {
+			t.Errorf("%v %v: expected 502, given %v", test.claim, test.value, w.Code)
+		}
+	}
+	for k, v := range valid {
+		claims[k] = v
+	}
+
+	// A callback without the cookie of the login is rejected.
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/auth/callback?code=thecode&state="+state, nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 without the state cookie, given %v", w.Code)
+	}
+
+	w = callback("thecode")
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "/prepare?blobKey=x" {
+		t.Fatalf("Expected a redirect back to the app, given %v %q %s", w.Code, w.Header().Get("Location"), w.Body)
+	}
+	var session *http.Cookie
+	for _, c := range w.Result().Cookies() {
+		if c.Name == "gopherpaint_session" {
+			session = c
+		}
+	}
+	if session == nil {
+		t.Fatal("Expected a session cookie")
+	}
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(session)
+	if u := a.Current(r); u == nil || u.ID != "1234" || u.Name != "Alice" || !u.Admin {
+		t.Errorf("Expected Alice as admin, given %+v", u)
+	}
+	// Administrators stop being so when they are removed, even with
+	// their session.
+	a.Admins = nil
+	if u := a.Current(r); u == nil || u.Admin {
+		t.Errorf("Expected Alice no longer admin, given %+v", u)
+	}
+
+	// E-mails not known to be verified don't make administrators.
+	a.Admins = []string{"alice@example.com"}
+	for _, verified := range []interface{}{false, nil} {
+		userinfo["email_verified"] = verified
+		if verified == nil {
+			delete(userinfo, "email_verified")
+		}
+		w = callback("thecode")
+		r = httptest.NewRequest("GET", "/", nil)
+		for _, c := range w.Result().Cookies() {
+			if c.Name == "gopherpaint_session" {
+				r.AddCookie(c)
+			}
+		}
+		if u := a.Current(r); u == nil || u.Email != "" || u.Admin {
+			t.Errorf("email_verified %v: expected Alice without e-mail, given %+v", verified, u)
+		}
+	}
+
+	if w = callback("wrong"); w.Code != http.StatusBadGateway {
+		t.Errorf("Expected 502 with a wrong code, given %v", w.Code)
+	}
+}
@@ -0,0 +1,244 @@
+package gopherpaint
+
+import (
+	"bytes"
+	"errors"
+	"filters"
+	"fmt"
+	"html/template"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"net/http"
+	"net/url"
+)
+
+// maxCompared is how many paintings can be compared at once.
+const maxCompared = 8
+
+// comparedPainting is a painting of a comparison, with its v parameter
+// and the query that renders it.
+type comparedPainting struct {
+	Style  string
+	Params string
+	V      string
+	Query  template.URL
+}
+
+// comparedChoice is a style that can be added to a comparison, Value
+// is its v parameter.
+type comparedChoice struct {
+	Label string
+	Value string
+}
+
+// comparedPaintings parses the v parameters of a comparison, each the
+// style and render parameters of a painting of blobkey encoded as a
+// query string.
+func comparedPaintings(blobkey string, vs []string) ([]comparedPainting, error) {
+	if len(vs) > maxCompared {
+		return nil, badRequest(fmt.Errorf("up to %d paintings can be compared", maxCompared))
+	}
+	var res []comparedPainting
+	for _, v := range vs {
+		q, err := url.ParseQuery(v)
+		if err != nil {
+			return nil, badRequest(err)
+		}
+		if q.Get("style") == "" {
+			return nil, badRequest(errors.New("the paintings compared need a style"))
+		}
+		params := requestParams(q).Encode()
+		res = append(res, comparedPainting{
+			Style:  q.Get("style"),
+			Params: params,
+			V:      v,
+			Query:  renderQuery(blobkey, q.Get("style"), params),
+		})
+	}
+	return res, nil
+}
+
+// renderOriginal returns the image as uploaded, rescaled to size and
+// PNG encoded. Animations are shown by their first frame.
+func renderOriginal(c Logger, st *Storage, m *Image, size int) ([]byte, error) {
+	if m.Failed() {
+		return nil, imageFailed(m.FailReason)
+	}
+	cacheKey := fmt.Sprintf("%s_original_%d", m.ContentKey(), size)
+	if data, err := st.Cache.Get(cacheKey); err == nil {
+		return data, nil
+	}
+	in, err := loadRenderInput(c, st, m, url.Values{}, size)
+	if err != nil {
+		return nil, err
+	}
+	buffer := bytes.NewBuffer([]byte{})
+	if err := png.Encode(buffer, in.Image); err != nil {
+		return nil, err
+	}
+	st.Cache.Set(cacheKey, buffer.Bytes())
+	return buffer.Bytes(), nil
+}
+
+// handleCompare serves /compare, a single image with the paintings of
+// the v parameters side by side, after the original unless original
+// is 0. With layout=grid they are laid out in a square grid instead of
+// a row. Without paintings it is the original alone. With a share the
+// only painting is the one of the share.
+func handleCompare(w http.ResponseWriter, r *http.Request) {
+	c := loggerFor(r)
+	st := storageFor(r)
+	r.ParseForm()
+	u := auth.Current(r)
+	m, s, err := renderableImage(st, u, r.FormValue("blobKey"), r.FormValue("share"))
+	if err != nil {
+		http.Error(w, http.StatusText(errorStatus(err)), errorStatus(err))
+		return
+	}
+	size := 200
+	if r.FormValue("size") == "800" {
+		size = 800
+	}
+	vs := r.Form["v"]
+	if s != nil {
+		// Share holders only get the pinned painting.
+		vs = []string{s.query().Encode()}
+	}
+	paintings, err := comparedPaintings(m.Blobkey, vs)
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+
+	var encoded [][]byte
+	if len(paintings) == 0 || r.FormValue("original") != "0" {
+		// Links to unlisted images let others paint them, but not
+		// see the photo.
+		if (u == nil || u.ID != m.OwnerID) && m.EffectiveVisibility() != VisibilityPublic {
+			http.Error(w, "only the owner can see the original", http.StatusForbidden)
+			return
+		}
+		data, err := renderOriginal(c, st, m, size)
+		if err != nil {
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+		encoded = append(encoded, data)
+	}
+	for _, p := range paintings {
+		q, _ := url.ParseQuery(string(p.Query))
+		data, err := renderImage(c, st, m, q, size, renderRequester(r))
+		if err != nil {
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+		encoded = append(encoded, data)
+	}
+	images := make([]image.Image, len(encoded))
+	for i, data := range encoded {
+		if images[i], _, err = image.Decode(bytes.NewReader(data)); err != nil {
+			serveError(c, w, err, r)
+			return
+		}
+	}
+	columns := len(images)
+	if r.FormValue("layout") == "grid" {
+		columns = int(math.Ceil(math.Sqrt(float64(len(images)))))
+	}
+
+	w.Header().Set("Content-type", "image/png")
+	if m.EffectiveVisibility() == VisibilityPublic {
+		w.Header().Set("Cache-control", "public, max-age=259200")
+	} else {
+		w.Header().Set("Cache-control", "private, max-age=259200")
+	}
+	if r.FormValue("attachment") == "1" {
+		w.Header().Set("Content-Disposition", "attachment; filename=comparison.png")
+	}
+	png.Encode(w, filters.Grid(images, columns, 8, color.White))
+}
+
+// handleComparison shows the original of an image of the user next to
+// some of its paintings, by default the current one and the pinned
+// versions, with a before and after slider.
+func handleComparison(w http.ResponseWriter, r *http.Request) {
+	c := loggerFor(r)
+	st := storageFor(r)
+	u := auth.Current(r)
+	if u == nil {
+		url, err := auth.LoginURL(r, r.URL.String())
+		if err != nil {
+			serveError(c, w, err, r)
+			return
+		}
+		http.Redirect(w, r, url, http.StatusFound)
+		return
+	}
+	r.ParseForm()
+	m, err := Images_GetOne(st.Images, u.ID, r.FormValue("blobKey"))
+	if err != nil {
+		if err == ErrNotFound {
+			http.NotFound(w, r)
+			return
+		}
+		serveError(c, w, err, r)
+		return
+	}
+	vs := r.Form["v"]
+	if len(vs) == 0 {
+		vs, err = defaultCompared(st, m)
+		if err != nil {
+			serveError(c, w, err, r)
+			return
+		}
+	}
+	paintings, err := comparedPaintings(m.Blobkey, vs)
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	compared := make(map[string]bool)
+	for _, v := range vs {
+		compared[v] = true
+	}
+	var choices []comparedChoice
+	for _, name := range filters.FilterNames() {
+		choices = append(choices, comparedChoice{name, url.Values{"style": {name}}.Encode()})
+	}
+	for _, p := range pipelinePresets() {
+		choices = append(choices, comparedChoice{p.Title, url.Values{"style": {p.ID}}.Encode()})
+	}
+
+	context := make(map[string]interface{})
+	context["IsLogged"] = true
+	context["UserName"] = u.String()
+	context["LogoutURL"], err = auth.LogoutURL(r, "/")
+	if err != nil {
+		c.Errorf("Error comparison logged: %v", err)
+	}
+	context["image"] = m
+	context["Paintings"] = paintings
+	context["Compared"] = compared
+	context["Choices"] = choices
+	context["compare"] = template.URL(url.Values{"blobKey": {m.Blobkey}, "v": vs}.Encode())
+	templates["comparison"].Execute(w, context)
+}
+
+// defaultCompared returns the paintings compared when none are asked
+// for: the current style and the pinned versions of the image.
+func defaultCompared(st *Storage, m *Image) ([]string, error) {
+	current := (&Version{Style: m.Style, Params: m.Params}).query()
+	vs := []string{current}
+	versions, err := Versions_OfImage(st.Versions, m.OwnerID, m.Blobkey)
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range versions {
+		if q := v.query(); v.Pinned && q != current && len(vs) < maxCompared {
+			vs = append(vs, q)
+		}
+	}
+	return vs, nil
+}
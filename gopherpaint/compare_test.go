@@ -0,0 +1,90 @@
+//go:build !appengine
+// +build !appengine
+
+package gopherpaint
+
+import (
+	"image/png"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCompare(t *testing.T) {
+	mux, st, done := setupAPITest(t)
+	defer done()
+	var err error
+	if templates, err = loadTemplates(filepath.Join("..", "templates")); err != nil {
+		t.Fatal(err)
+	}
+	id := apiUpload(t, mux, "a").ID
+
+	w := apiDo(mux, "GET", "/compare?blobKey="+id, "a", nil, "")
+	if w.Code != http.StatusOK || w.Header().Get("Content-type") != "image/png" {
+		t.Fatalf("Expected the original, given %v %s", w.Code, w.Body)
+	}
+	original, err := png.Decode(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cell := original.Bounds().Size()
+
+	compare := func(user string, q url.Values) *http.Response {
+		q.Set("blobKey", id)
+		w := apiDo(mux, "GET", "/compare?"+q.Encode(), user, nil, "")
+		return w.Result()
+	}
+	res := compare("a", url.Values{"v": {"style=voronoi", "style=grayscale&seed=2"}})
+	m, err := png.Decode(res.Body)
+	if err != nil {
+		t.Fatalf("Expected a PNG, given %v %v", res.StatusCode, err)
+	}
+	if size := m.Bounds().Size(); size.X != 3*cell.X+2*8 || size.Y != cell.Y {
+		t.Errorf("Expected the original and 2 paintings in a row, given %v", size)
+	}
+	res = compare("a", url.Values{"v": {"style=voronoi", "style=grayscale"}, "layout": {"grid"}})
+	if m, err = png.Decode(res.Body); err != nil || m.Bounds().Dy() != 2*cell.Y+8 {
+		t.Errorf("Expected a grid of 2 rows, given %v %v", err, m.Bounds())
+	}
+
+	// Others can compare the paintings of unlisted images with a
+	// link, but not see the original.
+	Images_UpdateVisibility(st.Images, "a", id, VisibilityUnlisted)
+	s := &Share{ID: "link", OwnerID: "a", Blobkey: id, Style: "voronoi"}
+	st.Shares.Put(s)
+	if res = compare("b", url.Values{"share": {"link"}, "v": {"style=voronoi"}}); res.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected the original refused, given %v", res.StatusCode)
+	}
+	if res = compare("b", url.Values{"share": {"link"}, "v": {"style=voronoi"}, "original": {"0"}}); res.StatusCode != http.StatusOK {
+		t.Errorf("Expected the paintings compared, given %v", res.StatusCode)
+	}
+	// Only the painting of the link, whatever the v parameters.
+	res = compare("b", url.Values{"share": {"link"}, "v": {"style=grayscale", "style=oilpaint"}, "original": {"0"}})
+	if m, err = png.Decode(res.Body); err != nil || m.Bounds().Size() != cell {
+		t.Errorf("Expected the painting of the link alone, given %v %v", err, m.Bounds())
+	}
+	if res = compare("b", url.Values{}); res.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected the original refused without a link, given %v", res.StatusCode)
+	}
+
+	bad := []url.Values{
+		{"v": {"seed=2"}},
+		{"v": strings.Split(strings.Repeat("style=voronoi,", maxCompared+1), ",")},
+	}
+	for _, q := range bad {
+		if res = compare("a", q); res.StatusCode != http.StatusBadRequest {
+			t.Errorf("%v: expected 400, given %v", q, res.StatusCode)
+		}
+	}
+
+	Images_UpdateStyle(st, "a", id, "oilpaint", "")
+	w = apiDo(mux, "GET", "/comparison?blobKey="+id, "a", nil, "")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "style=oilpaint") {
+		t.Errorf("Expected the current style compared, given %v", w.Code)
+	}
+	if w = apiDo(mux, "GET", "/comparison?blobKey="+id, "b", nil, ""); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for the image of another user, given %v", w.Code)
+	}
+}
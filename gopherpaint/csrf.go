@@ -0,0 +1,52 @@
+package gopherpaint
+
+import (
+	"crypto/subtle"
+	"net/http"
+)
+
+// csrfCookie keeps the token that the forms of the app post back. Other
+// sites can make a browser post to the app, with its cookies, but they
+// can't read the token to put it in the form.
+const csrfCookie = "gopherpaint_csrf"
+
+// csrfToken returns the token for the forms of a page, and gives the
+// browser its cookie if it doesn't have one yet.
+func csrfToken(w http.ResponseWriter, r *http.Request) string {
+	if cookie, err := r.Cookie(csrfCookie); err == nil && len(cookie.Value) == 32 {
+		return cookie.Value
+	}
+	token := randomKey(16)
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookie,
+		Value:    token,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return token
+}
+
+var errCSRF = &apiError{http.StatusForbidden, "invalid_csrf", "the form expired, please reload the page and try again"}
+
+// checkCSRF fails unless a post comes from a page of the app: it has
+// the token of the cookie as the csrf value of the form, given as
+// token, or in the X-CSRF-Token header. Requests made with an API
+// token don't need it, browsers don't send those by themselves.
+func checkCSRF(r *http.Request, token string) error {
+	if _, ok := bearerToken(r); ok {
+		return nil
+	}
+	cookie, err := r.Cookie(csrfCookie)
+	if err != nil || cookie.Value == "" {
+		return errCSRF
+	}
+	if token == "" {
+		token = r.Header.Get("X-CSRF-Token")
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(cookie.Value)) != 1 {
+		return errCSRF
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+//go:build !appengine
+// +build !appengine
+
+package gopherpaint
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCSRF(t *testing.T) {
+	mux, st, done := setupAPITest(t)
+	defer done()
+	var err error
+	if templates, err = loadTemplates(filepath.Join("..", "templates")); err != nil {
+		t.Fatal(err)
+	}
+	id := apiUpload(t, mux, "a").ID
+
+	// The pages give the browser its token, and put it in their forms.
+	r := httptest.NewRequest("GET", "/share?blobKey="+id+"&style=grayscale", nil)
+	r.Header.Set("X-User", "a")
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	var cookie *http.Cookie
+	for _, c := range w.Result().Cookies() {
+		if c.Name == csrfCookie {
+			cookie = c
+		}
+	}
+	if cookie == nil || cookie.SameSite != http.SameSiteLaxMode || !cookie.HttpOnly {
+		t.Fatalf("Expected a lax, HTTP only, CSRF cookie, given %+v", cookie)
+	}
+	if !strings.Contains(w.Body.String(), `name="csrf" value="`+cookie.Value+`"`) {
+		t.Errorf("Expected the token in the forms")
+	}
+
+	post := func(path string, form url.Values, token string) int {
+		form.Set("csrf", token)
+		r := httptest.NewRequest("POST", path, strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.Header.Set("X-User", "a")
+		r.AddCookie(cookie)
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		return w.Code
+	}
+	posts := []struct {
+		path string
+		form url.Values
+	}{
+		{"/visibility", url.Values{"blobKey": {id}, "visibility": {VisibilityPublic}}},
+		{"/delete", url.Values{"blobKey": {id}}},
+		{"/share/create", url.Values{"blobKey": {id}, "style": {"grayscale"}}},
+		{"/share/revoke", url.Values{"id": {"x"}}},
+		{"/share/save", url.Values{"blobKey": {id}, "style": {"grayscale"}}},
+		{"/account/tokens", url.Values{"name": {"x"}, "scope": {ScopeRead}}},
+		{"/account/tokens/revoke", url.Values{"id": {"x"}}},
+		{"/album/edit", url.Values{"action": {"create"}, "name": {"x"}}},
+		{"/versions/edit", url.Values{"blobKey": {id}, "action": {"pin"}}},
+	}
+	for _, p := range posts {
+		if code := post(p.path, p.form, ""); code != http.StatusForbidden {
+			t.Errorf("%v: expected a post without the token refused, given %v", p.path, code)
+		}
+		if code := post(p.path, p.form, "other"); code != http.StatusForbidden {
+			t.Errorf("%v: expected a post with another token refused, given %v", p.path, code)
+		}
+	}
+	if m, _ := st.Images.Get("a", id); m == nil || m.Visibility == VisibilityPublic {
+		t.Errorf("Expected the image unchanged, given %+v", m)
+	}
+	if code := post("/visibility", url.Values{"blobKey": {id}, "visibility": {VisibilityPublic}}, cookie.Value); code != http.StatusFound {
+		t.Errorf("Expected a post with the token done, given %v", code)
+	}
+
+	// Uploads are checked once they are parsed.
+	for _, path := range []string{"/upload", "/reference", "/mask"} {
+		body, contentType := uploadBody(map[string]string{"blobKey": id})
+		r := httptest.NewRequest("POST", path, body)
+		r.Header.Set("Content-Type", contentType)
+		r.Header.Set("X-User", "a")
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		if w.Code != http.StatusForbidden {
+			t.Errorf("%v: expected an upload without the token refused, given %v", path, w.Code)
+		}
+	}
+	if pics, _ := st.Images.OfUser("a"); len(pics) != 1 {
+		t.Errorf("Expected no images uploaded, given %v", len(pics))
+	}
+
+	// Administrators too.
+	auth = SingleUserAuth{User: User{ID: "a", Admin: true}}
+	r = httptest.NewRequest("POST", "/admin/quotas", strings.NewReader("user=b&tier=pro"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected an administrator post without the token refused, given %v", w.Code)
+	}
+	if tier, _ := st.Quotas.Tier("b"); tier == "pro" {
+		t.Errorf("Expected the plan unchanged")
+	}
+	auth = tokenAuth{HeaderAuth{UserHeader: "X-User"}}
+
+	// API tokens aren't sent by browsers on their own.
+	token, secret := NewToken("a", "writer", Scopes)
+	st.Tokens.Put(token)
+	r = httptest.NewRequest("POST", "/album/edit", strings.NewReader("action=create&name=y"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.Header.Set("Authorization", "Bearer "+secret)
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	if w.Code != http.StatusFound {
+		t.Errorf("Expected a post with an API token done, given %v %s", w.Code, w.Body)
+	}
+}
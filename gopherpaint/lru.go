@@ -0,0 +1,77 @@
+//go:build !appengine
+// +build !appengine
+
+package gopherpaint
+
+import (
+	"container/list"
+	"sync"
+)
+
+// LRUCache is an in process Cache that drops the least recently used
+// values once it holds more than MaxBytes.
+type LRUCache struct {
+	MaxBytes int64
+
+	mu    sync.Mutex
+	bytes int64
+	order *list.List
+	items map[string]*list.Element
+}
+
+type lruEntry struct {
+	key   string
+	value []byte
+}
+
+// NewLRUCache returns a cache holding up to maxBytes of values.
+func NewLRUCache(maxBytes int64) *LRUCache {
+	return &LRUCache{
+		MaxBytes: maxBytes,
+		order:    list.New(),
+		items:    make(map[string]*list.Element),
+	}
+}
+
+func (l *LRUCache) Get(key string) ([]byte, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	e, ok := l.items[key]
+	if !ok {
+		return nil, ErrCacheMiss
+	}
+	l.order.MoveToFront(e)
+	return e.Value.(*lruEntry).value, nil
+}
+
+func (l *LRUCache) Set(key string, value []byte) error {
+	if int64(len(value)) > l.MaxBytes {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if e, ok := l.items[key]; ok {
+		l.remove(e)
+	}
+	l.items[key] = l.order.PushFront(&lruEntry{key, value})
+	l.bytes += int64(len(value))
+	for l.bytes > l.MaxBytes {
+		l.remove(l.order.Back())
+	}
+	return nil
+}
+
+func (l *LRUCache) Delete(key string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if e, ok := l.items[key]; ok {
+		l.remove(e)
+	}
+	return nil
+}
+
+func (l *LRUCache) remove(e *list.Element) {
+	entry := l.order.Remove(e).(*lruEntry)
+	delete(l.items, entry.key)
+	l.bytes -= int64(len(entry.value))
+}
@@ -1,161 +1,227 @@
 package gopherpaint
 
 import (
-	"appengine"
-	"appengine/blobstore"
-	"appengine/datastore"
-	"appengine/memcache"
-	"appengine/user"
+	"fmt"
+	"html/template"
+	"net/url"
+	"strconv"
 	"time"
 )
 
 type Image struct {
 	OwnerID      string
-	Blobkey      appengine.BlobKey
+	Blobkey      string
 	Style        string
 	CreationTime time.Time
 	MD5          string
 	Size         int64
+	// Params holds the render parameters of the style, encoded
+	// as a query string.
+	Params string
+	// Visibility tells who can render the image, empty is private.
+	Visibility string
+	// Status is empty for the images that can be painted, and
+	// ImageFailed, with the reason in FailReason, for the ones that
+	// can't be read.
+	Status     string
+	FailReason string
+}
+
+// ImageFailed is the status of the images that can't be read.
+const ImageFailed = "failed"
+
+// Failed tells if the image can't be painted.
+func (m *Image) Failed() bool {
+	return m.Status == ImageFailed
+}
+
+// Visibilities of an image.
+const (
+	// Only the owner can render a private image.
+	VisibilityPrivate = "private"
+	// Unlisted images can also be rendered with a share link.
+	VisibilityUnlisted = "unlisted"
+	// Anyone can render a public image.
+	VisibilityPublic = "public"
+)
+
+// Visibilities lists the visibilities, from the most restricted.
+var Visibilities = []string{VisibilityPrivate, VisibilityUnlisted, VisibilityPublic}
+
+// EffectiveVisibility returns the visibility of the image, images saved
+// before there were visibilities are private.
+func (m *Image) EffectiveVisibility() string {
+	if m.Visibility == "" {
+		return VisibilityPrivate
+	}
+	return m.Visibility
+}
+
+func validVisibility(v string) bool {
+	for _, vis := range Visibilities {
+		if vis == v {
+			return true
+		}
+	}
+	return false
 }
 
 func (m *Image) GenerateID() string {
-	return (string)(m.Blobkey) + "_" + m.OwnerID
+	return m.Blobkey + "_" + m.OwnerID
+}
+
+// RenderQuery is the query string used to render the image
+// with its current style.
+func (m *Image) RenderQuery() template.URL {
+	return renderQuery(m.Blobkey, m.Style, m.Params)
+}
+
+// ContentKey identifies the content of the image among the images of
+// its owner, the same file uploaded twice has the same key. Images
+// without a checksum only match themselves.
+func (m *Image) ContentKey() string {
+	if m.MD5 == "" {
+		return m.Blobkey
+	}
+	return m.OwnerID + "_" + m.MD5 + "_" + strconv.FormatInt(m.Size, 10)
+}
+
+func renderQuery(blobkey, style, params string) template.URL {
+	q := url.Values{"blobKey": {blobkey}, "style": {style}}.Encode()
+	if params != "" {
+		q += "&" + params
+	}
+	return template.URL(q)
 }
 
 func GenID(blobkey, oid string) string {
 	return blobkey + "_" + oid
 }
 
-func ImagesPOST(c appengine.Context,
-	usr *user.User,
-	blobinfo *blobstore.BlobInfo,
-	style string) (*datastore.Key, error) {
+func ImagesPOST(repo ImageRepository,
+	ownerID string,
+	blobinfo *BlobInfo,
+	style string) error {
 	data := &Image{
-		OwnerID:      usr.ID,
-		Blobkey:      blobinfo.BlobKey,
+		OwnerID:      ownerID,
+		Blobkey:      blobinfo.Key,
 		Style:        style,
 		CreationTime: time.Now(),
 		MD5:          blobinfo.MD5,
 		Size:         blobinfo.Size,
 	}
-
-	mcKey := data.GenerateID()
-	key := datastore.NewKey(c, "Images", mcKey, 0, nil)
-
-	mcItem := &memcache.Item{
-		Key:    mcKey,
-		Object: data,
-	}
-	memcache.Gob.Set(c, mcItem)
-
-	return datastore.Put(c, key, data)
+	return repo.Put(data)
 }
 
-func Images_OfUser_GET(c appengine.Context, usr *user.User) ([]Image, error) {
-	mcKey := "pics_" + usr.ID
-	var items []Image
-	_, err := memcache.Gob.Get(c, mcKey, &items)
-	if err == nil {
-		return items, nil
-	}
-
-	q := datastore.NewQuery("Images").
-		Filter("OwnerID =", usr.ID).
-		Order("-CreationTime")
-	_, err = q.GetAll(c, &items)
-
-	// Add list of images to memcache
-	mcItem := &memcache.Item{
-		Key:    mcKey,
-		Object: items,
-	}
-	memcache.Gob.Set(c, mcItem)
+func Images_OfUser_GET(repo ImageRepository, ownerID string) ([]Image, error) {
+	return repo.OfUser(ownerID)
+}
 
-	return items, err
+func Images_GetOne(repo ImageRepository, ownerID string, blobkey string) (*Image, error) {
+	return repo.Get(ownerID, blobkey)
 }
 
-func Images_GetOne(c appengine.Context, usr *user.User, blobkey string) (*Image, error) {
-	// Try to get from memcache
-	mcKey := GenID(blobkey, usr.ID)
-	var item Image
-	_, err := memcache.Gob.Get(c, mcKey, &item)
-	if err == nil {
-		return &item, nil
+// Images_Duplicate returns the image of the user with the same content
+// as the blob, or ErrNotFound.
+func Images_Duplicate(repo ImageRepository, ownerID string, blobinfo *BlobInfo) (*Image, error) {
+	if blobinfo.MD5 == "" {
+		return nil, ErrNotFound
 	}
-
-	// Get from datastore
-	q := datastore.NewQuery("Images").
-		Filter("OwnerID =", usr.ID).
-		Filter("Blobkey =", blobkey)
-	var images []Image
-	_, err = q.GetAll(c, &images)
-	if err != nil && len(images) > 0 {
+	pics, err := repo.OfUser(ownerID)
+	if err != nil {
 		return nil, err
 	}
-	img := images[0]
-
-	// Saves in memcache so we don't hit datastore
-	mcItem := &memcache.Item{
-		Key:    mcKey,
-		Object: img,
+	for i := range pics {
+		m := &pics[i]
+		if m.Blobkey != blobinfo.Key && m.MD5 == blobinfo.MD5 && m.Size == blobinfo.Size {
+			return m, nil
+		}
 	}
-	memcache.Gob.Set(c, mcItem)
-
-	return &img, nil
+	return nil, ErrNotFound
 }
 
-func Images_UpdateStyle(c appengine.Context,
-	usr *user.User,
+// Images_UpdateStyle changes the style of an image, and records it in
+// the history of the image.
+func Images_UpdateStyle(st *Storage,
+	ownerID string,
 	blobkey string,
-	newstyle string) (*datastore.Key, error) {
-	// Retrieve key
-	m, err := Images_GetOne(c, usr, blobkey)
+	newstyle string,
+	params string) error {
+	// Retrieve the image
+	m, err := Images_GetOne(st.Images, ownerID, blobkey)
 	if err != nil {
-		c.Infof("Images_GetOne: %v", err)
-		return nil, err
+		return err
 	}
 
 	// Updates the value
-	if m.Style == newstyle || m.OwnerID != usr.ID {
-		c.Infof("Old style %v new %v | owner %v current %v", m.Style, newstyle, m.OwnerID, usr.ID)
-		return nil, nil
+	if (m.Style == newstyle && m.Params == params) || m.OwnerID != ownerID {
+		return nil
 	}
 
+	// Images without history get the style they had until now as
+	// their first version, so it isn't lost.
+	if versions, err := st.Versions.OfImage(ownerID, blobkey); err != nil {
+		return err
+	} else if len(versions) == 0 {
+		if err := Versions_Add(st.Versions, m, m.CreationTime); err != nil {
+			return err
+		}
+	}
 	m.Style = newstyle
-	key := datastore.NewKey(c, "Images", m.GenerateID(), 0, nil)
-	nk, err := datastore.Put(c, key, m)
+	m.Params = params
+	if err := st.Images.Put(m); err != nil {
+		return err
+	}
+	return Versions_Add(st.Versions, m, time.Now())
+}
 
+func Images_Delete(st *Storage,
+	ownerID string,
+	blobkey string) error {
+	m, err := Images_GetOne(st.Images, ownerID, blobkey)
 	if err != nil {
-		c.Infof("datastore put: %v", err)
-		return nk, err
+		return err
 	}
-	memcache.Delete(c, "pics_"+usr.ID)
-	mcKey := GenID(blobkey, usr.ID)
-	mcItem := &memcache.Item{
-		Key:    mcKey,
-		Object: m,
+	if m.OwnerID != ownerID {
+		return nil
 	}
-	memcache.Gob.Set(c, mcItem)
-
-	return nk, err
+	if err := Versions_DeleteOfImage(st.Versions, ownerID, blobkey); err != nil {
+		return err
+	}
+	return st.Images.Delete(ownerID, blobkey)
 }
 
-func Images_Delete(c appengine.Context,
-	usr *user.User,
-	blobkey string) error {
-	m, err := Images_GetOne(c, usr, blobkey)
+func Images_UpdateVisibility(repo ImageRepository,
+	ownerID string,
+	blobkey string,
+	visibility string) error {
+	if !validVisibility(visibility) {
+		return badRequest(fmt.Errorf("unknown visibility %q", visibility))
+	}
+	m, err := Images_GetOne(repo, ownerID, blobkey)
 	if err != nil {
 		return err
 	}
-	if m.OwnerID != usr.ID {
+	if m.EffectiveVisibility() == visibility {
 		return nil
 	}
-	itemKey := GenID(blobkey, usr.ID)
-	key := datastore.NewKey(c, "Images", itemKey, 0, nil)
-	err = datastore.Delete(c, key)
+	m.Visibility = visibility
+	return repo.Put(m)
+}
+
+// Images_MarkFailed records why an image of the user can't be painted.
+func Images_MarkFailed(repo ImageRepository,
+	ownerID string,
+	blobkey string,
+	reason string) error {
+	m, err := Images_GetOne(repo, ownerID, blobkey)
 	if err != nil {
 		return err
 	}
-
-	return memcache.Delete(c, itemKey)
+	if m.Failed() && m.FailReason == reason {
+		return nil
+	}
+	m.Status = ImageFailed
+	m.FailReason = reason
+	return repo.Put(m)
 }
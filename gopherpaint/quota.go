@@ -0,0 +1,256 @@
+package gopherpaint
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Tier sets the limits of the users in it. A zero limit is no limit.
+type Tier struct {
+	Name             string `json:"name"`
+	MaxImages        int    `json:"max_images"`
+	MaxBytes         int64  `json:"max_bytes"`
+	MaxRendersPerDay int    `json:"max_renders_per_day"`
+}
+
+// DefaultTiers has a single tier without limits, for the installs
+// that don't configure any.
+var DefaultTiers = []Tier{{Name: "default"}}
+
+// tiers are the tiers of the app, users are in the first one unless an
+// administrator moves them.
+var tiers = DefaultTiers
+
+// Usage is what a user is using of the limits of their tier.
+type Usage struct {
+	Tier         Tier
+	Images       int
+	Bytes        int64
+	RendersToday int
+}
+
+// MB returns the bytes used, in megabytes.
+func (u *Usage) MB() string {
+	return fmt.Sprintf("%.1f", float64(u.Bytes)/(1<<20))
+}
+
+// MaxMB returns the bytes allowed, in megabytes.
+func (u *Usage) MaxMB() string {
+	return fmt.Sprintf("%.1f", float64(u.Tier.MaxBytes)/(1<<20))
+}
+
+// quotaExceeded reports that the user went over a limit, with status
+// 403 for storage and 429 for renders, that come back tomorrow.
+func quotaExceeded(status int, format string, args ...interface{}) *apiError {
+	return &apiError{status, "quota_exceeded", fmt.Sprintf(format, args...)}
+}
+
+// today is the day the renders are counted in.
+func today() string {
+	return time.Now().UTC().Format("2006-01-02")
+}
+
+// findTier returns the tier with the name, or the first one.
+func findTier(name string) Tier {
+	for _, t := range tiers {
+		if t.Name == name {
+			return t
+		}
+	}
+	return tiers[0]
+}
+
+func validTier(name string) bool {
+	for _, t := range tiers {
+		if t.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Quotas_Tier returns the tier of the user.
+func Quotas_Tier(repo QuotaRepository, ownerID string) (Tier, error) {
+	name, err := repo.Tier(ownerID)
+	if err != nil {
+		return Tier{}, err
+	}
+	return findTier(name), nil
+}
+
+// Quotas_SetTier moves a user to another tier.
+func Quotas_SetTier(repo QuotaRepository, ownerID, tier string) error {
+	ownerID = strings.TrimSpace(ownerID)
+	if ownerID == "" {
+		return badRequest(fmt.Errorf("the user is required"))
+	}
+	if !validTier(tier) {
+		return badRequest(fmt.Errorf("unknown tier %q", tier))
+	}
+	return repo.SetTier(ownerID, tier)
+}
+
+// Quotas_Usage returns the usage of the user, pics are their images.
+// Their assets count in the bytes too.
+func Quotas_Usage(st *Storage, ownerID string, pics []Image) (*Usage, error) {
+	t, err := Quotas_Tier(st.Quotas, ownerID)
+	if err != nil {
+		return nil, err
+	}
+	u := &Usage{Tier: t, Images: len(pics)}
+	for _, m := range pics {
+		u.Bytes += m.Size
+	}
+	assets, err := st.Assets.OfUser(ownerID)
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range assets {
+		u.Bytes += a.Size
+	}
+	u.RendersToday, err = st.Quotas.Renders(ownerID, today())
+	return u, err
+}
+
+// checkUploadQuota fails if an upload of size bytes would take the user
+// over the limits of their tier.
+func checkUploadQuota(st *Storage, ownerID string, size int64) error {
+	return checkQuota(st, ownerID, size, true)
+}
+
+// checkAssetQuota is checkUploadQuota for an asset, that doesn't count
+// as an image.
+func checkAssetQuota(st *Storage, ownerID string, size int64) error {
+	return checkQuota(st, ownerID, size, false)
+}
+
+func checkQuota(st *Storage, ownerID string, size int64, image bool) error {
+	pics, err := Images_OfUser_GET(st.Images, ownerID)
+	if err != nil {
+		return err
+	}
+	u, err := Quotas_Usage(st, ownerID, pics)
+	if err != nil {
+		return err
+	}
+	if max := u.Tier.MaxImages; image && max > 0 && u.Images >= max {
+		return quotaExceeded(http.StatusForbidden,
+			"you have reached the %d images of your plan, delete some to upload more", max)
+	}
+	if max := u.Tier.MaxBytes; max > 0 && u.Bytes+size > max {
+		return quotaExceeded(http.StatusForbidden,
+			"the image doesn't fit in the %s MB of your plan, %s MB are in use", u.MaxMB(), u.MB())
+	}
+	return nil
+}
+
+// renderRequester returns who the renders of r are charged to: the
+// user, or the address of anonymous visitors, so that they have the
+// renders of the free plan and can't use up the ones of the owner.
+// Visitors behind the same proxy or NAT come from the same address, so
+// they share those renders. The headers that proxies add can be forged
+// by anyone, so they aren't used; installs behind a proxy of their own
+// should give the address of the visitor as RemoteAddr.
+func renderRequester(r *http.Request) string {
+	if u := auth.Current(r); u != nil {
+		return u.ID
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "anonymous:" + host
+}
+
+// reserveRender counts a render for the user before it is painted, and
+// fails if they already made all the renders of the day. Checking and
+// counting together keeps concurrent renders from going over the limit.
+func reserveRender(st *Storage, userID string) error {
+	t, err := Quotas_Tier(st.Quotas, userID)
+	if err != nil {
+		return err
+	}
+	ok, err := st.Quotas.ReserveRender(userID, today(), t.MaxRendersPerDay)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return quotaExceeded(http.StatusTooManyRequests,
+			"the %d renders of the day of your plan are used, try again tomorrow", t.MaxRendersPerDay)
+	}
+	return nil
+}
+
+// refundRender gives back a render reserved for the user that couldn't
+// be painted.
+func refundRender(st *Storage, userID string) error {
+	_, err := st.Quotas.AddRenders(userID, today(), -1)
+	return err
+}
+
+type userTier struct {
+	User string
+	Tier string
+}
+
+type byUser []userTier
+
+func (b byUser) Len() int           { return len(b) }
+func (b byUser) Less(i, j int) bool { return b[i].User < b[j].User }
+func (b byUser) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+
+// handleAdminQuotas shows the tiers to the administrators, and moves
+// users between them.
+func handleAdminQuotas(w http.ResponseWriter, r *http.Request) {
+	c := loggerFor(r)
+	u := auth.Current(r)
+	if u == nil || !u.Admin {
+		http.Error(w, "administrators only", http.StatusForbidden)
+		return
+	}
+	repo := storageFor(r).Quotas
+	if r.Method == "POST" {
+		if err := checkCSRF(r, r.FormValue("csrf")); err != nil {
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+		err := Quotas_SetTier(repo, r.FormValue("user"), r.FormValue("tier"))
+		if err != nil {
+			if status := errorStatus(err); status != http.StatusInternalServerError {
+				http.Error(w, err.Error(), status)
+				return
+			}
+			serveError(c, w, err, r)
+			return
+		}
+		http.Redirect(w, r, "/admin/quotas", http.StatusFound)
+		return
+	}
+
+	assigned, err := repo.Tiers()
+	if err != nil {
+		serveError(c, w, err, r)
+		return
+	}
+	var users []userTier
+	for user, tier := range assigned {
+		users = append(users, userTier{user, tier})
+	}
+	sort.Sort(byUser(users))
+
+	context := make(map[string]interface{})
+	context["csrf"] = csrfToken(w, r)
+	context["IsLogged"] = true
+	context["UserName"] = u.String()
+	context["LogoutURL"], err = auth.LogoutURL(r, "/")
+	if err != nil {
+		c.Errorf("Error admin logged: %v", err)
+	}
+	context["Tiers"] = tiers
+	context["Users"] = users
+	templates["admin"].Execute(w, context)
+}
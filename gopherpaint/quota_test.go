@@ -0,0 +1,132 @@
+//go:build !appengine
+// +build !appengine
+
+package gopherpaint
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestQuotas(t *testing.T) {
+	mux, st, done := setupAPITest(t)
+	defer done()
+	tiers = []Tier{{Name: "free", MaxImages: 2, MaxRendersPerDay: 2}, {Name: "pro"}}
+	defer func() { tiers = DefaultTiers }()
+
+	first := apiUpload(t, mux, "a")
+	apiUpload(t, mux, "a")
+	body, contentType := uploadBody(nil)
+	w := apiDo(mux, "POST", "/api/v1/images", "a", body, contentType)
+	var res struct {
+		Error apiError `json:"error"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &res)
+	if w.Code != http.StatusForbidden || res.Error.Code != "quota_exceeded" {
+		t.Errorf("Expected the third image refused, given %v %s", w.Code, w.Body)
+	}
+	if pics, _ := st.Images.OfUser("a"); len(pics) != 2 {
+		t.Errorf("Expected 2 images, given %v", len(pics))
+	}
+
+	for i, expected := range []int{http.StatusOK, http.StatusOK, http.StatusOK, http.StatusTooManyRequests} {
+		// The third render is the first one again, from the cache.
+		seed := []string{"1", "2", "1", "3"}[i]
+		w = apiDo(mux, "GET", "/render?blobKey="+first.ID+"&style=voronoi&seed="+seed, "a", nil, "")
+		if w.Code != expected {
+			t.Errorf("Render %d: expected %v, given %v", i, expected, w.Code)
+		}
+	}
+	if n, _ := st.Quotas.Renders("a", today()); n != 2 {
+		t.Errorf("Expected 2 renders counted, given %v", n)
+	}
+
+	form := url.Values{"user": {"a"}, "tier": {"pro"}}.Encode()
+	if w = apiDo(mux, "POST", "/admin/quotas", "a", strings.NewReader(form), "application/x-www-form-urlencoded"); w.Code != http.StatusForbidden {
+		t.Errorf("Expected only administrators to change plans, given %v", w.Code)
+	}
+	Quotas_SetTier(st.Quotas, "a", "pro")
+	if w = apiDo(mux, "GET", "/render?blobKey="+first.ID+"&style=voronoi&seed=3", "a", nil, ""); w.Code != http.StatusOK {
+		t.Errorf("Expected no limits in the pro plan, given %v", w.Code)
+	}
+	if err := Quotas_SetTier(st.Quotas, "a", "gold"); errorStatus(err) != http.StatusBadRequest {
+		t.Errorf("Expected an unknown tier refused, given %v", err)
+	}
+	u, err := Quotas_Usage(st, "a", nil)
+	if err != nil || u.Tier.Name != "pro" || u.RendersToday != 3 {
+		t.Errorf("Expected the usage of the pro plan, given %+v %v", u, err)
+	}
+}
+
+func TestRenderCharges(t *testing.T) {
+	mux, st, done := setupAPITest(t)
+	defer done()
+	tiers = []Tier{{Name: "free", MaxRendersPerDay: 1}}
+	defer func() { tiers = DefaultTiers }()
+
+	m := apiUpload(t, mux, "a")
+	Images_UpdateVisibility(st.Images, "a", m.ID, VisibilityPublic)
+	render := "/render?style=voronoi&blobKey=" + m.ID + "&seed="
+
+	// Failed renders aren't charged.
+	if w := apiDo(mux, "GET", render+"1&detailmap=nothing", "a", nil, ""); w.Code != http.StatusNotFound {
+		t.Errorf("Expected the render to fail, given %v", w.Code)
+	}
+	if n, _ := st.Quotas.Renders("a", today()); n != 0 {
+		t.Errorf("Expected no renders counted, given %v", n)
+	}
+
+	// Other users and visitors render with their own quota.
+	for i, user := range []string{"b", ""} {
+		seed := []string{"1", "2"}[i]
+		if w := apiDo(mux, "GET", render+seed, user, nil, ""); w.Code != http.StatusOK {
+			t.Errorf("%q: expected the public image painted, given %v", user, w.Code)
+		}
+		if w := apiDo(mux, "GET", render+seed+"0", user, nil, ""); w.Code != http.StatusTooManyRequests {
+			t.Errorf("%q: expected the second render refused, given %v", user, w.Code)
+		}
+	}
+	if n, _ := st.Quotas.Renders("anonymous:192.0.2.1", today()); n != 1 {
+		t.Errorf("Expected the render of the visitor counted, given %v", n)
+	}
+	if n, _ := st.Quotas.Renders("a", today()); n != 0 {
+		t.Errorf("Expected no renders charged to the owner, given %v", n)
+	}
+	if w := apiDo(mux, "GET", render+"3", "a", nil, ""); w.Code != http.StatusOK {
+		t.Errorf("Expected the owner to keep their renders, given %v", w.Code)
+	}
+}
+
+func TestConcurrentRenders(t *testing.T) {
+	mux, st, done := setupAPITest(t)
+	defer done()
+	tiers = []Tier{{Name: "free", MaxRendersPerDay: 2}}
+	defer func() { tiers = DefaultTiers }()
+	m := apiUpload(t, mux, "a")
+
+	// The renders are reserved before painting, so the ones made at
+	// once can't go over the limit.
+	codes := make(chan int)
+	for i := 0; i < 6; i++ {
+		go func(seed int) {
+			w := apiDo(mux, "GET", fmt.Sprintf("/render?style=voronoi&blobKey=%v&seed=%d", m.ID, seed), "a", nil, "")
+			codes <- w.Code
+		}(i)
+	}
+	painted := 0
+	for i := 0; i < 6; i++ {
+		if <-codes == http.StatusOK {
+			painted++
+		}
+	}
+	if painted != 2 {
+		t.Errorf("Expected 2 renders painted, given %v", painted)
+	}
+	if n, _ := st.Quotas.Renders("a", today()); n != 2 {
+		t.Errorf("Expected 2 renders counted, given %v", n)
+	}
+}
@@ -0,0 +1,278 @@
+//go:build !appengine
+// +build !appengine
+
+package gopherpaint
+
+import (
+	"bytes"
+	"encoding/json"
+	"filters"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/png"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRenderVisibility(t *testing.T) {
+	mux, st, done := setupAPITest(t)
+	defer done()
+
+	images := make(map[string]string)
+	for _, v := range Visibilities {
+		id := apiUpload(t, mux, "owner").ID
+		if err := Images_UpdateVisibility(st.Images, "owner", id, v); err != nil {
+			t.Fatal(err)
+		}
+		images[v] = id
+	}
+	legacy := apiUpload(t, mux, "owner").ID
+	other := apiUpload(t, mux, "owner").ID
+	images["unlisted2"] = apiUpload(t, mux, "owner").ID
+	Images_UpdateVisibility(st.Images, "owner", images["unlisted2"], VisibilityUnlisted)
+
+	share := func(id string, revoked bool) string {
+		s := &Share{ID: randomKey(4), OwnerID: "owner", Blobkey: id, Style: "voronoi", Revoked: revoked}
+		st.Shares.Put(s)
+		return s.ID
+	}
+	unlistedShare := share(images[VisibilityUnlisted], false)
+	revokedShare := share(images[VisibilityUnlisted], true)
+	otherShare := share(images["unlisted2"], false)
+	privateShare := share(images[VisibilityPrivate], false)
+	expired := &Share{ID: "expired", OwnerID: "owner", Blobkey: images[VisibilityUnlisted], Style: "voronoi",
+		Expires: time.Now().Add(-time.Hour)}
+	st.Shares.Put(expired)
+
+	tests := []struct {
+		name, blobkey, user, share string
+		status                     int
+	}{
+		{"owner of private", images[VisibilityPrivate], "owner", "", http.StatusOK},
+		{"owner of unlisted", images[VisibilityUnlisted], "owner", "", http.StatusOK},
+		{"owner of legacy", legacy, "owner", "", http.StatusOK},
+		{"other user of private", images[VisibilityPrivate], "other", "", http.StatusNotFound},
+		{"anonymous of private", images[VisibilityPrivate], "", "", http.StatusNotFound},
+		{"anonymous of legacy", legacy, "", "", http.StatusNotFound},
+		{"share of private", images[VisibilityPrivate], "", privateShare, http.StatusNotFound},
+		{"anonymous of unlisted", images[VisibilityUnlisted], "", "", http.StatusForbidden},
+		{"share holder of unlisted", images[VisibilityUnlisted], "", unlistedShare, http.StatusOK},
+		{"other user with share", images[VisibilityUnlisted], "other", unlistedShare, http.StatusOK},
+		{"revoked share", images[VisibilityUnlisted], "", revokedShare, http.StatusForbidden},
+		{"expired share", images[VisibilityUnlisted], "", "expired", http.StatusForbidden},
+		{"share of another image", images[VisibilityUnlisted], "", otherShare, http.StatusForbidden},
+		{"unknown share", images[VisibilityUnlisted], "", "nothing", http.StatusForbidden},
+		{"anonymous of public", images[VisibilityPublic], "", "", http.StatusOK},
+		{"other user of public", images[VisibilityPublic], "other", "", http.StatusOK},
+		{"unknown image", "nothing", "owner", "", http.StatusNotFound},
+		{"no image", "", "", "", http.StatusNotFound},
+	}
+	for _, test := range tests {
+		path := "/render?style=voronoi&blobKey=" + test.blobkey
+		if test.share != "" {
+			path += "&share=" + test.share
+		}
+		w := apiDo(mux, "GET", path, test.user, nil, "")
+		if w.Code != test.status {
+			t.Errorf("%v: expected %v, given %v %s", test.name, test.status, w.Code, w.Body)
+		}
+		if w.Code == http.StatusOK && w.Header().Get("Content-type") != "image/png" {
+			t.Errorf("%v: expected a PNG, given %q", test.name, w.Header().Get("Content-type"))
+		}
+	}
+
+	// Share holders get the pinned painting, not the original nor
+	// paintings of their own.
+	pinned := apiDo(mux, "GET", "/render?style=voronoi&blobKey="+images[VisibilityUnlisted], "owner", nil, "")
+	original := apiDo(mux, "GET", "/compare?blobKey="+images[VisibilityUnlisted], "owner", nil, "")
+	if pinned.Code != http.StatusOK || original.Code != http.StatusOK {
+		t.Fatalf("Expected the owner to render both, given %v and %v", pinned.Code, original.Code)
+	}
+	for _, q := range []string{
+		"spec=" + url.QueryEscape(`{"steps":[{"op":"resize","params":{"size":200}}]}`),
+		"style=grayscale",
+		"style=voronoi&seed=7",
+	} {
+		w := apiDo(mux, "GET", "/render?blobKey="+images[VisibilityUnlisted]+"&share="+unlistedShare+"&"+q, "", nil, "")
+		if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), pinned.Body.Bytes()) {
+			t.Errorf("%v: expected the painting of the share, given %v", q, w.Code)
+		}
+		if bytes.Equal(w.Body.Bytes(), original.Body.Bytes()) {
+			t.Errorf("%v: expected the original not to be given", q)
+		}
+	}
+
+	// Only public renders can be kept by shared caches.
+	w := apiDo(mux, "GET", "/render?blobKey="+images[VisibilityPublic], "", nil, "")
+	if !strings.HasPrefix(w.Header().Get("Cache-control"), "public") {
+		t.Errorf("Expected a public render to be cacheable, given %q", w.Header().Get("Cache-control"))
+	}
+	w = apiDo(mux, "GET", "/render?blobKey="+images[VisibilityPrivate], "owner", nil, "")
+	if !strings.HasPrefix(w.Header().Get("Cache-control"), "private") {
+		t.Errorf("Expected a private render not to be shared, given %q", w.Header().Get("Cache-control"))
+	}
+
+	if err := Images_UpdateVisibility(st.Images, "owner", other, "everyone"); errorStatus(err) != http.StatusBadRequest {
+		t.Errorf("Expected an unknown visibility to be rejected, given %v", err)
+	}
+}
+
+// testAnimation is a GIF with a dot moving over three frames.
+func testAnimation() []byte {
+	p := color.Palette{color.Black, color.White}
+	g := &gif.GIF{}
+	for i := 0; i < 3; i++ {
+		m := image.NewPaletted(image.Rect(0, 0, 24, 16), p)
+		m.SetColorIndex(4+4*i, 8, 1)
+		g.Image = append(g.Image, m)
+		g.Delay = append(g.Delay, 20)
+	}
+	buf := &bytes.Buffer{}
+	gif.EncodeAll(buf, g)
+	return buf.Bytes()
+}
+
+func TestRenderAnimation(t *testing.T) {
+	mux, _, done := setupAPITest(t)
+	defer done()
+
+	w := uploadFile(mux, "a", testAnimation())
+	m := &apiImage{}
+	json.Unmarshal(w.Body.Bytes(), m)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected the animation accepted, given %v %s", w.Code, w.Body)
+	}
+
+	w = apiDo(mux, "GET", "/render?style=voronoi&blobKey="+m.ID, "a", nil, "")
+	if w.Code != http.StatusOK || w.Header().Get("Content-type") != "image/gif" {
+		t.Fatalf("Expected a GIF, given %v %q", w.Code, w.Header().Get("Content-type"))
+	}
+	g, err := gif.DecodeAll(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(g.Image) != 3 || g.Delay[2] != 20 {
+		t.Errorf("Expected the 3 frames with their delays, given %d and %v", len(g.Image), g.Delay)
+	}
+
+	w = apiDo(mux, "POST", "/api/v1/images/"+m.ID+"/renders", "a", strings.NewReader(`{"style":"voronoi"}`), "application/json")
+	if w.Code != http.StatusCreated {
+		t.Errorf("Expected the render URL, given %v %s", w.Code, w.Body)
+	}
+}
+
+func TestRenderRegions(t *testing.T) {
+	mux, _, done := setupAPITest(t)
+	defer done()
+	id := apiUpload(t, mux, "a").ID
+	render := func(regions string) *http.Response {
+		q := url.Values{"blobKey": {id}, "style": {"voronoi"}, "regions": {regions}}
+		return apiDo(mux, "GET", "/render?"+q.Encode(), "a", nil, "").Result()
+	}
+
+	plain := apiDo(mux, "GET", "/render?style=voronoi&blobKey="+id, "a", nil, "")
+	res := render(`[{"style":"grayscale","shape":"ellipse","x":0.2,"y":0.2,"w":0.6,"h":0.6,"feather":0.05}]`)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Expected the regions painted, given %v", res.StatusCode)
+	}
+	data := &bytes.Buffer{}
+	data.ReadFrom(res.Body)
+	if bytes.Equal(data.Bytes(), plain.Body.Bytes()) {
+		t.Errorf("Expected the regions to change the painting")
+	}
+	if res = render(`[{"style":"grayscale","shape":"star"}]`); res.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected bad regions refused, given %v", res.StatusCode)
+	}
+	if res = render(`[{"style":"grayscale","shape":"mask","mask":"nothing"}]`); res.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected a missing mask not found, given %v", res.StatusCode)
+	}
+	// Blobs that aren't masks of the owner aren't either.
+	if res = render(`[{"style":"grayscale","shape":"mask","mask":"` + id + `"}]`); res.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected an image used as a mask not found, given %v", res.StatusCode)
+	}
+
+	// Masks are uploaded, or painted in the browser, for the image.
+	uploadMaskAs := func(user string, data []byte) *httptest.ResponseRecorder {
+		body := &bytes.Buffer{}
+		mw := multipart.NewWriter(body)
+		mw.WriteField("blobKey", id)
+		fw, _ := mw.CreateFormFile("file", "mask.png")
+		fw.Write(data)
+		mw.Close()
+		return apiDo(mux, "POST", "/mask", user, body, mw.FormDataContentType())
+	}
+	uploadMask := func(data []byte) *httptest.ResponseRecorder {
+		return uploadMaskAs("a", data)
+	}
+	mask := image.NewGray(image.Rect(0, 0, 8, 8))
+	mask.SetGray(2, 2, color.Gray{255})
+	buf := &bytes.Buffer{}
+	png.Encode(buf, mask)
+	w := uploadMask(buf.Bytes())
+	location, _ := url.Parse(w.Header().Get("Location"))
+	if w.Code != http.StatusFound || location.Path != "/prepare" || location.Query().Get("mask") == "" {
+		t.Fatalf("Expected a redirect to the styles with the mask, given %v %q", w.Code, w.Header().Get("Location"))
+	}
+	regions := `[{"style":"grayscale","shape":"mask","mask":"` + location.Query().Get("mask") + `"}]`
+	if res = render(regions); res.StatusCode != http.StatusOK {
+		t.Errorf("Expected the masked region painted, given %v", res.StatusCode)
+	}
+	if w = uploadMask([]byte("not an image")); w.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("Expected a mask that isn't an image refused, given %v", w.Code)
+	}
+
+	if w = uploadMaskAs("", buf.Bytes()); w.Code != http.StatusFound || w.Header().Get("Location") != "/" {
+		t.Errorf("Expected anonymous masks refused, given %v %q", w.Code, w.Header().Get("Location"))
+	}
+	w = uploadMaskAs("b", buf.Bytes())
+	location, _ = url.Parse(w.Header().Get("Location"))
+	regions = `[{"style":"grayscale","shape":"mask","mask":"` + location.Query().Get("mask") + `"}]`
+	if res = render(regions); res.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected the mask of another user not found, given %v", res.StatusCode)
+	}
+}
+
+func TestRenderDetailMap(t *testing.T) {
+	mux, _, done := setupAPITest(t)
+	defer done()
+	id := apiUpload(t, mux, "a").ID
+
+	body := &bytes.Buffer{}
+	mw := multipart.NewWriter(body)
+	mw.WriteField("blobKey", id)
+	mw.WriteField("mask", "regionmask")
+	mw.WriteField("use", "detail")
+	fw, _ := mw.CreateFormFile("file", "detail.png")
+	png.Encode(fw, image.NewGray(image.Rect(0, 0, 8, 8)))
+	mw.Close()
+	w := apiDo(mux, "POST", "/mask", "a", body, mw.FormDataContentType())
+	location, _ := url.Parse(w.Header().Get("Location"))
+	if w.Code != http.StatusFound || location.Query().Get("detailmap") == "" || location.Query().Get("mask") != "regionmask" {
+		t.Fatalf("Expected a redirect with the detail map and the mask kept, given %v %q", w.Code, w.Header().Get("Location"))
+	}
+
+	detailmap := location.Query().Get("detailmap")
+	w = apiDo(mux, "GET", "/render?style=impresionist&blobKey="+id+"&detailmap="+detailmap, "a", nil, "")
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected the painting with the detail map, given %v %s", w.Code, w.Body)
+	}
+	q := url.Values{"detailmap": {detailmap}}
+	plain := renderKey("k", filters.StylePipeline("impresionist"), requestParams(url.Values{}), 800)
+	if renderKey("k", filters.StylePipeline("impresionist"), requestParams(q), 800) == plain {
+		t.Errorf("Expected the detail map in the cache key")
+	}
+	w = apiDo(mux, "GET", "/render?style=impresionist&blobKey="+id+"&detailmap=nothing", "a", nil, "")
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected a missing detail map not found, given %v", w.Code)
+	}
+	w = apiDo(mux, "GET", "/render?style=impresionist&blobKey="+id+"&detailmap="+id, "a", nil, "")
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected an image used as a detail map not found, given %v", w.Code)
+	}
+}
@@ -0,0 +1,61 @@
+package gopherpaint
+
+import (
+	"archive/zip"
+	"errors"
+	"filters"
+	"fmt"
+	"image/png"
+	"io"
+	"net/url"
+)
+
+// Replays are painted at replaySize, taking a frame every
+// replayStrokes strokes.
+const (
+	replaySize    = 400
+	replayStrokes = 150
+)
+
+// renderReplay paints m with the render parameters in q and returns how
+// it was painted, as an animated GIF, or as a ZIP with a PNG per frame
+// if format is "zip". Animated images are replayed by their first
+// frame.
+func renderReplay(c Logger, st *Storage, m *Image, q url.Values, format, requester string) ([]byte, error) {
+	if format != "gif" && format != "zip" {
+		return nil, badRequest(errors.New("unknown replay format " + format))
+	}
+	return cachedRender(c, st, m, q, replaySize, "replay-"+format, requester, func(w io.Writer, pipeline *filters.Pipeline, in *renderInput) error {
+		a := pipeline.RunReplay(c, in.Image, in.Settings, replayStrokes)
+		last := len(a.Frames) - 1
+		a.Frames[last] = in.paintRegions(c, a.Frames[last], in.Image)
+		if format == "zip" {
+			return writeFrames(w, a)
+		}
+		// The colors of the finished painting are used in every
+		// frame, the first ones are mostly empty.
+		p := in.Settings.Palette
+		if p == nil {
+			p = filters.ExtractPalette(a.Frames[len(a.Frames)-1], filters.MaxPaletteColors)
+		}
+		return filters.EncodeGIF(w, a, p, in.Settings.Dither)
+	})
+}
+
+// writeFrames writes the frames of the animation as PNG files of a ZIP.
+func writeFrames(w io.Writer, a *filters.Animation) error {
+	zw := zip.NewWriter(w)
+	for i, frame := range a.Frames {
+		f, err := zw.CreateHeader(&zip.FileHeader{
+			Name:   fmt.Sprintf("frame-%03d.png", i+1),
+			Method: zip.Store,
+		})
+		if err != nil {
+			return err
+		}
+		if err := png.Encode(f, frame); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
@@ -0,0 +1,132 @@
+package gopherpaint
+
+import (
+	"errors"
+	"html/template"
+	"log"
+	"net/http"
+	"path/filepath"
+)
+
+// Logger receives the log messages of a request. An appengine.Context
+// satisfies it.
+type Logger interface {
+	Infof(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+// StdLogger writes to the standard log package.
+type StdLogger struct{}
+
+func (StdLogger) Infof(format string, args ...interface{}) {
+	log.Printf("INFO: "+format, args...)
+}
+
+func (StdLogger) Errorf(format string, args ...interface{}) {
+	log.Printf("ERROR: "+format, args...)
+}
+
+// Config tells the app which services to use.
+type Config struct {
+	// Directory with the HTML templates.
+	TemplateDir string
+	// Storage returns the storage used to serve a request.
+	Storage func(r *http.Request) *Storage
+	// Logger returns the logger of a request, by default StdLogger.
+	Logger func(r *http.Request) Logger
+	// Auth tells who makes the requests. If it is a
+	// HandlerAuthenticator its handlers are added too.
+	Auth Authenticator
+	// Tiers limit what users can store and render, new users are in
+	// the first one. By default there are no limits.
+	Tiers []Tier
+}
+
+var (
+	templates map[string]*template.Template
+	// storageFor returns the Storage used to serve a request.
+	storageFor func(r *http.Request) *Storage
+	loggerFor  func(r *http.Request) Logger
+	auth       Authenticator
+)
+
+// pages are the templates of the app, every one of them also uses
+// the shared templates.
+var pages = []string{"prepare", "home", "share", "account", "login", "shared", "albums", "album", "admin", "versions", "comparison"}
+
+var sharedTemplates = []string{"scripts.html", "navbar.html", "footer.html"}
+
+// Setup configures the app, it must be called before serving any
+// request.
+func Setup(cfg Config) error {
+	if cfg.Storage == nil || cfg.Auth == nil {
+		return errors.New("gopherpaint: Storage and Auth are required")
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = func(r *http.Request) Logger { return StdLogger{} }
+	}
+	t, err := loadTemplates(cfg.TemplateDir)
+	if err != nil {
+		return err
+	}
+	templates = t
+	storageFor = cfg.Storage
+	loggerFor = cfg.Logger
+	// API tokens are accepted whatever the authenticator is.
+	auth = tokenAuth{cfg.Auth}
+	tiers = DefaultTiers
+	if len(cfg.Tiers) > 0 {
+		tiers = cfg.Tiers
+	}
+	return nil
+}
+
+func loadTemplates(dir string) (map[string]*template.Template, error) {
+	res := make(map[string]*template.Template)
+	for _, page := range pages {
+		files := []string{filepath.Join(dir, page+".html")}
+		for _, f := range sharedTemplates {
+			files = append(files, filepath.Join(dir, f))
+		}
+		t, err := template.ParseFiles(files...)
+		if err != nil {
+			return nil, err
+		}
+		res[page] = t
+	}
+	return res, nil
+}
+
+// RegisterHandlers adds the handlers of the app to mux. Requests
+// made with an API token need the scopes of the handler.
+func RegisterHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("/delete", withScope(ScopeDelete, handleDelete))
+	mux.HandleFunc("/upload", withScope(ScopeUpload, handleUpload))
+	mux.HandleFunc("/reference", withScope(ScopeUpload, handleReference))
+	mux.HandleFunc("/mask", withScope(ScopeUpload, handleMask))
+	mux.HandleFunc("/prepare", withScope(ScopeRead, handleSetupPaint))
+	mux.HandleFunc("/render", withScope(ScopeRender, handlePreview))
+	mux.HandleFunc("/share", withScope(ScopeRender, handleShare))
+	mux.HandleFunc("/share/save", withScope(ScopeWrite, handleStyleSave))
+	mux.HandleFunc("/share/create", withScope(ScopeShare, handleShareCreate))
+	mux.HandleFunc("/share/revoke", withScope(ScopeShare, handleShareRevoke))
+	mux.HandleFunc("/visibility", withScope(ScopeShare, handleVisibility))
+	mux.HandleFunc("/s/", handlePublicShare)
+	mux.HandleFunc("/compare", withScope(ScopeRender, handleCompare))
+	mux.HandleFunc("/comparison", withScope(ScopeRead, handleComparison))
+	mux.HandleFunc("/versions", withScope(ScopeRead, handleVersions))
+	mux.HandleFunc("/versions/edit", withScope(ScopeWrite, handleVersionEdit))
+	mux.HandleFunc("/albums", withScope(ScopeRead, handleAlbums))
+	mux.HandleFunc("/album", withScope(ScopeRead, handleAlbum))
+	mux.HandleFunc("/album/edit", withScope(ScopeWrite, handleAlbumEdit))
+	mux.HandleFunc("/album/download", withScope(ScopeRead, withScope(ScopeRender, handleAlbumDownload)))
+	mux.HandleFunc("/account", withScope(scopeAccount, handleAccount))
+	mux.HandleFunc("/account/tokens", withScope(scopeAccount, handleTokenCreate))
+	mux.HandleFunc("/account/tokens/revoke", withScope(scopeAccount, handleTokenRevoke))
+	mux.HandleFunc("/admin/quotas", withScope(scopeAccount, handleAdminQuotas))
+	mux.HandleFunc(apiPrefix, handleAPI)
+	mux.HandleFunc("/", withScope(ScopeRead, handler))
+	if h, ok := auth.(HandlerAuthenticator); ok {
+		h.RegisterHandlers(mux)
+	}
+}
@@ -0,0 +1,123 @@
+package gopherpaint
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Sessions keeps the signed in user in a cookie signed with Key. The
+// authenticators that don't have sessions of their own use it.
+type Sessions struct {
+	Key []byte
+	// Name of the cookie, by default "gopherpaint_session".
+	Name string
+	// MaxAge of a session, by default 30 days.
+	MaxAge time.Duration
+}
+
+type sessionData struct {
+	User    User  `json:"user"`
+	Expires int64 `json:"exp"`
+}
+
+func (s *Sessions) name() string {
+	if s.Name == "" {
+		return "gopherpaint_session"
+	}
+	return s.Name
+}
+
+func (s *Sessions) maxAge() time.Duration {
+	if s.MaxAge == 0 {
+		return 30 * 24 * time.Hour
+	}
+	return s.MaxAge
+}
+
+// Get returns the user of the session, or nil. Sessions don't keep
+// whether the user is an administrator, the authenticators look it up
+// on every request so that it can be taken back.
+func (s *Sessions) Get(r *http.Request) *User {
+	cookie, err := r.Cookie(s.name())
+	if err != nil {
+		return nil
+	}
+	payload, ok := s.verify(cookie.Value)
+	if !ok {
+		return nil
+	}
+	var data sessionData
+	if err := json.Unmarshal(payload, &data); err != nil || time.Now().Unix() > data.Expires {
+		return nil
+	}
+	data.User.Admin = false
+	return &data.User
+}
+
+// Set starts a session for u. The cookie isn't sent with the posts
+// of other sites.
+func (s *Sessions) Set(w http.ResponseWriter, r *http.Request, u *User) error {
+	payload, err := json.Marshal(sessionData{
+		User:    User{ID: u.ID, Email: u.Email, Name: u.Name},
+		Expires: time.Now().Add(s.maxAge()).Unix(),
+	})
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     s.name(),
+		Value:    s.sign(payload),
+		Path:     "/",
+		MaxAge:   int(s.maxAge() / time.Second),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+// Clear ends the session.
+func (s *Sessions) Clear(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{Name: s.name(), Path: "/", MaxAge: -1, HttpOnly: true, SameSite: http.SameSiteLaxMode})
+}
+
+// sign returns payload and its signature, base64 encoded.
+func (s *Sessions) sign(payload []byte) string {
+	mac := hmac.New(sha256.New, s.Key)
+	mac.Write(payload)
+	return base64.RawURLEncoding.EncodeToString(payload) + "." +
+		base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verify returns the payload of a value made by sign.
+func (s *Sessions) verify(value string) ([]byte, bool) {
+	i := strings.Index(value, ".")
+	if i < 0 {
+		return nil, false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(value[:i])
+	if err != nil {
+		return nil, false
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(value[i+1:])
+	if err != nil {
+		return nil, false
+	}
+	mac := hmac.New(sha256.New, s.Key)
+	mac.Write(payload)
+	return payload, hmac.Equal(sig, mac.Sum(nil))
+}
+
+// localRedirect returns dest if it is a path of this app, so the login
+// pages can't be used to send users to other sites.
+func localRedirect(dest string) string {
+	if !strings.HasPrefix(dest, "/") || strings.HasPrefix(dest, "//") || strings.HasPrefix(dest, "/\\") {
+		return "/"
+	}
+	return dest
+}
@@ -0,0 +1,259 @@
+package gopherpaint
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Share is a public link to one painting of an image. It pins the
+// style and the render parameters, seed included, so whoever has the
+// link sees that painting and nothing else of the original.
+type Share struct {
+	ID           string
+	OwnerID      string
+	Blobkey      string
+	Style        string
+	Params       string
+	CreationTime time.Time
+	// Expires is zero for links that don't expire.
+	Expires time.Time
+	Revoked bool
+}
+
+// shareLifetimes are the expirations offered when creating a share,
+// in days. Zero never expires.
+var shareLifetimes = []int{0, 1, 7, 30}
+
+// Active tells if the link can be used at t.
+func (s *Share) Active(t time.Time) bool {
+	return !s.Revoked && (s.Expires.IsZero() || t.Before(s.Expires))
+}
+
+// URL is the path of the public page of the share.
+func (s *Share) URL() string {
+	return "/s/" + s.ID
+}
+
+// query returns the render parameters of the pinned painting.
+func (s *Share) query() url.Values {
+	q, _ := url.ParseQuery(s.Params)
+	if q == nil {
+		q = url.Values{}
+	}
+	q.Set("style", s.Style)
+	return q
+}
+
+// SharesPOST creates a share of an image of the user, with the given
+// style and render parameters.
+func SharesPOST(st *Storage, ownerID, blobkey, style string, params url.Values, lifetime time.Duration) (*Share, error) {
+	if !validStyle(style) {
+		return nil, badRequest(fmt.Errorf("unknown style %q", style))
+	}
+	if _, err := Images_GetOne(st.Images, ownerID, blobkey); err != nil {
+		return nil, err
+	}
+	s := &Share{
+		ID:           randomKey(12),
+		OwnerID:      ownerID,
+		Blobkey:      blobkey,
+		Style:        style,
+		Params:       requestParams(params).Encode(),
+		CreationTime: time.Now(),
+	}
+	if lifetime > 0 {
+		s.Expires = s.CreationTime.Add(lifetime)
+	}
+	return s, st.Shares.Put(s)
+}
+
+// Shares_OfImage returns the shares of an image, newest first.
+func Shares_OfImage(repo ShareRepository, ownerID, blobkey string) ([]Share, error) {
+	shares, err := repo.OfUser(ownerID)
+	if err != nil {
+		return nil, err
+	}
+	var res []Share
+	for _, s := range shares {
+		if s.Blobkey == blobkey {
+			res = append(res, s)
+		}
+	}
+	return res, nil
+}
+
+// Shares_Revoke disables a share of the user for good.
+func Shares_Revoke(repo ShareRepository, ownerID, id string) error {
+	s, err := repo.Get(id)
+	if err != nil {
+		return err
+	}
+	if s.OwnerID != ownerID {
+		return ErrNotFound
+	}
+	s.Revoked = true
+	return repo.Put(s)
+}
+
+// activeShare returns the share with the ID, if it can be used and
+// its image wasn't deleted.
+func activeShare(st *Storage, id string) (*Share, error) {
+	s, err := st.Shares.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	if !s.Active(time.Now()) {
+		return nil, ErrNotFound
+	}
+	if _, err := Images_GetOne(st.Images, s.OwnerID, s.Blobkey); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// handleShareCreate creates a public link to the painting shown in the
+// share page.
+func handleShareCreate(w http.ResponseWriter, r *http.Request) {
+	c := loggerFor(r)
+	u := auth.Current(r)
+	if r.Method != "POST" || u == nil {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+	if err := checkCSRF(r, r.FormValue("csrf")); err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	r.ParseForm()
+	days, err := strconv.Atoi(r.FormValue("days"))
+	if err != nil || days < 0 {
+		days = 0
+	}
+	params, err := url.ParseQuery(r.FormValue("params"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s, err := SharesPOST(storageFor(r), u.ID, r.FormValue("blobKey"), r.FormValue("style"),
+		params, time.Duration(days)*24*time.Hour)
+	if err != nil {
+		if status := errorStatus(err); status != http.StatusInternalServerError {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		serveError(c, w, err, r)
+		return
+	}
+	http.Redirect(w, r, s.URL(), http.StatusFound)
+}
+
+// handleShareRevoke disables a public link and goes back to the share
+// page.
+func handleShareRevoke(w http.ResponseWriter, r *http.Request) {
+	c := loggerFor(r)
+	u := auth.Current(r)
+	if r.Method != "POST" || u == nil {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+	if err := checkCSRF(r, r.FormValue("csrf")); err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	err := Shares_Revoke(storageFor(r).Shares, u.ID, r.FormValue("id"))
+	if err != nil && err != ErrNotFound {
+		serveError(c, w, err, r)
+		return
+	}
+	dest := localRedirect(r.FormValue("rd"))
+	http.Redirect(w, r, dest, http.StatusFound)
+}
+
+// handlePublicShare serves /s/{id}, the public page of a share,
+// /s/{id}/image, its painting, and /s/{id}/replay, an animation of how
+// it was painted.
+func handlePublicShare(w http.ResponseWriter, r *http.Request) {
+	c := loggerFor(r)
+	st := storageFor(r)
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/s/"), "/")
+	s, err := activeShare(st, parts[0])
+	if err != nil {
+		if err != ErrNotFound {
+			c.Errorf("share %v: %v", parts[0], err)
+		}
+		http.NotFound(w, r)
+		return
+	}
+
+	switch {
+	case len(parts) == 1:
+		context := map[string]interface{}{
+			"share": s,
+		}
+		if u := auth.Current(r); u != nil {
+			context["IsLogged"] = true
+			context["UserName"] = u.String()
+			context["LogoutURL"], _ = auth.LogoutURL(r, "/")
+		} else {
+			context["IsLogged"] = false
+			context["LoginURL"], _ = auth.LoginURL(r, "/")
+		}
+		templates["shared"].Execute(w, context)
+	case len(parts) == 2 && parts[1] == "image":
+		size := 200
+		if r.FormValue("size") == "800" {
+			size = 800
+		}
+		m, err := Images_GetOne(st.Images, s.OwnerID, s.Blobkey)
+		if err != nil {
+			http.Error(w, "the painting can't be rendered", errorStatus(err))
+			return
+		}
+		// Only the pinned parameters are used, whatever the query
+		// says.
+		data, err := renderImage(c, st, m, s.query(), size, renderRequester(r))
+		if err != nil {
+			http.Error(w, "the painting can't be rendered", errorStatus(err))
+			return
+		}
+		contentType, ext := renderType(data)
+		w.Header().Set("Content-type", contentType)
+		w.Header().Set("Cache-control", "public, max-age=3600")
+		if r.FormValue("attachment") == "1" {
+			w.Header().Set("Content-Disposition", "attachment; filename=gopherpaint."+ext)
+		}
+		w.Write(data)
+	case len(parts) == 2 && parts[1] == "replay":
+		m, err := Images_GetOne(st.Images, s.OwnerID, s.Blobkey)
+		if err != nil {
+			http.Error(w, "the painting can't be rendered", errorStatus(err))
+			return
+		}
+		format := r.FormValue("format")
+		if format == "" {
+			format = "gif"
+		}
+		data, err := renderReplay(c, st, m, s.query(), format, renderRequester(r))
+		if err != nil {
+			http.Error(w, "the replay can't be rendered", errorStatus(err))
+			return
+		}
+		w.Header().Set("Cache-control", "public, max-age=3600")
+		if format == "zip" {
+			w.Header().Set("Content-type", "application/zip")
+			w.Header().Set("Content-Disposition", "attachment; filename=gopherpaint-replay.zip")
+		} else {
+			w.Header().Set("Content-type", "image/gif")
+			if r.FormValue("attachment") == "1" {
+				w.Header().Set("Content-Disposition", "attachment; filename=gopherpaint-replay.gif")
+			}
+		}
+		w.Write(data)
+	default:
+		http.NotFound(w, r)
+	}
+}
@@ -0,0 +1,112 @@
+//go:build !appengine
+// +build !appengine
+
+package gopherpaint
+
+import (
+	"archive/zip"
+	"bytes"
+	"image/gif"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestShares(t *testing.T) {
+	mux, st, done := setupAPITest(t)
+	defer done()
+	var err error
+	if templates, err = loadTemplates(filepath.Join("..", "templates")); err != nil {
+		t.Fatal(err)
+	}
+	id := apiUpload(t, mux, "a").ID
+
+	form := url.Values{
+		"blobKey": {id},
+		"style":   {"voronoi"},
+		"params":  {"seed=3&exposure=0.5"},
+		"days":    {"7"},
+	}
+	w := apiDo(mux, "POST", "/share/create", "a", strings.NewReader(form.Encode()), "application/x-www-form-urlencoded")
+	link := w.Header().Get("Location")
+	if w.Code != http.StatusFound || !strings.HasPrefix(link, "/s/") {
+		t.Fatalf("Expected a redirect to the share, given %v %q", w.Code, link)
+	}
+	if strings.Contains(link, id) {
+		t.Errorf("Expected the link not to show the blob key, given %q", link)
+	}
+	s, _ := st.Shares.Get(strings.TrimPrefix(link, "/s/"))
+	if s == nil || s.Params != "exposure=0.5&seed=3" || s.Expires.Before(time.Now().Add(6*24*time.Hour)) {
+		t.Errorf("Expected the painting pinned for 7 days, given %+v", s)
+	}
+
+	if w = apiDo(mux, "GET", link, "", nil, ""); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), link+"/image") {
+		t.Errorf("Expected the public page, given %v", w.Code)
+	}
+	pinned := apiDo(mux, "GET", link+"/image", "", nil, "")
+	other := apiDo(mux, "GET", link+"/image?style=grayscale&seed=9", "", nil, "")
+	if pinned.Code != http.StatusOK || !bytes.Equal(pinned.Body.Bytes(), other.Body.Bytes()) {
+		t.Errorf("Expected the query to be ignored, given %v and %v", pinned.Code, other.Code)
+	}
+
+	revoke := url.Values{"id": {s.ID}}.Encode()
+	apiDo(mux, "POST", "/share/revoke", "b", strings.NewReader(revoke), "application/x-www-form-urlencoded")
+	if w = apiDo(mux, "GET", link, "", nil, ""); w.Code != http.StatusOK {
+		t.Errorf("Expected other users not to revoke the share, given %v", w.Code)
+	}
+	apiDo(mux, "POST", "/share/revoke", "a", strings.NewReader(revoke), "application/x-www-form-urlencoded")
+	for _, path := range []string{link, link + "/image"} {
+		if w = apiDo(mux, "GET", path, "", nil, ""); w.Code != http.StatusNotFound {
+			t.Errorf("%v: expected 404 once revoked, given %v", path, w.Code)
+		}
+	}
+
+	expired := &Share{ID: "expired", OwnerID: "a", Blobkey: id, Style: "voronoi", Expires: time.Now().Add(-time.Minute)}
+	st.Shares.Put(expired)
+	if w = apiDo(mux, "GET", "/s/expired", "", nil, ""); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 once expired, given %v", w.Code)
+	}
+
+	kept := &Share{ID: "kept", OwnerID: "a", Blobkey: id, Style: "voronoi"}
+	st.Shares.Put(kept)
+	Images_Delete(st, "a", id)
+	if w = apiDo(mux, "GET", "/s/kept/image", "", nil, ""); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 once the image is deleted, given %v", w.Code)
+	}
+}
+
+func TestShareReplay(t *testing.T) {
+	mux, st, done := setupAPITest(t)
+	defer done()
+	id := apiUpload(t, mux, "a").ID
+	s := &Share{ID: "replay", OwnerID: "a", Blobkey: id, Style: "impresionist"}
+	st.Shares.Put(s)
+
+	w := apiDo(mux, "GET", "/s/replay/replay", "", nil, "")
+	if w.Code != http.StatusOK || w.Header().Get("Content-type") != "image/gif" {
+		t.Fatalf("Expected a GIF, given %v %s", w.Code, w.Body)
+	}
+	g, err := gif.DecodeAll(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(g.Image) < 2 {
+		t.Errorf("Expected the painting in several frames, given %d", len(g.Image))
+	}
+
+	w = apiDo(mux, "GET", "/s/replay/replay?format=zip", "", nil, "")
+	zr, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+	if err != nil {
+		t.Fatalf("Expected a ZIP, given %v %v", w.Code, err)
+	}
+	if len(zr.File) != len(g.Image) {
+		t.Errorf("Expected a PNG per frame, given %d files for %d frames", len(zr.File), len(g.Image))
+	}
+
+	if w = apiDo(mux, "GET", "/s/replay/replay?format=apng", "", nil, ""); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected an unknown format to be refused, given %v", w.Code)
+	}
+}
@@ -0,0 +1,176 @@
+package gopherpaint
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+var (
+	// ErrNotFound is returned by the repositories when an item
+	// doesn't exist.
+	ErrNotFound = errors.New("not found")
+	// ErrCacheMiss is returned by a Cache that doesn't have the key.
+	ErrCacheMiss = errors.New("cache miss")
+)
+
+// BlobInfo describes a stored blob.
+type BlobInfo struct {
+	Key          string
+	ContentType  string
+	CreationTime time.Time
+	Filename     string
+	Size         int64
+	MD5          string
+}
+
+// ImageRepository stores the Image records of every user.
+type ImageRepository interface {
+	Put(img *Image) error
+	// Get returns ErrNotFound if the user doesn't have the image.
+	Get(ownerID, blobkey string) (*Image, error)
+	// OfUser returns the images of a user, newest first.
+	OfUser(ownerID string) ([]Image, error)
+	// ByBlobkey returns the image of a blob, whoever the owner is,
+	// or ErrNotFound.
+	ByBlobkey(blobkey string) (*Image, error)
+	Delete(ownerID, blobkey string) error
+}
+
+// TokenRepository stores the API tokens.
+type TokenRepository interface {
+	Put(t *Token) error
+	// Get returns ErrNotFound if there is no token with the ID.
+	Get(id string) (*Token, error)
+	// OfUser returns the tokens of a user, newest first.
+	OfUser(ownerID string) ([]Token, error)
+	Delete(id string) error
+}
+
+// ShareRepository stores the public links to paintings.
+type ShareRepository interface {
+	Put(s *Share) error
+	// Get returns ErrNotFound if there is no share with the ID.
+	Get(id string) (*Share, error)
+	// OfUser returns the shares of a user, newest first.
+	OfUser(ownerID string) ([]Share, error)
+}
+
+// AlbumRepository stores the albums of every user.
+type AlbumRepository interface {
+	Put(a *Album) error
+	// Get returns ErrNotFound if the user doesn't have the album.
+	Get(ownerID, id string) (*Album, error)
+	// OfUser returns the albums of a user, newest first.
+	OfUser(ownerID string) ([]Album, error)
+	Delete(ownerID, id string) error
+}
+
+// VersionRepository stores the style history of the images.
+type VersionRepository interface {
+	Put(v *Version) error
+	// Get returns ErrNotFound if the image doesn't have the version.
+	Get(ownerID, blobkey, id string) (*Version, error)
+	// OfImage returns the versions of an image, newest first.
+	OfImage(ownerID, blobkey string) ([]Version, error)
+	Delete(ownerID, blobkey, id string) error
+}
+
+// AssetRepository stores the assets of every user.
+type AssetRepository interface {
+	Put(a *Asset) error
+	// Get returns ErrNotFound if the user doesn't have the asset.
+	Get(ownerID, blobkey string) (*Asset, error)
+	// OfUser returns the assets of a user, newest first.
+	OfUser(ownerID string) ([]Asset, error)
+	Delete(ownerID, blobkey string) error
+}
+
+// QuotaRepository keeps the tiers of the users and counts their
+// renders.
+type QuotaRepository interface {
+	// Tier returns the tier of the user, empty if they weren't moved
+	// to one.
+	Tier(ownerID string) (string, error)
+	SetTier(ownerID, tier string) error
+	// Tiers returns the tier of every user moved to one.
+	Tiers() (map[string]string, error)
+	// Renders returns how many renders the user made on day.
+	Renders(ownerID, day string) (int, error)
+	// AddRenders adds n to the renders of the user on day, and
+	// returns the total.
+	AddRenders(ownerID, day string, n int) (int, error)
+	// ReserveRender adds a render to the user on day unless they
+	// already made max, in the same transaction, and reports whether
+	// it was added. A zero max is no limit.
+	ReserveRender(ownerID, day string, max int) (bool, error)
+}
+
+// BlobStore keeps the uploaded originals and other binary data,
+// like rendered paintings.
+type BlobStore interface {
+	// UploadURL returns where an upload form has to be posted. The
+	// upload is then handled by the handler at successPath.
+	UploadURL(successPath string) (string, error)
+	// ParseUpload returns the blobs stored by an upload request,
+	// by field name, and the other form values.
+	ParseUpload(r *http.Request) (map[string][]*BlobInfo, url.Values, error)
+	Open(key string) (io.ReadCloser, error)
+	// Put stores data and returns its key.
+	Put(contentType string, data []byte) (string, error)
+	Delete(key string) error
+}
+
+// Cache keeps rendered images and other expensive results.
+type Cache interface {
+	// Get returns ErrCacheMiss if the key isn't cached.
+	Get(key string) ([]byte, error)
+	Set(key string, value []byte) error
+	Delete(key string) error
+}
+
+// Storage bundles the persistence services used by the handlers.
+type Storage struct {
+	Images   ImageRepository
+	Tokens   TokenRepository
+	Shares   ShareRepository
+	Albums   AlbumRepository
+	Versions VersionRepository
+	Assets   AssetRepository
+	Quotas   QuotaRepository
+	Blobs    BlobStore
+	Cache    Cache
+}
+
+// cacheGetGob decodes a value saved with cacheSetGob.
+func cacheGetGob(cache Cache, key string, v interface{}) error {
+	data, err := cache.Get(key)
+	if err != nil {
+		return err
+	}
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+// cacheSetGob saves any gob encodable value in the cache.
+func cacheSetGob(cache Cache, key string, v interface{}) error {
+	buffer := bytes.NewBuffer([]byte{})
+	if err := gob.NewEncoder(buffer).Encode(v); err != nil {
+		return err
+	}
+	return cache.Set(key, buffer.Bytes())
+}
+
+// randomKey returns n random bytes, hex encoded.
+func randomKey(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
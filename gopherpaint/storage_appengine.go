@@ -0,0 +1,546 @@
+//go:build appengine
+// +build appengine
+
+package gopherpaint
+
+import (
+	"appengine"
+	"appengine/blobstore"
+	"appengine/datastore"
+	"appengine/memcache"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// appengineStorage keeps the images in the datastore, the blobs in
+// the blobstore and caches in memcache.
+func appengineStorage(r *http.Request) *Storage {
+	c := appengine.NewContext(r)
+	return &Storage{
+		Images:   appengineImages{c},
+		Tokens:   appengineTokens{c},
+		Shares:   appengineShares{c},
+		Albums:   appengineAlbums{c},
+		Versions: appengineVersions{c},
+		Assets:   appengineAssets{c},
+		Quotas:   appengineQuotas{c},
+		Blobs:    appengineBlobs{c},
+		Cache:    appengineCache{c},
+	}
+}
+
+// imageEntity is how an Image is saved in the datastore, the
+// blob key keeps its own property type.
+type imageEntity struct {
+	OwnerID      string
+	Blobkey      appengine.BlobKey
+	Style        string
+	CreationTime time.Time
+	MD5          string
+	Size         int64
+	Params       string
+	Visibility   string
+	Status       string
+	FailReason   string `datastore:",noindex"`
+}
+
+func toEntity(m *Image) *imageEntity {
+	return &imageEntity{
+		OwnerID:      m.OwnerID,
+		Blobkey:      appengine.BlobKey(m.Blobkey),
+		Style:        m.Style,
+		CreationTime: m.CreationTime,
+		MD5:          m.MD5,
+		Size:         m.Size,
+		Params:       m.Params,
+		Visibility:   m.Visibility,
+		Status:       m.Status,
+		FailReason:   m.FailReason,
+	}
+}
+
+func (e *imageEntity) image() Image {
+	return Image{
+		OwnerID:      e.OwnerID,
+		Blobkey:      string(e.Blobkey),
+		Style:        e.Style,
+		CreationTime: e.CreationTime,
+		MD5:          e.MD5,
+		Size:         e.Size,
+		Params:       e.Params,
+		Visibility:   e.Visibility,
+		Status:       e.Status,
+		FailReason:   e.FailReason,
+	}
+}
+
+type appengineImages struct {
+	c appengine.Context
+}
+
+func (s appengineImages) Put(m *Image) error {
+	mcKey := m.GenerateID()
+	key := datastore.NewKey(s.c, "Images", mcKey, 0, nil)
+	if _, err := datastore.Put(s.c, key, toEntity(m)); err != nil {
+		return err
+	}
+	memcache.Gob.Set(s.c, &memcache.Item{
+		Key:    mcKey,
+		Object: m,
+	})
+	memcache.Delete(s.c, "pics_"+m.OwnerID)
+	return nil
+}
+
+func (s appengineImages) Get(ownerID, blobkey string) (*Image, error) {
+	// Try to get from memcache
+	mcKey := GenID(blobkey, ownerID)
+	var item Image
+	if _, err := memcache.Gob.Get(s.c, mcKey, &item); err == nil {
+		return &item, nil
+	}
+
+	// Get from datastore
+	var e imageEntity
+	err := datastore.Get(s.c, datastore.NewKey(s.c, "Images", mcKey, 0, nil), &e)
+	if err == datastore.ErrNoSuchEntity {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	img := e.image()
+
+	// Saves in memcache so we don't hit datastore
+	memcache.Gob.Set(s.c, &memcache.Item{
+		Key:    mcKey,
+		Object: img,
+	})
+	return &img, nil
+}
+
+func (s appengineImages) OfUser(ownerID string) ([]Image, error) {
+	mcKey := "pics_" + ownerID
+	var items []Image
+	if _, err := memcache.Gob.Get(s.c, mcKey, &items); err == nil {
+		return items, nil
+	}
+
+	q := datastore.NewQuery("Images").
+		Filter("OwnerID =", ownerID).
+		Order("-CreationTime")
+	var entities []imageEntity
+	if _, err := q.GetAll(s.c, &entities); err != nil {
+		return nil, err
+	}
+	items = make([]Image, len(entities))
+	for i := range entities {
+		items[i] = entities[i].image()
+	}
+
+	// Add list of images to memcache
+	memcache.Gob.Set(s.c, &memcache.Item{
+		Key:    mcKey,
+		Object: items,
+	})
+	return items, nil
+}
+
+func (s appengineImages) ByBlobkey(blobkey string) (*Image, error) {
+	q := datastore.NewQuery("Images").
+		Filter("Blobkey =", appengine.BlobKey(blobkey)).
+		Limit(1)
+	var entities []imageEntity
+	if _, err := q.GetAll(s.c, &entities); err != nil {
+		return nil, err
+	}
+	if len(entities) == 0 {
+		return nil, ErrNotFound
+	}
+	img := entities[0].image()
+	return &img, nil
+}
+
+func (s appengineImages) Delete(ownerID, blobkey string) error {
+	itemKey := GenID(blobkey, ownerID)
+	key := datastore.NewKey(s.c, "Images", itemKey, 0, nil)
+	if err := datastore.Delete(s.c, key); err != nil {
+		return err
+	}
+	memcache.Delete(s.c, "pics_"+ownerID)
+	err := memcache.Delete(s.c, itemKey)
+	if err == memcache.ErrCacheMiss {
+		return nil
+	}
+	return err
+}
+
+// appengineTokens keeps the tokens in the datastore, and in memcache
+// as they are checked on every request made with them.
+type appengineTokens struct {
+	c appengine.Context
+}
+
+func (s appengineTokens) Put(t *Token) error {
+	key := datastore.NewKey(s.c, "Tokens", t.ID, 0, nil)
+	if _, err := datastore.Put(s.c, key, t); err != nil {
+		return err
+	}
+	memcache.Delete(s.c, "token_"+t.ID)
+	return nil
+}
+
+func (s appengineTokens) Get(id string) (*Token, error) {
+	t := &Token{}
+	if _, err := memcache.Gob.Get(s.c, "token_"+id, t); err == nil {
+		return t, nil
+	}
+	err := datastore.Get(s.c, datastore.NewKey(s.c, "Tokens", id, 0, nil), t)
+	if err == datastore.ErrNoSuchEntity {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	memcache.Gob.Set(s.c, &memcache.Item{
+		Key:    "token_" + id,
+		Object: t,
+	})
+	return t, nil
+}
+
+func (s appengineTokens) OfUser(ownerID string) ([]Token, error) {
+	q := datastore.NewQuery("Tokens").
+		Filter("OwnerID =", ownerID).
+		Order("-CreationTime")
+	var items []Token
+	_, err := q.GetAll(s.c, &items)
+	return items, err
+}
+
+func (s appengineTokens) Delete(id string) error {
+	if err := datastore.Delete(s.c, datastore.NewKey(s.c, "Tokens", id, 0, nil)); err != nil {
+		return err
+	}
+	memcache.Delete(s.c, "token_"+id)
+	return nil
+}
+
+type appengineShares struct {
+	c appengine.Context
+}
+
+func (s appengineShares) Put(sh *Share) error {
+	_, err := datastore.Put(s.c, datastore.NewKey(s.c, "Shares", sh.ID, 0, nil), sh)
+	return err
+}
+
+func (s appengineShares) Get(id string) (*Share, error) {
+	sh := &Share{}
+	err := datastore.Get(s.c, datastore.NewKey(s.c, "Shares", id, 0, nil), sh)
+	if err == datastore.ErrNoSuchEntity {
+		return nil, ErrNotFound
+	}
+	return sh, err
+}
+
+func (s appengineShares) OfUser(ownerID string) ([]Share, error) {
+	q := datastore.NewQuery("Shares").
+		Filter("OwnerID =", ownerID).
+		Order("-CreationTime")
+	var items []Share
+	_, err := q.GetAll(s.c, &items)
+	return items, err
+}
+
+type appengineAlbums struct {
+	c appengine.Context
+}
+
+func (s appengineAlbums) key(ownerID, id string) *datastore.Key {
+	return datastore.NewKey(s.c, "Albums", ownerID+"_"+id, 0, nil)
+}
+
+func (s appengineAlbums) Put(a *Album) error {
+	_, err := datastore.Put(s.c, s.key(a.OwnerID, a.ID), a)
+	return err
+}
+
+func (s appengineAlbums) Get(ownerID, id string) (*Album, error) {
+	a := &Album{}
+	err := datastore.Get(s.c, s.key(ownerID, id), a)
+	if err == datastore.ErrNoSuchEntity {
+		return nil, ErrNotFound
+	}
+	return a, err
+}
+
+func (s appengineAlbums) OfUser(ownerID string) ([]Album, error) {
+	q := datastore.NewQuery("Albums").
+		Filter("OwnerID =", ownerID).
+		Order("-CreationTime")
+	var items []Album
+	_, err := q.GetAll(s.c, &items)
+	return items, err
+}
+
+func (s appengineAlbums) Delete(ownerID, id string) error {
+	return datastore.Delete(s.c, s.key(ownerID, id))
+}
+
+// appengineVersions saves the versions as Versions entities, children
+// of the entity of their image.
+type appengineVersions struct {
+	c appengine.Context
+}
+
+func (s appengineVersions) parent(ownerID, blobkey string) *datastore.Key {
+	return datastore.NewKey(s.c, "Images", GenID(blobkey, ownerID), 0, nil)
+}
+
+func (s appengineVersions) key(ownerID, blobkey, id string) *datastore.Key {
+	return datastore.NewKey(s.c, "Versions", id, 0, s.parent(ownerID, blobkey))
+}
+
+func (s appengineVersions) Put(v *Version) error {
+	_, err := datastore.Put(s.c, s.key(v.OwnerID, v.Blobkey, v.ID), v)
+	return err
+}
+
+func (s appengineVersions) Get(ownerID, blobkey, id string) (*Version, error) {
+	v := &Version{}
+	err := datastore.Get(s.c, s.key(ownerID, blobkey, id), v)
+	if err == datastore.ErrNoSuchEntity {
+		return nil, ErrNotFound
+	}
+	return v, err
+}
+
+func (s appengineVersions) OfImage(ownerID, blobkey string) ([]Version, error) {
+	q := datastore.NewQuery("Versions").
+		Ancestor(s.parent(ownerID, blobkey)).
+		Order("-CreationTime")
+	var items []Version
+	_, err := q.GetAll(s.c, &items)
+	return items, err
+}
+
+func (s appengineVersions) Delete(ownerID, blobkey, id string) error {
+	return datastore.Delete(s.c, s.key(ownerID, blobkey, id))
+}
+
+// appengineAssets saves the assets as Assets entities, by owner and
+// blob key.
+type appengineAssets struct {
+	c appengine.Context
+}
+
+func (s appengineAssets) key(ownerID, blobkey string) *datastore.Key {
+	return datastore.NewKey(s.c, "Assets", ownerID+"_"+blobkey, 0, nil)
+}
+
+func (s appengineAssets) Put(a *Asset) error {
+	_, err := datastore.Put(s.c, s.key(a.OwnerID, a.Blobkey), a)
+	return err
+}
+
+func (s appengineAssets) Get(ownerID, blobkey string) (*Asset, error) {
+	a := &Asset{}
+	err := datastore.Get(s.c, s.key(ownerID, blobkey), a)
+	if err == datastore.ErrNoSuchEntity {
+		return nil, ErrNotFound
+	}
+	return a, err
+}
+
+func (s appengineAssets) OfUser(ownerID string) ([]Asset, error) {
+	q := datastore.NewQuery("Assets").
+		Filter("OwnerID =", ownerID).
+		Order("-CreationTime")
+	var items []Asset
+	_, err := q.GetAll(s.c, &items)
+	return items, err
+}
+
+func (s appengineAssets) Delete(ownerID, blobkey string) error {
+	return datastore.Delete(s.c, s.key(ownerID, blobkey))
+}
+
+// appengineQuotas saves the tiers as UserTiers entities, by user, and
+// the renders as Renders entities, by user and day.
+type appengineQuotas struct {
+	c appengine.Context
+}
+
+type userTierEntity struct {
+	Tier string
+}
+
+type rendersEntity struct {
+	Count int
+}
+
+func (s appengineQuotas) Tier(ownerID string) (string, error) {
+	var e userTierEntity
+	err := datastore.Get(s.c, datastore.NewKey(s.c, "UserTiers", ownerID, 0, nil), &e)
+	if err == datastore.ErrNoSuchEntity {
+		return "", nil
+	}
+	return e.Tier, err
+}
+
+func (s appengineQuotas) SetTier(ownerID, tier string) error {
+	_, err := datastore.Put(s.c, datastore.NewKey(s.c, "UserTiers", ownerID, 0, nil), &userTierEntity{tier})
+	return err
+}
+
+func (s appengineQuotas) Tiers() (map[string]string, error) {
+	var entities []userTierEntity
+	keys, err := datastore.NewQuery("UserTiers").GetAll(s.c, &entities)
+	if err != nil {
+		return nil, err
+	}
+	res := make(map[string]string)
+	for i, k := range keys {
+		res[k.StringID()] = entities[i].Tier
+	}
+	return res, nil
+}
+
+func (s appengineQuotas) rendersKey(ownerID, day string) *datastore.Key {
+	return datastore.NewKey(s.c, "Renders", ownerID+"_"+day, 0, nil)
+}
+
+func (s appengineQuotas) Renders(ownerID, day string) (int, error) {
+	var e rendersEntity
+	err := datastore.Get(s.c, s.rendersKey(ownerID, day), &e)
+	if err == datastore.ErrNoSuchEntity {
+		return 0, nil
+	}
+	return e.Count, err
+}
+
+func (s appengineQuotas) AddRenders(ownerID, day string, n int) (int, error) {
+	total, _, err := s.addRenders(ownerID, day, n, 0)
+	return total, err
+}
+
+func (s appengineQuotas) ReserveRender(ownerID, day string, max int) (bool, error) {
+	_, ok, err := s.addRenders(ownerID, day, 1, max)
+	return ok, err
+}
+
+// addRenders adds n to the renders of the user on day, unless that
+// goes over max.
+func (s appengineQuotas) addRenders(ownerID, day string, n, max int) (int, bool, error) {
+	var e rendersEntity
+	added := false
+	err := datastore.RunInTransaction(s.c, func(c appengine.Context) error {
+		key := s.rendersKey(ownerID, day)
+		e = rendersEntity{}
+		added = false
+		if err := datastore.Get(c, key, &e); err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		if max > 0 && e.Count+n > max {
+			return nil
+		}
+		e.Count += n
+		added = true
+		_, err := datastore.Put(c, key, &e)
+		return err
+	}, nil)
+	return e.Count, added, err
+}
+
+type appengineBlobs struct {
+	c appengine.Context
+}
+
+func (s appengineBlobs) UploadURL(successPath string) (string, error) {
+	u, err := blobstore.UploadURL(s.c, successPath, nil)
+	if err != nil {
+		return "", err
+	}
+	return u.Path, nil
+}
+
+func (s appengineBlobs) ParseUpload(r *http.Request) (map[string][]*BlobInfo, url.Values, error) {
+	blobs, other, err := blobstore.ParseUpload(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	res := make(map[string][]*BlobInfo)
+	for field, infos := range blobs {
+		for _, b := range infos {
+			res[field] = append(res[field], &BlobInfo{
+				Key:          string(b.BlobKey),
+				ContentType:  b.ContentType,
+				CreationTime: b.CreationTime,
+				Filename:     b.Filename,
+				Size:         b.Size,
+				MD5:          b.MD5,
+			})
+		}
+	}
+	return res, other, nil
+}
+
+func (s appengineBlobs) Open(key string) (io.ReadCloser, error) {
+	return ioutil.NopCloser(blobstore.NewReader(s.c, appengine.BlobKey(key))), nil
+}
+
+func (s appengineBlobs) Put(contentType string, data []byte) (string, error) {
+	w, err := blobstore.Create(s.c, contentType)
+	if err != nil {
+		return "", err
+	}
+	if _, err := w.Write(data); err != nil {
+		return "", err
+	}
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+	key, err := w.Key()
+	return string(key), err
+}
+
+func (s appengineBlobs) Delete(key string) error {
+	return blobstore.Delete(s.c, appengine.BlobKey(key))
+}
+
+type appengineCache struct {
+	c appengine.Context
+}
+
+// maxMemcacheItem is the largest value memcache accepts.
+const maxMemcacheItem = 1000*1000 - 300
+
+func (s appengineCache) Get(key string) ([]byte, error) {
+	item, err := memcache.Get(s.c, key)
+	if err == memcache.ErrCacheMiss {
+		return nil, ErrCacheMiss
+	} else if err != nil {
+		return nil, err
+	}
+	return item.Value, nil
+}
+
+func (s appengineCache) Set(key string, value []byte) error {
+	if len(value) >= maxMemcacheItem {
+		return nil
+	}
+	return memcache.Set(s.c, &memcache.Item{
+		Key:   key,
+		Value: value,
+	})
+}
+
+func (s appengineCache) Delete(key string) error {
+	err := memcache.Delete(s.c, key)
+	if err == memcache.ErrCacheMiss {
+		return nil
+	}
+	return err
+}
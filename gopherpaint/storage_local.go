@@ -0,0 +1,611 @@
+//go:build !appengine
+// +build !appengine
+
+package gopherpaint
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	bolt "go.etcd.io/bbolt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// LocalStorage keeps everything on the local machine: the records in
+// a BoltDB file, the blobs in a directory and the cache in memory.
+type LocalStorage struct {
+	dir   string
+	db    *bolt.DB
+	cache *LRUCache
+}
+
+var (
+	imagesBucket   = []byte("Images")
+	blobsBucket    = []byte("Blobs")
+	tokensBucket   = []byte("Tokens")
+	sharesBucket   = []byte("Shares")
+	albumsBucket   = []byte("Albums")
+	quotasBucket   = []byte("Quotas")
+	versionsBucket = []byte("Versions")
+	assetsBucket   = []byte("Assets")
+)
+
+// maxLocalUpload is the largest upload accepted by the local blob
+// store, of which up to maxUploadMemory is kept in memory while it's
+// parsed and the rest in temporary files.
+const (
+	maxLocalUpload  = 32 << 20
+	maxUploadMemory = 8 << 20
+)
+
+// NewLocalStorage opens, or creates, a local storage in dir. It caches
+// up to cacheBytes of data in memory.
+func NewLocalStorage(dir string, cacheBytes int64) (*LocalStorage, error) {
+	if err := os.MkdirAll(filepath.Join(dir, "blobs"), 0755); err != nil {
+		return nil, err
+	}
+	db, err := bolt.Open(filepath.Join(dir, "gopherpaint.db"), 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, b := range [][]byte{imagesBucket, blobsBucket, tokensBucket, sharesBucket, albumsBucket, quotasBucket, versionsBucket, assetsBucket} {
+			if _, err := tx.CreateBucketIfNotExists(b); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &LocalStorage{dir: dir, db: db, cache: NewLRUCache(cacheBytes)}, nil
+}
+
+// Close releases the database.
+func (l *LocalStorage) Close() error {
+	return l.db.Close()
+}
+
+// Storage returns the services of the local storage. The same Storage
+// serves every request.
+func (l *LocalStorage) Storage() *Storage {
+	return &Storage{
+		Images:   localImages{l},
+		Tokens:   localTokens{l},
+		Shares:   localShares{l},
+		Albums:   localAlbums{l},
+		Versions: localVersions{l},
+		Assets:   localAssets{l},
+		Quotas:   localQuotas{l},
+		Blobs:    localBlobs{l},
+		Cache:    l.cache,
+	}
+}
+
+// putJSON saves v in the bucket, encoded as JSON.
+func (l *LocalStorage) putJSON(bucket []byte, key string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return l.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucket).Put([]byte(key), data)
+	})
+}
+
+// getJSON loads a value saved by putJSON.
+func (l *LocalStorage) getJSON(bucket []byte, key string, v interface{}) error {
+	return l.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(bucket).Get([]byte(key))
+		if data == nil {
+			return ErrNotFound
+		}
+		return json.Unmarshal(data, v)
+	})
+}
+
+// deleteKey removes a key from the bucket.
+func (l *LocalStorage) deleteKey(bucket []byte, key string) error {
+	return l.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucket).Delete([]byte(key))
+	})
+}
+
+// eachPrefix calls f with the value of every key starting by prefix.
+func (l *LocalStorage) eachPrefix(bucket []byte, prefix string, f func(data []byte) error) error {
+	return l.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(bucket).Cursor()
+		p := []byte(prefix)
+		for k, v := c.Seek(p); k != nil && bytes.HasPrefix(k, p); k, v = c.Next() {
+			if err := f(v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+type localImages struct {
+	l *LocalStorage
+}
+
+// Images are saved by owner, so the images of an user are together.
+func localImageKey(ownerID, blobkey string) string {
+	return ownerID + "\x00" + blobkey
+}
+
+func (s localImages) Put(m *Image) error {
+	return s.l.putJSON(imagesBucket, localImageKey(m.OwnerID, m.Blobkey), m)
+}
+
+func (s localImages) Get(ownerID, blobkey string) (*Image, error) {
+	m := &Image{}
+	if err := s.l.getJSON(imagesBucket, localImageKey(ownerID, blobkey), m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (s localImages) OfUser(ownerID string) ([]Image, error) {
+	var items []Image
+	err := s.l.eachPrefix(imagesBucket, ownerID+"\x00", func(data []byte) error {
+		var m Image
+		if err := json.Unmarshal(data, &m); err != nil {
+			return err
+		}
+		items = append(items, m)
+		return nil
+	})
+	sort.Sort(byNewest(items))
+	return items, err
+}
+
+// ByBlobkey goes through every image.
+func (s localImages) ByBlobkey(blobkey string) (*Image, error) {
+	var res *Image
+	err := s.l.eachPrefix(imagesBucket, "", func(data []byte) error {
+		var m Image
+		if err := json.Unmarshal(data, &m); err != nil {
+			return err
+		}
+		if m.Blobkey == blobkey && res == nil {
+			res = &m
+		}
+		return nil
+	})
+	if err == nil && res == nil {
+		err = ErrNotFound
+	}
+	return res, err
+}
+
+func (s localImages) Delete(ownerID, blobkey string) error {
+	return s.l.deleteKey(imagesBucket, localImageKey(ownerID, blobkey))
+}
+
+type byNewest []Image
+
+func (b byNewest) Len() int           { return len(b) }
+func (b byNewest) Less(i, j int) bool { return b[i].CreationTime.After(b[j].CreationTime) }
+func (b byNewest) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+
+type localTokens struct {
+	l *LocalStorage
+}
+
+func (s localTokens) Put(t *Token) error {
+	return s.l.putJSON(tokensBucket, t.ID, t)
+}
+
+func (s localTokens) Get(id string) (*Token, error) {
+	t := &Token{}
+	if err := s.l.getJSON(tokensBucket, id, t); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// OfUser goes through every token, there are few of them.
+func (s localTokens) OfUser(ownerID string) ([]Token, error) {
+	var items []Token
+	err := s.l.eachPrefix(tokensBucket, "", func(data []byte) error {
+		var t Token
+		if err := json.Unmarshal(data, &t); err != nil {
+			return err
+		}
+		if t.OwnerID == ownerID {
+			items = append(items, t)
+		}
+		return nil
+	})
+	sort.Sort(tokensByNewest(items))
+	return items, err
+}
+
+func (s localTokens) Delete(id string) error {
+	return s.l.deleteKey(tokensBucket, id)
+}
+
+type tokensByNewest []Token
+
+func (b tokensByNewest) Len() int           { return len(b) }
+func (b tokensByNewest) Less(i, j int) bool { return b[i].CreationTime.After(b[j].CreationTime) }
+func (b tokensByNewest) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+
+type localShares struct {
+	l *LocalStorage
+}
+
+func (s localShares) Put(sh *Share) error {
+	return s.l.putJSON(sharesBucket, sh.ID, sh)
+}
+
+func (s localShares) Get(id string) (*Share, error) {
+	sh := &Share{}
+	if err := s.l.getJSON(sharesBucket, id, sh); err != nil {
+		return nil, err
+	}
+	return sh, nil
+}
+
+// OfUser goes through every share.
+func (s localShares) OfUser(ownerID string) ([]Share, error) {
+	var items []Share
+	err := s.l.eachPrefix(sharesBucket, "", func(data []byte) error {
+		var sh Share
+		if err := json.Unmarshal(data, &sh); err != nil {
+			return err
+		}
+		if sh.OwnerID == ownerID {
+			items = append(items, sh)
+		}
+		return nil
+	})
+	sort.Sort(sharesByNewest(items))
+	return items, err
+}
+
+type sharesByNewest []Share
+
+func (b sharesByNewest) Len() int           { return len(b) }
+func (b sharesByNewest) Less(i, j int) bool { return b[i].CreationTime.After(b[j].CreationTime) }
+func (b sharesByNewest) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+
+type localBlobs struct {
+	l *LocalStorage
+}
+
+func (s localBlobs) path(key string) string {
+	return filepath.Join(s.l.dir, "blobs", key)
+}
+
+// UploadURL is the success path itself, the form is posted directly
+// to the handler.
+func (s localBlobs) UploadURL(successPath string) (string, error) {
+	return successPath, nil
+}
+
+func (s localBlobs) ParseUpload(r *http.Request) (map[string][]*BlobInfo, url.Values, error) {
+	r.Body = http.MaxBytesReader(nil, r.Body, maxLocalUpload)
+	if err := r.ParseMultipartForm(maxUploadMemory); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			err = &apiError{http.StatusRequestEntityTooLarge, "upload_too_large",
+				fmt.Sprintf("uploads can have up to %d MB", maxLocalUpload>>20)}
+		}
+		return nil, nil, err
+	}
+	defer r.MultipartForm.RemoveAll()
+	res := make(map[string][]*BlobInfo)
+	for field, files := range r.MultipartForm.File {
+		for _, fh := range files {
+			info, err := s.store(fh)
+			if err != nil {
+				// Nobody gets the blobs already stored.
+				for _, infos := range res {
+					for _, info := range infos {
+						s.Delete(info.Key)
+					}
+				}
+				return nil, nil, err
+			}
+			res[field] = append(res[field], info)
+		}
+	}
+	return res, url.Values(r.MultipartForm.Value), nil
+}
+
+func (s localBlobs) store(fh *multipart.FileHeader) (*BlobInfo, error) {
+	f, err := fh.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := s.write(fh.Header.Get("Content-Type"), f)
+	if err != nil {
+		return nil, err
+	}
+	info.Filename = fh.Filename
+	if err := s.l.putJSON(blobsBucket, info.Key, info); err != nil {
+		os.Remove(s.path(info.Key))
+		return nil, err
+	}
+	return info, nil
+}
+
+// write copies r to a new blob file.
+func (s localBlobs) write(contentType string, r io.Reader) (*BlobInfo, error) {
+	info := &BlobInfo{
+		Key:          randomKey(16),
+		ContentType:  contentType,
+		CreationTime: time.Now(),
+	}
+	out, err := os.Create(s.path(info.Key))
+	if err != nil {
+		return nil, err
+	}
+	h := md5.New()
+	info.Size, err = io.Copy(io.MultiWriter(out, h), r)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		// A partial blob is no use to anyone.
+		os.Remove(s.path(info.Key))
+		return nil, err
+	}
+	info.MD5 = hex.EncodeToString(h.Sum(nil))
+	return info, nil
+}
+
+func (s localBlobs) Open(key string) (io.ReadCloser, error) {
+	if strings.ContainsAny(key, `/\.`) || key == "" {
+		return nil, ErrNotFound
+	}
+	f, err := os.Open(s.path(key))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	return f, err
+}
+
+func (s localBlobs) Put(contentType string, data []byte) (string, error) {
+	info, err := s.write(contentType, bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+	return info.Key, s.l.putJSON(blobsBucket, info.Key, info)
+}
+
+func (s localBlobs) Delete(key string) error {
+	if strings.ContainsAny(key, `/\.`) || key == "" {
+		return ErrNotFound
+	}
+	if err := os.Remove(s.path(key)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return s.l.deleteKey(blobsBucket, key)
+}
+
+type localAlbums struct {
+	l *LocalStorage
+}
+
+// Albums are saved by owner, like the images.
+func (s localAlbums) Put(a *Album) error {
+	return s.l.putJSON(albumsBucket, localImageKey(a.OwnerID, a.ID), a)
+}
+
+func (s localAlbums) Get(ownerID, id string) (*Album, error) {
+	a := &Album{}
+	if err := s.l.getJSON(albumsBucket, localImageKey(ownerID, id), a); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (s localAlbums) OfUser(ownerID string) ([]Album, error) {
+	var items []Album
+	err := s.l.eachPrefix(albumsBucket, ownerID+"\x00", func(data []byte) error {
+		var a Album
+		if err := json.Unmarshal(data, &a); err != nil {
+			return err
+		}
+		items = append(items, a)
+		return nil
+	})
+	sort.Sort(albumsByNewest(items))
+	return items, err
+}
+
+func (s localAlbums) Delete(ownerID, id string) error {
+	return s.l.deleteKey(albumsBucket, localImageKey(ownerID, id))
+}
+
+type albumsByNewest []Album
+
+func (b albumsByNewest) Len() int           { return len(b) }
+func (b albumsByNewest) Less(i, j int) bool { return b[i].CreationTime.After(b[j].CreationTime) }
+func (b albumsByNewest) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+
+// localVersions saves the versions in "<user>\x00<blobkey>\x00<id>",
+// so the history of an image can be walked.
+type localVersions struct {
+	l *LocalStorage
+}
+
+func (s localVersions) key(ownerID, blobkey, id string) string {
+	return localImageKey(ownerID, blobkey) + "\x00" + id
+}
+
+func (s localVersions) Put(v *Version) error {
+	return s.l.putJSON(versionsBucket, s.key(v.OwnerID, v.Blobkey, v.ID), v)
+}
+
+func (s localVersions) Get(ownerID, blobkey, id string) (*Version, error) {
+	v := &Version{}
+	if err := s.l.getJSON(versionsBucket, s.key(ownerID, blobkey, id), v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+func (s localVersions) OfImage(ownerID, blobkey string) ([]Version, error) {
+	var items []Version
+	err := s.l.eachPrefix(versionsBucket, s.key(ownerID, blobkey, ""), func(data []byte) error {
+		var v Version
+		if err := json.Unmarshal(data, &v); err != nil {
+			return err
+		}
+		items = append(items, v)
+		return nil
+	})
+	sort.Sort(versionsByNewest(items))
+	return items, err
+}
+
+func (s localVersions) Delete(ownerID, blobkey, id string) error {
+	return s.l.deleteKey(versionsBucket, s.key(ownerID, blobkey, id))
+}
+
+type versionsByNewest []Version
+
+func (b versionsByNewest) Len() int           { return len(b) }
+func (b versionsByNewest) Less(i, j int) bool { return b[i].CreationTime.After(b[j].CreationTime) }
+func (b versionsByNewest) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+
+type localAssets struct {
+	l *LocalStorage
+}
+
+// Assets are saved by owner, like the images.
+func (s localAssets) Put(a *Asset) error {
+	return s.l.putJSON(assetsBucket, localImageKey(a.OwnerID, a.Blobkey), a)
+}
+
+func (s localAssets) Get(ownerID, blobkey string) (*Asset, error) {
+	a := &Asset{}
+	if err := s.l.getJSON(assetsBucket, localImageKey(ownerID, blobkey), a); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (s localAssets) OfUser(ownerID string) ([]Asset, error) {
+	var items []Asset
+	err := s.l.eachPrefix(assetsBucket, ownerID+"\x00", func(data []byte) error {
+		var a Asset
+		if err := json.Unmarshal(data, &a); err != nil {
+			return err
+		}
+		items = append(items, a)
+		return nil
+	})
+	sort.Sort(assetsByNewest(items))
+	return items, err
+}
+
+func (s localAssets) Delete(ownerID, blobkey string) error {
+	return s.l.deleteKey(assetsBucket, localImageKey(ownerID, blobkey))
+}
+
+type assetsByNewest []Asset
+
+func (b assetsByNewest) Len() int           { return len(b) }
+func (b assetsByNewest) Less(i, j int) bool { return b[i].CreationTime.After(b[j].CreationTime) }
+func (b assetsByNewest) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+
+// localQuotas saves the tier of a user in "tier\x00<user>" and the
+// renders of a day in "renders\x00<user>\x00<day>".
+type localQuotas struct {
+	l *LocalStorage
+}
+
+func (s localQuotas) Tier(ownerID string) (string, error) {
+	var tier string
+	err := s.l.getJSON(quotasBucket, "tier\x00"+ownerID, &tier)
+	if err == ErrNotFound {
+		return "", nil
+	}
+	return tier, err
+}
+
+func (s localQuotas) SetTier(ownerID, tier string) error {
+	return s.l.putJSON(quotasBucket, "tier\x00"+ownerID, tier)
+}
+
+func (s localQuotas) Tiers() (map[string]string, error) {
+	res := make(map[string]string)
+	err := s.l.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(quotasBucket).Cursor()
+		p := []byte("tier\x00")
+		for k, v := c.Seek(p); k != nil && bytes.HasPrefix(k, p); k, v = c.Next() {
+			var tier string
+			if err := json.Unmarshal(v, &tier); err != nil {
+				return err
+			}
+			res[string(k[len(p):])] = tier
+		}
+		return nil
+	})
+	return res, err
+}
+
+func (s localQuotas) Renders(ownerID, day string) (int, error) {
+	var n int
+	err := s.l.getJSON(quotasBucket, "renders\x00"+ownerID+"\x00"+day, &n)
+	if err == ErrNotFound {
+		return 0, nil
+	}
+	return n, err
+}
+
+func (s localQuotas) AddRenders(ownerID, day string, n int) (int, error) {
+	total, _, err := s.addRenders(ownerID, day, n, 0)
+	return total, err
+}
+
+func (s localQuotas) ReserveRender(ownerID, day string, max int) (bool, error) {
+	_, ok, err := s.addRenders(ownerID, day, 1, max)
+	return ok, err
+}
+
+// addRenders adds n to the renders of the user on day, unless that
+// goes over max.
+func (s localQuotas) addRenders(ownerID, day string, n, max int) (int, bool, error) {
+	key := []byte("renders\x00" + ownerID + "\x00" + day)
+	var total int
+	added := false
+	err := s.l.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(quotasBucket)
+		if data := b.Get(key); data != nil {
+			if err := json.Unmarshal(data, &total); err != nil {
+				return err
+			}
+		}
+		if max > 0 && total+n > max {
+			return nil
+		}
+		total += n
+		added = true
+		data, err := json.Marshal(total)
+		if err != nil {
+			return err
+		}
+		return b.Put(key, data)
+	})
+	return total, added, err
+}
@@ -0,0 +1,154 @@
+//go:build !appengine
+// +build !appengine
+
+package gopherpaint
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestStorage(t *testing.T) (*Storage, func()) {
+	dir, err := ioutil.TempDir("", "gopherpaint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := NewLocalStorage(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l.Storage(), func() {
+		l.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestLocalImages(t *testing.T) {
+	st, done := newTestStorage(t)
+	defer done()
+
+	now := time.Now()
+	st.Images.Put(&Image{OwnerID: "a", Blobkey: "old", CreationTime: now.Add(-time.Hour)})
+	st.Images.Put(&Image{OwnerID: "a", Blobkey: "new", CreationTime: now})
+	st.Images.Put(&Image{OwnerID: "b", Blobkey: "other", CreationTime: now})
+
+	pics, err := st.Images.OfUser("a")
+	if err != nil || len(pics) != 2 || pics[0].Blobkey != "new" {
+		t.Errorf("Expected [new old], given %v (%v)", pics, err)
+	}
+	if _, err := st.Images.Get("b", "old"); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound, given %v", err)
+	}
+
+	if err := Images_UpdateStyle(st, "a", "old", "voronoi", "dither=1"); err != nil {
+		t.Fatal(err)
+	}
+	m, err := st.Images.Get("a", "old")
+	if err != nil || m.Style != "voronoi" || m.Params != "dither=1" {
+		t.Errorf("Expected updated style, given %v (%v)", m, err)
+	}
+
+	if err := Images_Delete(st, "a", "old"); err != nil {
+		t.Fatal(err)
+	}
+	if pics, _ := st.Images.OfUser("a"); len(pics) != 1 {
+		t.Errorf("Expected 1 image, given %v", pics)
+	}
+}
+
+func TestLocalBlobs(t *testing.T) {
+	st, done := newTestStorage(t)
+	defer done()
+
+	key, err := st.Blobs.Put("text/plain", []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := st.Blobs.Open(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadAll(r)
+	r.Close()
+	if string(data) != "hello" {
+		t.Errorf("Expected hello, given %q", data)
+	}
+
+	if _, err := st.Blobs.Open("../gopherpaint.db"); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound, given %v", err)
+	}
+	st.Blobs.Delete(key)
+	if _, err := st.Blobs.Open(key); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound, given %v", err)
+	}
+}
+
+// failingReader returns an error after some data.
+type failingReader struct{ n int }
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if r.n <= 0 {
+		return 0, errors.New("connection reset")
+	}
+	r.n -= len(p)
+	return len(p), nil
+}
+
+func TestLocalUploadLimits(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gopherpaint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	l, err := NewLocalStorage(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	blobs := l.Storage().Blobs
+
+	body := &bytes.Buffer{}
+	mw := multipart.NewWriter(body)
+	fw, _ := mw.CreateFormFile("file", "big.png")
+	fw.Write(make([]byte, maxLocalUpload+1))
+	mw.Close()
+	r := httptest.NewRequest("POST", "/upload", body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	if _, _, err := blobs.ParseUpload(r); errorStatus(err) != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected an upload over the limit refused, given %v", err)
+	}
+
+	if _, err := (localBlobs{l}).write("image/png", &failingReader{1000}); err == nil {
+		t.Errorf("Expected the error of the reader")
+	}
+	if files, _ := ioutil.ReadDir(filepath.Join(dir, "blobs")); len(files) != 0 {
+		t.Errorf("Expected no blobs left behind, given %v files", len(files))
+	}
+}
+
+func TestLRUCache(t *testing.T) {
+	c := NewLRUCache(10)
+	c.Set("a", []byte("aaaa"))
+	c.Set("b", []byte("bbbb"))
+	c.Get("a")
+	c.Set("c", []byte("cccc"))
+
+	if _, err := c.Get("b"); err != ErrCacheMiss {
+		t.Errorf("Expected b to be evicted")
+	}
+	if v, err := c.Get("a"); err != nil || string(v) != "aaaa" {
+		t.Errorf("Expected aaaa, given %q (%v)", v, err)
+	}
+	c.Set("big", make([]byte, 11))
+	if _, err := c.Get("big"); err != ErrCacheMiss {
+		t.Errorf("Expected values over the limit not to be cached")
+	}
+}
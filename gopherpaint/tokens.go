@@ -0,0 +1,170 @@
+package gopherpaint
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Scopes of the API tokens, each one allows some of the requests.
+const (
+	ScopeRead   = "read"
+	ScopeUpload = "upload"
+	ScopeRender = "render"
+	ScopeDelete = "delete"
+	// Changes to the saved styles, versions and albums.
+	ScopeWrite = "write"
+	// Changes to who can see the images: shares and visibility.
+	ScopeShare = "share"
+)
+
+// Scopes lists every scope a token can have.
+var Scopes = []string{ScopeRead, ScopeUpload, ScopeRender, ScopeDelete, ScopeWrite, ScopeShare}
+
+// scopeAccount is needed to manage the tokens. No token has it, so
+// only browser sessions can.
+const scopeAccount = "account"
+
+// tokenPrefix starts every token, so they are easy to spot in logs
+// and config files.
+const tokenPrefix = "gpt_"
+
+// lastUsedResolution is how often the last use of a token is saved.
+const lastUsedResolution = time.Hour
+
+// Token is a personal API token. Only the hash of the token is saved,
+// the user sees it once when it is created.
+type Token struct {
+	ID           string
+	OwnerID      string
+	Name         string
+	Hash         string
+	Scopes       []string
+	CreationTime time.Time
+	LastUsed     time.Time
+}
+
+// NewToken creates a token for the user, and returns it with its
+// secret value.
+func NewToken(ownerID, name string, scopes []string) (*Token, string) {
+	t := &Token{
+		ID:           randomKey(8),
+		OwnerID:      ownerID,
+		Name:         name,
+		Scopes:       scopes,
+		CreationTime: time.Now(),
+	}
+	secret := tokenPrefix + t.ID + "_" + randomKey(24)
+	t.Hash = hashToken(secret)
+	return t, secret
+}
+
+func hashToken(secret string) string {
+	h := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(h[:])
+}
+
+// HasScope tells if the token allows the requests of scope.
+func (t *Token) HasScope(scope string) bool {
+	for _, s := range t.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// validScope tells if scope is one of Scopes.
+func validScope(scope string) bool {
+	for _, s := range Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// bearerToken returns the token in the Authorization header.
+func bearerToken(r *http.Request) (string, bool) {
+	h := r.Header.Get("Authorization")
+	if !strings.HasPrefix(h, "Bearer ") {
+		return "", false
+	}
+	return strings.TrimSpace(h[len("Bearer "):]), true
+}
+
+// checkToken returns the stored token matching secret.
+func checkToken(repo TokenRepository, secret string) (*Token, error) {
+	rest := strings.TrimPrefix(secret, tokenPrefix)
+	i := strings.Index(rest, "_")
+	if rest == secret || i < 0 {
+		return nil, ErrNotFound
+	}
+	t, err := repo.Get(rest[:i])
+	if err != nil {
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare([]byte(t.Hash), []byte(hashToken(secret))) != 1 {
+		return nil, ErrNotFound
+	}
+	if time.Since(t.LastUsed) > lastUsedResolution {
+		t.LastUsed = time.Now()
+		repo.Put(t)
+	}
+	return t, nil
+}
+
+// tokenAuth signs in the requests with a bearer token, the rest are
+// given to next.
+type tokenAuth struct {
+	next Authenticator
+}
+
+func (a tokenAuth) Current(r *http.Request) *User {
+	secret, ok := bearerToken(r)
+	if !ok {
+		return a.next.Current(r)
+	}
+	t, err := checkToken(storageFor(r).Tokens, secret)
+	if err != nil {
+		return nil
+	}
+	return &User{ID: t.OwnerID, Name: t.OwnerID, Token: t}
+}
+
+func (a tokenAuth) LoginURL(r *http.Request, dest string) (string, error) {
+	return a.next.LoginURL(r, dest)
+}
+
+func (a tokenAuth) LogoutURL(r *http.Request, dest string) (string, error) {
+	return a.next.LogoutURL(r, dest)
+}
+
+// RegisterHandlers adds the handlers of next, if any.
+func (a tokenAuth) RegisterHandlers(mux *http.ServeMux) {
+	if h, ok := a.next.(HandlerAuthenticator); ok {
+		h.RegisterHandlers(mux)
+	}
+}
+
+// withScope rejects the requests made with a token that doesn't have
+// scope. Requests without a token go to h.
+func withScope(scope string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := bearerToken(r); ok {
+			u := auth.Current(r)
+			if u == nil {
+				http.Error(w, "invalid token", http.StatusUnauthorized)
+				return
+			}
+			if !u.Can(scope) {
+				http.Error(w, "the token doesn't allow "+scope, http.StatusForbidden)
+				return
+			}
+		}
+		h(w, r)
+	}
+}
@@ -0,0 +1,148 @@
+package gopherpaint
+
+import (
+	"bufio"
+	"bytes"
+	"filters"
+	"fmt"
+	"image"
+	"net/http"
+)
+
+// imageFormats are the formats accepted on upload, by the magic bytes
+// their files start with. A ? in the magic matches any byte.
+var imageFormats = []struct {
+	Name  string
+	Magic string
+}{
+	{"jpeg", "\xff\xd8\xff"},
+	{"png", "\x89PNG\r\n\x1a\n"},
+	{"gif", "GIF87a"},
+	{"gif", "GIF89a"},
+	{"tiff", "II*\x00"},
+	{"tiff", "MM\x00*"},
+	{"bmp", "BM"},
+	{"webp", "RIFF????WEBPVP8"},
+}
+
+// heicBrands are the brands of the HEIF containers used for HEIC photos.
+// There is no pure Go HEVC decoder, so they are refused with a hint.
+var heicBrands = []string{"heic", "heix", "hevc", "hevx", "heim", "heis", "mif1", "msf1"}
+
+// formatNames are the accepted formats, as told to the users.
+const formatNames = "JPEG, PNG, GIF, TIFF, BMP or WebP"
+
+// Uploads with more pixels, or a longer side, are refused before they
+// are decoded. Animations are also refused when the frames that are
+// painted add up to more than maxAnimationPixels.
+var (
+	maxImagePixels     = 50 * 1000 * 1000
+	maxImageSide       = 16384
+	maxAnimationPixels = 100 * 1000 * 1000
+)
+
+// sniffFormat returns the name of the format of a file that starts
+// with header, or "" if it isn't accepted.
+func sniffFormat(header []byte) string {
+	for _, f := range imageFormats {
+		if matchMagic(header, f.Magic) {
+			return f.Name
+		}
+	}
+	return ""
+}
+
+func matchMagic(header []byte, magic string) bool {
+	if len(header) < len(magic) {
+		return false
+	}
+	for i := 0; i < len(magic); i++ {
+		if magic[i] != '?' && magic[i] != header[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// isHEIC tells if the file that starts with header is a HEIC photo.
+func isHEIC(header []byte) bool {
+	if len(header) < 12 || !bytes.Equal(header[4:8], []byte("ftyp")) {
+		return false
+	}
+	for _, brand := range heicBrands {
+		if string(header[8:12]) == brand {
+			return true
+		}
+	}
+	return false
+}
+
+// invalidImage reports an upload refused for its content.
+func invalidImage(status int, code, format string, args ...interface{}) *apiError {
+	return &apiError{status, code, fmt.Sprintf(format, args...)}
+}
+
+// imageFailed is the error of rendering an image that can't be read.
+func imageFailed(reason string) *apiError {
+	return &apiError{http.StatusUnprocessableEntity, "image_failed", reason}
+}
+
+// validateBlob checks an uploaded blob before it becomes an image. Files
+// that aren't of an accepted format or are too large are refused with an
+// error. For files that look right but whose header can't be read, it
+// returns the reason the image can't be used.
+func validateBlob(st *Storage, key string) (reason string, err error) {
+	rc, err := st.Blobs.Open(key)
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+	br := bufio.NewReader(rc)
+	header, _ := br.Peek(16)
+	if isHEIC(header) {
+		return "", invalidImage(http.StatusUnsupportedMediaType, "unsupported_heic",
+			"HEIC photos aren't supported, please export them as JPEG first")
+	}
+	format := sniffFormat(header)
+	if format == "" {
+		return "", invalidImage(http.StatusUnsupportedMediaType, "unsupported_format",
+			"the file isn't a %s image", formatNames)
+	}
+	cfg, decoded, err := image.DecodeConfig(br)
+	if err != nil {
+		return fmt.Sprintf("the %s file is damaged: %v", format, err), nil
+	}
+	if decoded != format {
+		return fmt.Sprintf("the file looks like %s but decodes as %s", format, decoded), nil
+	}
+	if cfg.Width <= 0 || cfg.Height <= 0 {
+		return "the image is empty", nil
+	}
+	if cfg.Width > maxImageSide || cfg.Height > maxImageSide || cfg.Width*cfg.Height > maxImagePixels {
+		return "", invalidImage(http.StatusRequestEntityTooLarge, "image_too_large",
+			"the image is %dx%d, images can have up to %d pixels per side and %d megapixels",
+			cfg.Width, cfg.Height, maxImageSide, maxImagePixels/1000000)
+	}
+	if format == "gif" {
+		return validateAnimation(st, key, cfg)
+	}
+	return "", nil
+}
+
+// validateAnimation counts the frames of a GIF, without decoding them,
+// and refuses it if they are too many for their size. Damaged frames
+// are left for the render to find, like with the other formats.
+func validateAnimation(st *Storage, key string, cfg image.Config) (reason string, err error) {
+	rc, err := st.Blobs.Open(key)
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+	frames, _ := filters.CountGIFFrames(rc)
+	if frames*cfg.Width*cfg.Height > maxAnimationPixels {
+		return "", invalidImage(http.StatusRequestEntityTooLarge, "image_too_large",
+			"the animation has %d frames of %dx%d, animations can have up to %d megapixels in all their frames",
+			frames, cfg.Width, cfg.Height, maxAnimationPixels/1000000)
+	}
+	return "", nil
+}
@@ -0,0 +1,130 @@
+//go:build !appengine
+// +build !appengine
+
+package gopherpaint
+
+import (
+	"bytes"
+	"encoding/json"
+	"golang.org/x/image/bmp"
+	"golang.org/x/image/tiff"
+	"image"
+	"image/png"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// uploadFile uploads data as the file of an image.
+func uploadFile(mux *http.ServeMux, user string, data []byte) *httptest.ResponseRecorder {
+	body := &bytes.Buffer{}
+	mw := multipart.NewWriter(body)
+	fw, _ := mw.CreateFormFile("file", "photo")
+	fw.Write(data)
+	mw.Close()
+	return apiDo(mux, "POST", "/api/v1/images", user, body, mw.FormDataContentType())
+}
+
+func TestSniffFormat(t *testing.T) {
+	tests := map[string]string{
+		"\xff\xd8\xff\xe0\x00\x10JFIF": "jpeg",
+		"\x89PNG\r\n\x1a\n\x00":        "png",
+		"GIF89a\x01\x00":               "gif",
+		"GIF87a":                       "gif",
+		"II*\x00\x08\x00":              "tiff",
+		"MM\x00*\x00\x00":              "tiff",
+		"BM6\x00\x00\x00":              "bmp",
+		"RIFF\x10\x00\x00\x00WEBPVP8L": "webp",
+		"RIFF\x10\x00\x00\x00WAVEfmt ": "",
+		"<svg xmlns=":                  "",
+		"\x89PNG":                      "",
+		"":                             "",
+	}
+	for header, expected := range tests {
+		if given := sniffFormat([]byte(header)); given != expected {
+			t.Errorf("%q: expected %q, given %q", header, expected, given)
+		}
+	}
+}
+
+func TestUploadValidation(t *testing.T) {
+	mux, st, done := setupAPITest(t)
+	defer done()
+	good := &bytes.Buffer{}
+	png.Encode(good, testImage())
+
+	if w := uploadFile(mux, "a", []byte("<html>not an image</html>")); w.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("Expected 415 for HTML, given %v %s", w.Code, w.Body)
+	}
+	heic := []byte("\x00\x00\x00\x18ftypheic\x00\x00\x00\x00mif1heic")
+	if w := uploadFile(mux, "a", heic); w.Code != http.StatusUnsupportedMediaType || !strings.Contains(w.Body.String(), "unsupported_heic") {
+		t.Errorf("Expected HEIC refused with its own code, given %v %s", w.Code, w.Body)
+	}
+	maxImageSide = 8
+	w := uploadFile(mux, "a", good.Bytes())
+	maxImageSide = 16384
+	if w.Code != http.StatusRequestEntityTooLarge || !strings.Contains(w.Body.String(), "16x16") {
+		t.Errorf("Expected 413 for a large image, given %v %s", w.Code, w.Body)
+	}
+	maxAnimationPixels = 1000
+	w = uploadFile(mux, "a", testAnimation())
+	maxAnimationPixels = 100 * 1000 * 1000
+	if w.Code != http.StatusRequestEntityTooLarge || !strings.Contains(w.Body.String(), "3 frames of 24x16") {
+		t.Errorf("Expected 413 for a large animation, given %v %s", w.Code, w.Body)
+	}
+	if pics, _ := st.Images.OfUser("a"); len(pics) != 0 {
+		t.Errorf("Expected the refused uploads not saved, given %v images", len(pics))
+	}
+
+	// A damaged header is saved as failed.
+	w = uploadFile(mux, "a", []byte("\x89PNG\r\n\x1a\ngarbage"))
+	damaged := &apiImage{}
+	json.Unmarshal(w.Body.Bytes(), damaged)
+	if w.Code != http.StatusCreated || damaged.Status != ImageFailed || damaged.FailReason == "" {
+		t.Errorf("Expected the image saved as failed, given %v %s", w.Code, w.Body)
+	}
+	if w = apiDo(mux, "GET", "/render?blobKey="+damaged.ID, "a", nil, ""); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected 422 rendering a failed image, given %v", w.Code)
+	}
+
+	// A file cut after the header fails when rendered, once.
+	w = uploadFile(mux, "a", good.Bytes()[:good.Len()/2])
+	cut := &apiImage{}
+	json.Unmarshal(w.Body.Bytes(), cut)
+	if cut.Status != "ready" {
+		t.Fatalf("Expected a readable header, given %s", w.Body)
+	}
+	if w = apiDo(mux, "GET", "/render?blobKey="+cut.ID, "a", nil, ""); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected 422 rendering a cut image, given %v", w.Code)
+	}
+	if m, _ := st.Images.Get("a", cut.ID); m == nil || !m.Failed() {
+		t.Errorf("Expected the cut image marked as failed, given %+v", m)
+	}
+}
+
+func TestUploadFormats(t *testing.T) {
+	mux, _, done := setupAPITest(t)
+	defer done()
+	encoders := map[string]func(w *bytes.Buffer, m image.Image) error{
+		"bmp":  func(w *bytes.Buffer, m image.Image) error { return bmp.Encode(w, m) },
+		"tiff": func(w *bytes.Buffer, m image.Image) error { return tiff.Encode(w, m, nil) },
+	}
+	for name, encode := range encoders {
+		data := &bytes.Buffer{}
+		if err := encode(data, testImage()); err != nil {
+			t.Fatal(err)
+		}
+		w := uploadFile(mux, "a", data.Bytes())
+		m := &apiImage{}
+		json.Unmarshal(w.Body.Bytes(), m)
+		if w.Code != http.StatusCreated || m.Status != "ready" {
+			t.Errorf("%v: expected the image accepted, given %v %s", name, w.Code, w.Body)
+			continue
+		}
+		if w = apiDo(mux, "GET", "/render?blobKey="+m.ID+"&style=voronoi", "a", nil, ""); w.Code != http.StatusOK {
+			t.Errorf("%v: expected it rendered, given %v %s", name, w.Code, w.Body)
+		}
+	}
+}
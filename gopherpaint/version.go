@@ -0,0 +1,210 @@
+package gopherpaint
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Version is a style applied to an image, kept in its history so it
+// can be restored.
+type Version struct {
+	ID      string
+	OwnerID string
+	Blobkey string
+	Style   string
+	// Params holds the render parameters, with the seed, encoded as a
+	// query string.
+	Params       string
+	CreationTime time.Time
+	// Pinned versions are the favorites of the user, they are never
+	// dropped from the history.
+	Pinned bool
+}
+
+// maxVersions is how many versions of an image are kept, besides the
+// pinned ones.
+const maxVersions = 50
+
+// RenderQuery is the query string used to render the version.
+func (v *Version) RenderQuery() template.URL {
+	return renderQuery(v.Blobkey, v.Style, v.Params)
+}
+
+// query returns the style and the parameters of the version as a
+// query string.
+func (v *Version) query() string {
+	q := url.Values{"style": {v.Style}}.Encode()
+	if v.Params != "" {
+		q += "&" + v.Params
+	}
+	return q
+}
+
+// Seed returns the seed of the random strokes of the version.
+func (v *Version) Seed() string {
+	q, _ := url.ParseQuery(v.Params)
+	if seed := q.Get("seed"); seed != "" {
+		return seed
+	}
+	return "0"
+}
+
+// Versions_Add records the current style of the image in its history,
+// unless it is the latest version already. The oldest versions that
+// aren't pinned are dropped when there are too many.
+func Versions_Add(repo VersionRepository, m *Image, when time.Time) error {
+	versions, err := repo.OfImage(m.OwnerID, m.Blobkey)
+	if err != nil {
+		return err
+	}
+	if len(versions) > 0 && versions[0].Style == m.Style && versions[0].Params == m.Params {
+		return nil
+	}
+	v := &Version{
+		ID:           randomKey(8),
+		OwnerID:      m.OwnerID,
+		Blobkey:      m.Blobkey,
+		Style:        m.Style,
+		Params:       m.Params,
+		CreationTime: when,
+	}
+	if err := repo.Put(v); err != nil {
+		return err
+	}
+	kept := 1
+	for _, old := range versions {
+		if old.Pinned {
+			continue
+		}
+		if kept++; kept > maxVersions {
+			if err := repo.Delete(old.OwnerID, old.Blobkey, old.ID); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func Versions_OfImage(repo VersionRepository, ownerID, blobkey string) ([]Version, error) {
+	return repo.OfImage(ownerID, blobkey)
+}
+
+// Versions_Restore paints the image again with an earlier version.
+func Versions_Restore(st *Storage, ownerID, blobkey, id string) error {
+	v, err := st.Versions.Get(ownerID, blobkey, id)
+	if err != nil {
+		return err
+	}
+	return Images_UpdateStyle(st, ownerID, blobkey, v.Style, v.Params)
+}
+
+// Versions_SetPinned pins a version of an image, or unpins it.
+func Versions_SetPinned(repo VersionRepository, ownerID, blobkey, id string, pinned bool) error {
+	v, err := repo.Get(ownerID, blobkey, id)
+	if err != nil {
+		return err
+	}
+	if v.Pinned == pinned {
+		return nil
+	}
+	v.Pinned = pinned
+	return repo.Put(v)
+}
+
+// Versions_DeleteOfImage deletes the history of an image.
+func Versions_DeleteOfImage(repo VersionRepository, ownerID, blobkey string) error {
+	versions, err := repo.OfImage(ownerID, blobkey)
+	if err != nil {
+		return err
+	}
+	for _, v := range versions {
+		if err := repo.Delete(ownerID, blobkey, v.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// handleVersions shows the history of the styles of an image.
+func handleVersions(w http.ResponseWriter, r *http.Request) {
+	c := loggerFor(r)
+	st := storageFor(r)
+	u := auth.Current(r)
+	if u == nil {
+		url, err := auth.LoginURL(r, r.URL.String())
+		if err != nil {
+			serveError(c, w, err, r)
+			return
+		}
+		http.Redirect(w, r, url, http.StatusFound)
+		return
+	}
+	m, err := Images_GetOne(st.Images, u.ID, r.FormValue("blobKey"))
+	if err != nil {
+		if err == ErrNotFound {
+			http.NotFound(w, r)
+			return
+		}
+		serveError(c, w, err, r)
+		return
+	}
+	versions, err := Versions_OfImage(st.Versions, u.ID, m.Blobkey)
+	if err != nil {
+		serveError(c, w, err, r)
+		return
+	}
+
+	context := make(map[string]interface{})
+	context["csrf"] = csrfToken(w, r)
+	context["IsLogged"] = true
+	context["UserName"] = u.String()
+	context["LogoutURL"], err = auth.LogoutURL(r, "/")
+	if err != nil {
+		c.Errorf("Error versions logged: %v", err)
+	}
+	context["image"] = m
+	context["Versions"] = versions
+	context["Lifetimes"] = shareLifetimes
+	templates["versions"].Execute(w, context)
+}
+
+// handleVersionEdit restores, pins and unpins the versions of an image.
+func handleVersionEdit(w http.ResponseWriter, r *http.Request) {
+	c := loggerFor(r)
+	st := storageFor(r)
+	u := auth.Current(r)
+	if r.Method != "POST" || u == nil {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+	if err := checkCSRF(r, r.FormValue("csrf")); err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	r.ParseForm()
+	blobkey := r.FormValue("blobKey")
+	id := r.FormValue("id")
+	var err error
+	switch r.FormValue("action") {
+	case "restore":
+		err = Versions_Restore(st, u.ID, blobkey, id)
+	case "pin":
+		err = Versions_SetPinned(st.Versions, u.ID, blobkey, id, true)
+	case "unpin":
+		err = Versions_SetPinned(st.Versions, u.ID, blobkey, id, false)
+	default:
+		err = badRequest(fmt.Errorf("unknown action %q", r.FormValue("action")))
+	}
+	if err != nil {
+		if status := errorStatus(err); status != http.StatusInternalServerError {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		serveError(c, w, err, r)
+		return
+	}
+	http.Redirect(w, r, "/versions?blobKey="+url.QueryEscape(blobkey), http.StatusFound)
+}
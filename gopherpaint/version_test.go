@@ -0,0 +1,131 @@
+//go:build !appengine
+// +build !appengine
+
+package gopherpaint
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestVersions(t *testing.T) {
+	mux, st, done := setupAPITest(t)
+	defer done()
+	var err error
+	if templates, err = loadTemplates(filepath.Join("..", "templates")); err != nil {
+		t.Fatal(err)
+	}
+	id := apiUpload(t, mux, "a").ID
+	m, _ := st.Images.Get("a", id)
+	original := m.Style
+
+	for _, style := range []string{"voronoi", "grayscale", "grayscale"} {
+		if err := Images_UpdateStyle(st, "a", id, style, "seed=7"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	versions, err := Versions_OfImage(st.Versions, "a", id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 3 || versions[0].Style != "grayscale" || versions[2].Style != original {
+		t.Fatalf("Expected the original style and the 2 changes, given %+v", versions)
+	}
+	if versions[0].Seed() != "7" || versions[2].Seed() != "0" {
+		t.Errorf("Expected the seeds kept, given %v and %v", versions[0].Seed(), versions[2].Seed())
+	}
+
+	edit := func(user string, form url.Values) *httptest.ResponseRecorder {
+		return apiDo(mux, "POST", "/versions/edit", user, strings.NewReader(form.Encode()), "application/x-www-form-urlencoded")
+	}
+	voronoi := versions[1].ID
+	if w := edit("a", url.Values{"action": {"restore"}, "blobKey": {id}, "id": {voronoi}}); w.Code != http.StatusFound {
+		t.Errorf("Expected a redirect to the history, given %v %s", w.Code, w.Body)
+	}
+	if m, _ = st.Images.Get("a", id); m.Style != "voronoi" || m.Params != "seed=7" {
+		t.Errorf("Expected the version restored, given %+v", m)
+	}
+	edit("a", url.Values{"action": {"pin"}, "blobKey": {id}, "id": {voronoi}})
+	if v, _ := st.Versions.Get("a", id, voronoi); v == nil || !v.Pinned {
+		t.Errorf("Expected the version pinned, given %+v", v)
+	}
+	if w := edit("b", url.Values{"action": {"restore"}, "blobKey": {id}, "id": {voronoi}}); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for the image of another user, given %v", w.Code)
+	}
+
+	w := apiDo(mux, "GET", "/versions?blobKey="+id, "a", nil, "")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "Pinned") {
+		t.Errorf("Expected the history with the pinned version, given %v", w.Code)
+	}
+	if w = apiDo(mux, "GET", "/versions?blobKey="+id, "b", nil, ""); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for the history of another user, given %v", w.Code)
+	}
+
+	// Long histories forget their oldest versions, but not the
+	// pinned ones.
+	for i := 0; i < maxVersions+5; i++ {
+		style := "grayscale"
+		if i%2 == 0 {
+			style = "oilpaint"
+		}
+		Images_UpdateStyle(st, "a", id, style, "")
+	}
+	versions, _ = Versions_OfImage(st.Versions, "a", id)
+	if len(versions) != maxVersions+1 {
+		t.Errorf("Expected %d versions, given %d", maxVersions+1, len(versions))
+	}
+	if v, err := st.Versions.Get("a", id, voronoi); err != nil || !v.Pinned {
+		t.Errorf("Expected the pinned version kept, given %v", err)
+	}
+
+	if err := Images_Delete(st, "a", id); err != nil {
+		t.Fatal(err)
+	}
+	if versions, _ = Versions_OfImage(st.Versions, "a", id); len(versions) != 0 {
+		t.Errorf("Expected the history deleted with the image, given %d versions", len(versions))
+	}
+}
+
+func TestStyleSave(t *testing.T) {
+	mux, st, done := setupAPITest(t)
+	defer done()
+	var err error
+	if templates, err = loadTemplates(filepath.Join("..", "templates")); err != nil {
+		t.Fatal(err)
+	}
+	id := apiUpload(t, mux, "a").ID
+	count := func() int {
+		versions, _ := st.Versions.OfImage("a", id)
+		return len(versions)
+	}
+
+	// Previews don't change the image.
+	if w := apiDo(mux, "GET", "/share?blobKey="+id+"&style=grayscale&seed=3", "a", nil, ""); w.Code != http.StatusOK {
+		t.Fatalf("Expected the preview, given %v", w.Code)
+	}
+	if m, _ := st.Images.Get("a", id); m.Style != "voronoi" || count() != 0 {
+		t.Errorf("Expected the style unchanged by the preview, given %v and %v versions", m.Style, count())
+	}
+
+	save := func(method, style, params string) *httptest.ResponseRecorder {
+		form := url.Values{"blobKey": {id}, "style": {style}, "params": {params}}
+		return apiDo(mux, method, "/share/save", "a", strings.NewReader(form.Encode()), "application/x-www-form-urlencoded")
+	}
+	if save("GET", "grayscale", "seed=3"); count() != 0 {
+		t.Errorf("Expected only posts to save, given %v versions", count())
+	}
+	w := save("POST", "grayscale", "seed=3&size=9")
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "/share?blobKey="+id+"&style=grayscale&seed=3" {
+		t.Errorf("Expected a redirection to the preview, given %v %q", w.Code, w.Header().Get("Location"))
+	}
+	if m, _ := st.Images.Get("a", id); m.Style != "grayscale" || m.Params != "seed=3" || count() != 2 {
+		t.Errorf("Expected the style saved with the old one as a version, given %+v and %v versions", m, count())
+	}
+	if save("POST", "grayscale", "seed=3"); count() != 2 {
+		t.Errorf("Expected no version for the same style, given %v", count())
+	}
+}